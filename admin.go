@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveAdmin runs the JSON admin API
+func serveAdmin(addr string, tokens map[string]string, router *Router, config func() *EffectiveConfig) {
+	go sampleRates()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, config())
+	})
+	mux.HandleFunc("/sessions", handleSessions)
+	mux.HandleFunc("/memory", handleMemory)
+	mux.HandleFunc("/udp", handleUDPStats)
+	mux.HandleFunc("/block", handleBlock)
+	mux.HandleFunc("/explain", handleExplain)
+	mux.HandleFunc("/fallback", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"attempts":      fallbackStats.Attempts.Load(),
+			"succeeded":     fallbackStats.Succeeded.Load(),
+			"failed":        fallbackStats.Failed.Load(),
+			"cert_failures": fallbackStats.CertFailures.Load(),
+			"unreachable":   fallbackStats.Unreachable.Load(),
+			"retries":       retryStats.Retries.Load(),
+			"retry_ok":      retryStats.Succeeded.Load(),
+			"retry_failed":  retryStats.Failed.Load(),
+		})
+	})
+	mux.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		if exporter == nil {
+			http.Error(w, "session export disabled", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, exporter.stats())
+	})
+	mux.HandleFunc("/exits", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, exits.list())
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, health.list())
+	})
+	mux.HandleFunc("/groups", handleGroups)
+	mux.HandleFunc("/speedtest", handleSpeedTest)
+	mux.HandleFunc("/traffic", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, trafficStats())
+	})
+	mux.HandleFunc("/routecache", func(w http.ResponseWriter, r *http.Request) {
+		if router.cache == nil {
+			http.Error(w, "route cache disabled", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, router.cache.stats())
+	})
+	log.Printf("Admin API on %s\n", addr)
+	var handler http.Handler = mux
+	if len(tokens) > 0 {
+		handler = adminAuth(tokens, mux)
+	}
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Println("Admin server failed:", err)
+	}
+}
+
+// Admin token roles: "read" tokens may only use GET, "admin" tokens may also
+// change state (block clients, toggle tracing)
+const (
+	roleRead  = "read"
+	roleAdmin = "admin"
+)
+
+// checkAdminTokens validates the roles of the admin tokens
+func checkAdminTokens(tokens map[string]string) error {
+	for _, role := range tokens {
+		if role != roleRead && role != roleAdmin {
+			return fmt.Errorf("admin_tokens: unknown role %q", role)
+		}
+	}
+	return nil
+}
+
+// adminAuth requires a "Authorization: Bearer <token>" header and a role
+// allowed to use the request method
+func adminAuth(tokens map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		role := ""
+		for token, tokenRole := range tokens {
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				role = tokenRole
+			}
+		}
+		switch {
+		case role == "":
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		case role == roleRead && r.Method != http.MethodGet && r.Method != http.MethodHead:
+			http.Error(w, "read-only token", http.StatusForbidden)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// writeJSON sends v as an indented JSON response
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// sessionMemory is a session with its memory usage, as reported by /memory
+type sessionMemory struct {
+	*Session
+	Memory int64 `json:"memory"`
+}
+
+// sessionTraffic is a session with its traffic and throughput, as reported
+// by /sessions; rates are in bytes per second
+type sessionTraffic struct {
+	*Session
+	BytesUp   int64 `json:"bytes_up"`
+	BytesDown int64 `json:"bytes_down"`
+	RateUp    int64 `json:"rate_up"`   // Estimated over the last seconds
+	RateDown  int64 `json:"rate_down"` // Estimated over the last seconds
+	AvgUp     int64 `json:"avg_up"`    // Since the session started
+	AvgDown   int64 `json:"avg_down"`  // Since the session started
+}
+
+// handleSessions lists the active sessions with their throughput;
+// ?sort=rate orders them by current throughput, busiest first, and ?top=N
+// limits the list
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	list := []sessionTraffic{}
+	for _, s := range sessions.list() {
+		t := sessionTraffic{Session: s}
+		t.BytesUp, t.BytesDown = s.Bytes()
+		t.RateUp, t.RateDown = s.Rates()
+		if age := time.Since(s.Start); age >= time.Second {
+			t.AvgUp = t.BytesUp * int64(time.Second) / int64(age)
+			t.AvgDown = t.BytesDown * int64(time.Second) / int64(age)
+		}
+		list = append(list, t)
+	}
+	switch r.URL.Query().Get("sort") {
+	case "", "id":
+	case "rate":
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].RateUp+list[i].RateDown > list[j].RateUp+list[j].RateDown
+		})
+	default:
+		http.Error(w, "invalid sort", http.StatusBadRequest)
+		return
+	}
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+		list = list[:min(n, len(list))]
+	}
+	writeJSON(w, list)
+}
+
+// handleMemory reports session memory aggregates and the top consumers;
+// ?top=N sets how many sessions are listed (default 10)
+func handleMemory(w http.ResponseWriter, r *http.Request) {
+	top := 10
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	var total int64
+	var list []sessionMemory
+	for _, s := range sessions.list() {
+		m := sessionMemory{Session: s, Memory: s.Memory()}
+		total += m.Memory
+		list = append(list, m)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Memory > list[j].Memory })
+	if len(list) > top {
+		list = list[:top]
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	writeJSON(w, map[string]any{
+		"sessions":      sessions.count(),
+		"session_bytes": total,
+		"top":           list,
+		"runtime": map[string]any{
+			"heap_alloc": ms.HeapAlloc,
+			"heap_inuse": ms.HeapInuse,
+			"sys":        ms.Sys,
+			"goroutines": runtime.NumGoroutine(),
+		},
+	})
+}
+
+// handleBlock lists blocked client IPs (GET), blocks one and terminates its
+// sessions (POST ?ip=) or lifts a block (DELETE ?ip=)
+func handleBlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, blocks.list())
+		return
+	}
+	ip := net.ParseIP(r.URL.Query().Get("ip"))
+	if ip == nil {
+		http.Error(w, "invalid ip", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		closed := blocks.block(ip)
+		log.Printf("Blocked %s, closed %d sessions\n", ip, closed)
+		writeJSON(w, map[string]any{"ip": ip.String(), "closed": closed})
+	case http.MethodDelete:
+		if !blocks.unblock(ip) {
+			http.Error(w, "not blocked", http.StatusNotFound)
+			return
+		}
+		log.Printf("Unblocked %s\n", ip)
+		writeJSON(w, map[string]any{"ip": ip.String()})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleExplain shows (GET) or sets (POST
+// ?on=true|false&source=<cidr>&dest=<domain or cidr>) routing decision
+// tracing
+func handleExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+		if err != nil {
+			http.Error(w, "invalid on", http.StatusBadRequest)
+			return
+		}
+		var source *net.IPNet
+		if v := r.URL.Query().Get("source"); v != "" {
+			source, err = parseCIDR(v)
+			if err != nil {
+				http.Error(w, "invalid source", http.StatusBadRequest)
+				return
+			}
+		}
+		explain.set(on, source, r.URL.Query().Get("dest"))
+		log.Printf("Explain mode: %v\n", explain.status())
+	}
+	writeJSON(w, explain.status())
+}
+
+// handleUDPStats reports the UDP relay counters
+func handleUDPStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"associations":       udpStats.Associations.Load(),
+		"datagrams":          udpStats.Datagrams.Load(),
+		"reply_datagrams":    udpStats.Replies.Load(),
+		"dropped":            udpStats.Dropped.Load(),
+		"fragments":          udpStats.Fragments.Load(),
+		"fragments_dropped":  udpStats.FragDropped.Load(),
+		"reassembled":        udpStats.Reassembled.Load(),
+		"foreign":            udpStats.Foreign.Load(),
+		"fragments_repeated": udpStats.FragRepeated.Load(),
+		"replayed":           udpStats.Replayed.Load(),
+		"reclaimed":          udpStats.Reclaimed.Load(),
+	})
+}
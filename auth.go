@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ProbeResistanceConfig hides the SOCKS server from active probing: failed
+// handshakes get no SOCKS error replies, only the configured response or
+// silence, after a random delay
+type ProbeResistanceConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Response string   `json:"response"` // Sent to failed probes, e.g. an HTTP 400 page; empty to stay silent
+	Jitter   Duration `json:"jitter"`   // Upper bound of the random delay before answering/closing, default 3s
+}
+
+// probeError is a handshake failure that looks like a probe (wrong
+// protocol, no acceptable method, bad credentials)
+type probeError struct {
+	msg string
+}
+
+func (e *probeError) Error() string { return e.msg }
+
+// errProbeOnly reports a client let in without credentials on a listener
+// with users, because a health probe destination is configured; it may
+// only CONNECT to that destination
+var errProbeOnly = errors.New("unauthenticated client limited to the health probe")
+
+// handleHandshake performs the SOCKS5 handshake, requiring username/password
+// authentication (RFC 1929) when users are configured. It returns the
+// authenticated user name, or errProbeOnly when a client offering only no
+// auth is accepted for the health probe.
+func handleHandshake(conn net.Conn, cfg *Config) (string, error) {
+	quiet := cfg.ProbeResistance.Enabled
+	// Version, method count, methods
+	sb := scratchBuffers.Get().(*[]byte)
+	defer scratchBuffers.Put(sb)
+	buf := *sb
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 0x05 {
+		return "", &probeError{"invalid version"}
+	}
+	methods := buf[2 : 2+int(buf[1])]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	if len(cfg.Users) == 0 {
+		if bytes.IndexByte(methods, 0x00) < 0 {
+			if !quiet {
+				conn.Write(replyNoMethod)
+			}
+			return "", &probeError{"no supported auth method"}
+		}
+		_, err := conn.Write(replyNoAuth)
+		return "", err
+	}
+
+	if bytes.IndexByte(methods, 0x02) < 0 {
+		// Load balancer health checks rarely carry credentials
+		if cfg.Probe != "" && bytes.IndexByte(methods, 0x00) >= 0 {
+			if _, err := conn.Write(replyNoAuth); err != nil {
+				return "", err
+			}
+			return "", errProbeOnly
+		}
+		if !quiet {
+			conn.Write(replyNoMethod)
+		}
+		return "", &probeError{"client does not offer username/password auth"}
+	}
+	if _, err := conn.Write(replyUserPass); err != nil {
+		return "", err
+	}
+	user, pass, err := readUserPass(conn)
+	if err != nil {
+		return "", err
+	}
+	want, ok := cfg.Users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(pass), []byte(want)) != 1 {
+		if !quiet {
+			conn.Write(replyAuthFailed)
+		}
+		return "", &probeError{fmt.Sprintf("authentication failed for user %q", user)}
+	}
+	_, err = conn.Write(replyAuthOK)
+	return user, err
+}
+
+// scratchBuffers recycle the buffers handshakes and requests are parsed
+// in; they fit the longest username/password request
+var scratchBuffers = sync.Pool{New: func() any {
+	b := make([]byte, 2+255+1+255)
+	return &b
+}}
+
+// Handshake replies, shared so answering a client does not allocate
+var (
+	replyNoAuth     = []byte{0x05, 0x00} // Version 5, no auth
+	replyUserPass   = []byte{0x05, 0x02} // Version 5, username/password
+	replyNoMethod   = []byte{0x05, 0xff} // No acceptable methods
+	replyAuthOK     = []byte{0x01, 0x00}
+	replyAuthFailed = []byte{0x01, 0x01}
+)
+
+// readUserPass reads an RFC 1929 username/password request
+func readUserPass(conn net.Conn) (string, string, error) {
+	// Version and username length, username, password length, password
+	sb := scratchBuffers.Get().(*[]byte)
+	defer scratchBuffers.Put(sb)
+	buf := *sb
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", "", err
+	}
+	if buf[0] != 0x01 {
+		return "", "", &probeError{"invalid auth version"}
+	}
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(conn, buf[2:2+ulen+1]); err != nil {
+		return "", "", err
+	}
+	plen := int(buf[2+ulen])
+	pass := buf[3+ulen : 3+ulen+plen]
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return "", "", err
+	}
+	return string(buf[2 : 2+ulen]), string(pass), nil
+}
+
+// answerProbe reacts to a failed handshake without revealing SOCKS: after a
+// random delay it sends the configured response (if any) and closes
+func answerProbe(conn net.Conn, cfg *ProbeResistanceConfig) {
+	jitter := time.Duration(cfg.Jitter)
+	if jitter == 0 {
+		jitter = 3 * time.Second
+	}
+	delay := time.Duration(rand.Int63n(int64(jitter)))
+
+	// Swallow whatever else the prober sends in the meantime
+	conn.SetReadDeadline(time.Now().Add(delay))
+	io.Copy(io.Discard, conn)
+	if cfg.Response != "" {
+		conn.Write([]byte(cfg.Response))
+	}
+}
+
+// isProbe reports whether a handshake error should be answered as a probe
+func isProbe(err error) bool {
+	var p *probeError
+	return errors.As(err, &p)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshakes are client greetings, with credentials where users are
+// configured
+var handshakes = []struct {
+	name  string
+	cfg   *Config
+	greet []byte
+	user  string
+}{
+	{"no auth", &Config{}, []byte{0x05, 0x01, 0x00}, ""},
+	{"username/password", &Config{Users: map[string]string{"alice": "secret"}},
+		append([]byte{0x05, 0x02, 0x00, 0x02, 0x01, 5, 'a', 'l', 'i', 'c', 'e', 6}, "secret"...), "alice"},
+}
+
+func TestHandleHandshake(t *testing.T) {
+	for _, tt := range handshakes {
+		user, err := handleHandshake(newMemConn(tt.greet), tt.cfg)
+		if err != nil || user != tt.user {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, user, err, tt.user)
+		}
+	}
+}
+
+// TestHandleHandshakeAllocs guards the allocations of the handshake: none
+// without users, the user name and password strings with them
+func TestHandleHandshakeAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts differ under the race detector")
+	}
+	for i, want := range []float64{0, 2} {
+		tt := handshakes[i]
+		conn := newMemConn(tt.greet)
+		allocs := testing.AllocsPerRun(100, func() {
+			conn.r.Reset(tt.greet)
+			handleHandshake(conn, tt.cfg)
+		})
+		if allocs > want {
+			t.Errorf("%s: handleHandshake allocates %v times, want at most %v", tt.name, allocs, want)
+		}
+	}
+}
+
+func BenchmarkHandleHandshake(b *testing.B) {
+	for _, tt := range handshakes {
+		b.Run(tt.name, func(b *testing.B) {
+			conn := newMemConn(tt.greet)
+			b.ReportAllocs()
+			for range b.N {
+				conn.r.Reset(tt.greet)
+				if _, err := handleHandshake(conn, tt.cfg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestProbeWithoutCredentials checks that a listener with users answers
+// the health probe to clients without credentials, and nothing else
+func TestProbeWithoutCredentials(t *testing.T) {
+	users := map[string]string{"alice": "secret"}
+	noAuth := []byte{0x05, 0x01, 0x00}
+	login := append([]byte{0x05, 0x01, 0x02, 0x01, 5, 'a', 'l', 'i', 'c', 'e', 6}, "secret"...)
+	probe := append(append([]byte{0x05, 0x01, 0x00, 0x03, 14}, "probe.internal"...), 0x00, 0x01)
+	other := append(append([]byte{0x05, 0x01, 0x00, 0x03, 11}, "example.com"...), 0x01, 0xbb)
+	udpProbe := append([]byte{0x05, 0x03}, probe[2:]...)
+	concat := func(b ...[]byte) []byte { return bytes.Join(b, nil) }
+	tests := []struct {
+		name   string
+		probe  string
+		stream []byte
+		want   []byte
+	}{
+		{"probe without credentials", "probe.internal:1", concat(noAuth, probe), concat(replyNoAuth, replies[0x00])},
+		{"probe with credentials", "probe.internal:1", concat(login, probe), concat(replyUserPass, replyAuthOK, replies[0x00])},
+		{"other destination", "probe.internal:1", concat(noAuth, other), concat(replyNoAuth, replies[0x02])},
+		{"UDP to the probe", "probe.internal:1", concat(noAuth, udpProbe), concat(replyNoAuth, replies[0x02])},
+		{"no probe configured", "", concat(noAuth, probe), replyNoMethod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go handleClient(server, &Config{Users: users, Probe: tt.probe}, nil)
+			go client.Write(tt.stream)
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
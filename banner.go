@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EffectiveConfig summarizes the fully resolved configuration that is
+// running, logged at startup and served by the admin API
+type EffectiveConfig struct {
+	Listen    string                     `json:"listen"`
+	Health    string                     `json:"health,omitempty"`
+	Admin     string                     `json:"admin,omitempty"`
+	Outbounds map[string]string          `json:"outbounds"`
+	DialHooks []string                   `json:"dial_hooks,omitempty"`
+	Default   string                     `json:"default"`
+	Fallback  string                     `json:"fallback,omitempty"`
+	DNS       string                     `json:"dns"`
+	Rules     []RuleSummary              `json:"rules"`
+	Sources   map[string]int             `json:"rule_sources"` // Number of rules per matcher type
+	Providers map[string]ProviderSummary `json:"providers,omitempty"`
+	GeoData   []DataFileSummary          `json:"geodata,omitempty"`
+}
+
+// RuleSummary describes one compiled rule
+type RuleSummary struct {
+	Match     string `json:"match"`
+	Outbound  string `json:"outbound,omitempty"`
+	Split     string `json:"split,omitempty"`   // e.g. "direct:10,upstream:90"
+	Entries   int    `json:"entries,omitempty"` // Domains/CIDRs behind the matcher
+	Scheduled bool   `json:"scheduled,omitempty"`
+	DNS       string `json:"dns,omitempty"`
+	Fallback  string `json:"fallback,omitempty"`
+	Log       string `json:"log,omitempty"`
+}
+
+// ProviderSummary describes a loaded rule provider
+type ProviderSummary struct {
+	URL     string    `json:"url,omitempty"`
+	Path    string    `json:"path"`
+	Format  string    `json:"format"`
+	Entries int       `json:"entries"`
+	Updated time.Time `json:"updated"`
+}
+
+// DataFileSummary identifies the version of a loaded data file by its size
+// and modification time, as dat/mmdb files carry no version of their own
+type DataFileSummary struct {
+	Kind     string    `json:"kind"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// entryCounter is implemented by matchers backed by lists
+type entryCounter interface {
+	entries() int
+}
+
+func (d *domainMatcher) entries() int {
+	return len(d.full) + len(d.suffix) + len(d.keywords) + len(d.regexps)
+}
+
+func (i *ipMatcher) entries() int {
+	return len(i.nets)
+}
+
+func (a anyMatcher) entries() int {
+	n := 0
+	for _, m := range a {
+		n += countEntries(m)
+	}
+	return n
+}
+
+func (e exceptMatcher) entries() int {
+	return countEntries(e.match)
+}
+
+func (p *RuleProvider) entries() int {
+	return p.matcher.Load().entries()
+}
+
+func (a andMatcher) entries() int {
+	n := 0
+	for _, part := range a {
+		n += countEntries(part)
+	}
+	return n
+}
+
+// countEntries returns the list size behind a matcher, 0 for simple ones
+func countEntries(m Matcher) int {
+	if c, ok := m.(entryCounter); ok {
+		return c.entries()
+	}
+	return 0
+}
+
+// effectiveConfig builds the summary of what is running
+func effectiveConfig(cfg *Config, router *Router, geo *GeoData) *EffectiveConfig {
+	e := &EffectiveConfig{
+		Listen:    cfg.Listen,
+		Health:    cfg.Health,
+		Admin:     cfg.Admin,
+		Outbounds: map[string]string{},
+		DialHooks: cfg.DialHooks,
+		Default:   router.Default,
+		Fallback:  router.Fallback,
+		DNS:       defaultDNS.Name,
+		Sources:   map[string]int{},
+		Providers: map[string]ProviderSummary{},
+	}
+	for tag, ob := range outbounds {
+		e.Outbounds[tag] = fmt.Sprint(ob)
+	}
+	for _, rule := range router.Rules {
+		kind, _, _ := strings.Cut(rule.Match, ":")
+		if _, ok := rule.Matcher.(andMatcher); ok {
+			kind = "and"
+		}
+		e.Sources[kind]++
+		s := RuleSummary{
+			Match:     rule.Match,
+			Outbound:  rule.Outbound,
+			Entries:   countEntries(rule.Matcher),
+			Scheduled: rule.Schedule != nil,
+			Fallback:  rule.Fallback,
+		}
+		if rule.DNS != nil {
+			s.DNS = rule.DNS.Name
+		}
+		if rule.Log != logNormal {
+			s.Log = rule.Log.String()
+		}
+		for i, t := range rule.Split {
+			if i > 0 {
+				s.Split += ","
+			}
+			s.Split += fmt.Sprintf("%s:%d", t.Outbound, t.Weight)
+		}
+		e.Rules = append(e.Rules, s)
+	}
+	for name, p := range providers {
+		s := ProviderSummary{URL: p.cfg.URL, Path: p.cfg.Path, Format: p.cfg.Format, Entries: p.entries()}
+		if info, err := os.Stat(p.cfg.Path); err == nil {
+			s.Updated = info.ModTime()
+		}
+		e.Providers[name] = s
+	}
+	for _, f := range geo.files() {
+		if info, err := os.Stat(f.Path); err == nil {
+			f.Size = info.Size()
+			f.Modified = info.ModTime()
+		}
+		e.GeoData = append(e.GeoData, f)
+	}
+	sort.Slice(e.GeoData, func(i, j int) bool { return e.GeoData[i].Kind < e.GeoData[j].Kind })
+	return e
+}
+
+// logEffectiveConfig prints the startup banner
+func logEffectiveConfig(e *EffectiveConfig) {
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		log.Println("Effective configuration:", err)
+		return
+	}
+	log.Printf("Effective configuration:\n%s\n", b)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// newBindDialer returns a dialer whose connections leave through a network
+// interface, from a local address and/or with a firewall mark for policy
+// routing, nil when none is set
+func newBindDialer(iface, source string, mark int) (*net.Dialer, error) {
+	if iface == "" && source == "" && mark == 0 {
+		return nil, nil
+	}
+	if mark < 0 {
+		return nil, fmt.Errorf("mark: must be positive")
+	}
+	d := &net.Dialer{}
+	if source != "" {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, fmt.Errorf("source: invalid IP address %q", source)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if iface != "" {
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return nil, fmt.Errorf("interface: %v", err)
+		}
+	}
+	if iface != "" || mark != 0 {
+		control, err := socketControl(iface, mark)
+		if err != nil {
+			return nil, err
+		}
+		d.Control = control
+	}
+	return d, nil
+}
+
+// listenBound opens a UDP socket for datagrams to any destination with the
+// settings of a bind dialer (interface, source address and mark), or an
+// unbound one when d is nil
+func listenBound(d *net.Dialer) (*net.UDPConn, error) {
+	if d == nil {
+		return net.ListenUDP("udp", nil)
+	}
+	addr := ":0"
+	if src, ok := d.LocalAddr.(*net.TCPAddr); ok {
+		addr = net.JoinHostPort(src.IP.String(), "0")
+	}
+	lc := net.ListenConfig{Control: d.Control}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// defaultDialTimeout bounds dials without a timeout of their own, rather
+// than waiting for the kernel to give up on a dead host
+const defaultDialTimeout = 30 * time.Second
+
+// dialBound dials a TCP address with a bind dialer, or the default one
+// when d is nil. The shorter of timeout and the dialer's own timeout
+// applies, defaultDialTimeout when neither is set.
+func dialBound(d *net.Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	if d != nil && d.Timeout > 0 && (timeout == 0 || d.Timeout < timeout) {
+		timeout = d.Timeout
+	}
+	if timeout == 0 {
+		timeout = defaultDialTimeout
+	}
+	if d == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	dd := *d
+	dd.Timeout = timeout
+	return dd.Dial("tcp", addr)
+}
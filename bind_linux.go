@@ -0,0 +1,28 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// socketControl returns a socket control function binding sockets to an
+// interface with SO_BINDTODEVICE (needs CAP_NET_RAW) and/or setting their
+// firewall mark with SO_MARK (needs CAP_NET_ADMIN)
+func socketControl(iface string, mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if iface != "" {
+				serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+			}
+			if serr == nil && mark != 0 {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockopt reads an integer socket option of a UDP socket
+func sockopt(t *testing.T, conn *net.UDPConn, opt int) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	raw.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	})
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+// TestUDPOutMark checks that the sockets a UDP association sends from
+// carry the mark of the direct outbound the destination is routed to
+func TestUDPOutMark(t *testing.T) {
+	marked, err := newBindDialer("", "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &udpAssociation{session: &Session{}}
+	defer a.closeOuts()
+	out, err := a.outFor("direct", directOutbound{dialer: marked})
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting SO_MARK needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark := sockopt(t, out, syscall.SO_MARK); mark != 100 {
+		t.Errorf("mark %d, want 100", mark)
+	}
+	if again, _ := a.outFor("direct", directOutbound{dialer: marked}); again != out {
+		t.Error("a second destination of the outbound got another socket")
+	}
+	plain, err := a.outFor("plain", directOutbound{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark := sockopt(t, plain, syscall.SO_MARK); mark != 0 {
+		t.Errorf("unbound outbound's socket has mark %d", mark)
+	}
+	a.closeOuts()
+	if _, err := a.outFor("other", directOutbound{}); err == nil {
+		t.Error("socket opened after the association ended")
+	}
+}
+
+// TestUDPOutBind checks that the socket of a direct outbound is bound to
+// its source address, with its interface set
+func TestUDPOutBind(t *testing.T) {
+	d, err := newBindDialer("lo", "127.0.0.1", 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	a := &udpAssociation{session: &Session{}}
+	defer a.closeOuts()
+	out, err := a.outFor("direct", directOutbound{dialer: d})
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("SO_BINDTODEVICE needs CAP_NET_RAW")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := out.LocalAddr().(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("bound to %v, want the source 127.0.0.1", ip)
+	}
+	// Datagrams leave from the source address
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := out.WriteToUDP([]byte("x"), peer.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, from, err := peer.ReadFromUDP(make([]byte, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.Port != out.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("datagram from %v, want the outbound's socket %v", from, out.LocalAddr())
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// socketControl is only implemented on Linux; elsewhere use "source" with
+// an address of the interface
+func socketControl(iface string, mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("interface and mark are only supported on Linux")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// blockTable holds client IPs refused by the admin API, persisted to a file
+// so blocks survive restarts until they are lifted
+type blockTable struct {
+	mu   sync.RWMutex
+	path string               // Empty to keep blocks in memory only
+	ips  map[string]time.Time // Block time by IP
+}
+
+var blocks = &blockTable{ips: map[string]time.Time{}}
+
+// load reads the persisted blocks; a missing file is not an error
+func (t *blockTable) load(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &t.ips); err != nil {
+		return fmt.Errorf("parse %s: %v", path, err)
+	}
+	return nil
+}
+
+// save writes the blocks to the file; called with mu held
+func (t *blockTable) save() {
+	if t.path == "" {
+		return
+	}
+	data, _ := json.MarshalIndent(t.ips, "", "  ")
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Println("Save blocks failed:", err)
+		return
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		log.Println("Save blocks failed:", err)
+	}
+}
+
+// blocked reports whether connections from addr are refused
+func (t *blockTable) blocked(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok = t.ips[tcp.IP.String()]
+	return ok
+}
+
+// block refuses an IP and closes its sessions, returning how many were
+// closed
+func (t *blockTable) block(ip net.IP) int {
+	t.mu.Lock()
+	if _, ok := t.ips[ip.String()]; !ok {
+		t.ips[ip.String()] = time.Now()
+		t.save()
+	}
+	t.mu.Unlock()
+	return sessions.closeSource(ip)
+}
+
+// unblock lifts a block, reporting whether there was one
+func (t *blockTable) unblock(ip net.IP) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.ips[ip.String()]; !ok {
+		return false
+	}
+	delete(t.ips, ip.String())
+	t.save()
+	return true
+}
+
+// BlockedIP is a block as listed by the admin API
+type BlockedIP struct {
+	IP    string    `json:"ip"`
+	Since time.Time `json:"since"`
+}
+
+// list returns the blocks ordered by IP
+func (t *blockTable) list() []BlockedIP {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]BlockedIP, 0, len(t.ips))
+	for ip, since := range t.ips {
+		list = append(list, BlockedIP{IP: ip, Since: since})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ClockCheckConfig enables the startup check of the system clock, which
+// breaks TLS certificate validation when it is far off, as it often is on
+// router hardware without an RTC
+type ClockCheckConfig struct {
+	Server     string   `json:"server"`     // NTP server ("pool.ntp.org") or http(s) URL whose Date header is used
+	MaxSkew    Duration `json:"max_skew"`   // Skew that is warned about, default 1m
+	Compensate bool     `json:"compensate"` // Use the corrected time for upstream TLS certificates and VMess headers
+}
+
+// clockSkew is the correction added to the system time when compensating,
+// in nanoseconds
+var clockSkew atomic.Int64
+
+// clockNow returns the system time corrected by the measured skew
+func clockNow() time.Time {
+	return time.Now().Add(time.Duration(clockSkew.Load()))
+}
+
+// checkClock measures the skew of the system clock and warns when it
+// exceeds the limit
+func checkClock(cfg *ClockCheckConfig) {
+	if cfg.Server == "" {
+		cfg.Server = "pool.ntp.org"
+	}
+	if cfg.MaxSkew == 0 {
+		cfg.MaxSkew = Duration(time.Minute)
+	}
+	skew, err := measureSkew(cfg.Server)
+	if err != nil {
+		log.Printf("Clock check via %s failed: %v", cfg.Server, err)
+		return
+	}
+	if skew.Abs() <= time.Duration(cfg.MaxSkew) {
+		log.Printf("Clock check: skew %v", skew.Round(time.Millisecond))
+		return
+	}
+	log.Printf("WARNING: system clock is off by %v (reference %s); TLS certificate checks will fail, fix the time with NTP",
+		skew.Round(time.Second), cfg.Server)
+	if cfg.Compensate {
+		clockSkew.Store(int64(skew))
+		log.Printf("Compensating clock skew for upstream TLS")
+	}
+}
+
+// measureSkew returns how far the reference time is ahead of the system
+// clock, taking the reference at the midpoint of the exchange
+func measureSkew(server string) (time.Duration, error) {
+	start := time.Now()
+	var ref time.Time
+	var err error
+	if strings.HasPrefix(server, "http://") || strings.HasPrefix(server, "https://") {
+		ref, err = httpTime(server)
+	} else {
+		ref, err = ntpTime(server)
+	}
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	return ref.Sub(start.Add(rtt / 2)), nil
+}
+
+// httpTime reads the Date header of a HEAD request, which is truncated to
+// the second, so the middle of that second is returned
+func httpTime(url string) (time.Time, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Head(url)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+	date := resp.Header.Get("Date")
+	if date == "" {
+		return time.Time{}, fmt.Errorf("no Date header")
+	}
+	t, err := http.ParseTime(date)
+	return t.Add(500 * time.Millisecond), err
+}
+
+// ntpEpoch is the NTP era 0 start, 1900-01-01, in Unix seconds
+const ntpEpoch = -2208988800
+
+// ntpTime asks an NTP server for the time with one SNTP request
+func ntpTime(server string) (time.Time, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, 5*time.Second)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := make([]byte, 48)
+	req[0] = 0x23 // LI 0, version 4, mode 3 (client)
+	if _, err := conn.Write(req); err != nil {
+		return time.Time{}, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if n < 48 || resp[0]&0x7 != 4 {
+		return time.Time{}, fmt.Errorf("invalid NTP response")
+	}
+	// Transmit timestamp: 32-bit seconds and 32-bit fraction
+	secs := int64(binary.BigEndian.Uint32(resp[40:44]))
+	frac := int64(binary.BigEndian.Uint32(resp[44:48]))
+	if secs == 0 {
+		return time.Time{}, fmt.Errorf("NTP server not synchronized")
+	}
+	return time.Unix(secs+ntpEpoch, frac*1e9>>32), nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Config is the JSON configuration file loaded with -config
+type Config struct {
+	Listen              string                    `json:"listen"`                // Local address to listen on
+	Upstream            string                    `json:"upstream"`              // Upstream SOCKS5 proxy, empty for none
+	Transport           *TransportConfig          `json:"transport"`             // How the upstream connection is carried, nil for plain TCP
+	Outbounds           map[string]OutboundConfig `json:"outbounds"`             // Named upstream proxies, usable as rule outbounds
+	GeoSite             string                    `json:"geosite"`               // Path to geosite.dat
+	GeoIP               string                    `json:"geoip"`                 // Path to geoip.dat
+	GeoSources          []GeoSourceConfig         `json:"geo_sources"`           // More geosite/geoip databases, consulted before geosite/geoip in order
+	ASN                 string                    `json:"asn"`                   // Path to a GeoLite2-ASN .mmdb file
+	Rules               []RuleConfig              `json:"rules"`                 // Routing rules, first match wins
+	Lists               map[string]ListConfig     `json:"lists"`                 // Custom domain/CIDR lists, referenced as "geosite:<name>", "geoip:<name>" or "list:<name>"
+	Providers           map[string]ProviderConfig `json:"providers"`             // Remote rule lists, referenced as "provider:<name>"
+	SoftFail            bool                      `json:"soft_fail"`             // Start without unavailable geo data/providers and retry them
+	DialHooks           []string                  `json:"dial_hooks"`            // Compiled-in dial hooks wrapping every outbound dial, outermost first
+	Default             string                    `json:"default"`               // Outbound used when no rule matches
+	Fallback            string                    `json:"fallback"`              // Outbound retried when the chosen one fails to connect, empty for none
+	DirectIfUnreachable bool                      `json:"direct_if_unreachable"` // Dial directly when an upstream proxy itself cannot be reached; leaks traffic past the proxy
+	Retry               *RetryConfig              `json:"retry"`                 // Retry transient dial failures with backoff, nil to dial once
+	Explain             bool                      `json:"explain"`               // Log the rule evaluation trace of every decision
+	RouteCache          Duration                  `json:"route_cache"`           // How long routing decisions per domain are cached, 0 to disable
+	Health              string                    `json:"health"`                // Address for /healthz and /readyz, empty to disable
+	Admin               string                    `json:"admin"`                 // Address for the JSON admin API, empty to disable
+	AdminTokens         map[string]string         `json:"admin_tokens"`          // Admin API bearer tokens and their role, "read" or "admin"; empty for no auth
+	Blocks              string                    `json:"blocks"`                // File persisting client IPs blocked through the admin API
+	StateFile           string                    `json:"state_file"`            // File keeping group choices, health state and warm domains across restarts
+	ShutdownReport      *ShutdownReportConfig     `json:"shutdown_report"`       // Webhook receiving the summary logged on SIGINT/SIGTERM
+	Export              *ExportConfig             `json:"export"`                // Send finished session records to ClickHouse/InfluxDB, nil to disable
+	ConnRate            *ConnRateConfig           `json:"conn_rate"`             // Limit new connections per destination host, nil for no limit
+	Watchdog            *WatchdogConfig           `json:"watchdog"`              // Dump goroutine stacks when relays stall, nil to disable
+	HealthCheck         *HealthCheckConfig        `json:"health_check"`          // Probe upstreams and stop routing to failing ones, nil to disable
+	ExitCheck           *ExitCheckConfig          `json:"exit_check"`            // Discover upstream exit IPs/countries, nil to disable
+	SpeedTest           *SpeedTestConfig          `json:"speedtest"`             // Test server of the speed tests run through the admin API, nil for the defaults
+	ClockCheck          *ClockCheckConfig         `json:"clock_check"`           // Warn about system clock skew at startup, nil to disable
+	Shadowsocks         *ShadowsocksConfig        `json:"shadowsocks"`           // Also accept Shadowsocks (AEAD) clients, nil to disable
+	Trojan              *TrojanConfig             `json:"trojan"`                // Also accept Trojan clients on a TLS listener, nil to disable
+	Users               map[string]string         `json:"users"`                 // SOCKS5 username/password pairs, empty for no auth
+	Mux                 bool                      `json:"mux"`                   // Accept multiplexed (sing-mux smux/yamux) sessions from clients
+	UDPOverTCP          bool                      `json:"udp_over_tcp"`          // Accept UDP-over-TCP (sing-box UoT) streams from clients
+	ReplyReason         bool                      `json:"reply_reason"`          // Follow failure replies with a "reason: ..." line for troubleshooting
+	ProbeResistance     ProbeResistanceConfig     `json:"probe_resistance"`      // Hide the server from active probing
+	Probe               string                    `json:"probe"`                 // Destination answered internally for health checks, e.g. "probe.internal:1"; reachable without credentials
+	Sniff               SniffConfig               `json:"sniff"`                 // Recover domains of raw-IP requests from TLS SNI / HTTP Host
+	UDPDedup            Duration                  `json:"udp_dedup"`             // Drop UDP datagrams repeated within this window per association, 0 to disable
+	UDPIdleTimeout      Duration                  `json:"udp_idle_timeout"`      // Close UDP associations that relay no datagram either way for this long, 0 for never
+	Zones               map[string]string         `json:"zones"`                 // IPv6 zone by link-local CIDR for direct dials, e.g. {"fe80::/10": "eth0"}
+	DNS                 string                    `json:"dns"`                   // Default resolution: "local", "remote", "none", a DNS server address or a DoH URL
+	DNSZones            map[string]string         `json:"dns_zones"`             // DNS server by domain, for the domain and its subdomains, e.g. {"corp.example": "10.0.0.53"}
+	DNSRules            []DNSRuleConfig           `json:"dns_rules"`             // Resolver by domain condition such as geosite:cn, first match wins, after dns_zones
+	DNSServer           *DNSServerConfig          `json:"dns_server"`            // Answer the DNS queries of clients, optionally with fake IPs; nil to disable
+	Hosts               map[string][]string       `json:"hosts"`                 // Static records: addresses, or one host name resolved instead, e.g. {"lab.example": ["10.0.0.5"]}
+	HostsFiles          []string                  `json:"hosts_files"`           // /etc/hosts-style files whose names override DNS, reread when they change
+	DNSCache            *DNSCacheConfig           `json:"dns_cache"`             // One answer cache for routing, dials and the DNS server; nil to resolve each time
+	DNSBootstrap        map[string][]string       `json:"dns_bootstrap"`         // Addresses of DoH server host names, e.g. {"dns.google": ["8.8.8.8"]}
+	Tenants             map[string]TenantConfig   `json:"tenants"`               // Isolated customer namespaces with their own listener, users, outbounds and rules
+}
+
+// OutboundConfig describes a named upstream proxy
+type OutboundConfig struct {
+	Protocol  string           `json:"protocol"`  // "socks5" (default), "http" (CONNECT), "vmess", "vless", "direct", "static", "chain", "urltest", "loadbalance", "select" or "race"
+	Address   string           `json:"address"`   // host:port of the proxy
+	Username  string           `json:"username"`  // Credentials, empty for no authentication
+	Password  string           `json:"password"`  // Password for Username
+	Transport *TransportConfig `json:"transport"` // How the connection is carried, nil for plain TCP
+	Chain     []string         `json:"chain"`     // For "chain": socks5 outbounds to go through, first hop first
+	Members   []string         `json:"members"`   // For groups ("urltest", "loadbalance", "select", "race"): outbounds to choose from
+	Test      *GroupTestConfig `json:"test"`      // For "urltest": how members are measured
+	Strategy  string           `json:"strategy"`  // For "loadbalance": "round-robin" (default) or "hash" (by destination)
+	Weights   map[string]int   `json:"weights"`   // For "loadbalance": member weights, default 1
+	UUID      string           `json:"uuid"`      // For "vmess" and "vless": user ID
+	Response  *ResponseConfig  `json:"response"`  // For "static": the HTTP response served
+
+	Interface    string     `json:"interface"`     // For proxies and "direct": network interface connections leave through, e.g. "wg0" (Linux)
+	Source       string     `json:"source"`        // For proxies and "direct": local IP address connections are made from
+	IPFamily     string     `json:"ip_family"`     // For "direct": "prefer_ipv4" (default), "prefer_ipv6", "ipv4_only" or "ipv6_only"
+	Mark         int        `json:"mark"`          // For proxies and "direct": firewall mark (SO_MARK, Linux) for policy routing, 0 for none
+	Pool         int        `json:"pool"`          // For "socks5" and "http": connections kept ready for every request, 0 for warm rules only
+	CertFallback string     `json:"cert_fallback"` // Outbound used while the TLS certificate fails verification
+	Mux          *MuxConfig `json:"mux"`           // For proxies: carry connections as streams of a few shared upstream connections, nil to disable
+	UDPOverTCP   bool       `json:"udp_over_tcp"`  // For proxies: carry UDP as UDP-over-TCP streams through the proxy
+	DialTimeout  Duration   `json:"dial_timeout"`  // For proxies and "direct": TCP connect timeout, default 30s
+	TLSTimeout   Duration   `json:"tls_timeout"`   // For proxies with a tls or ws transport: handshake timeout, default 10s
+	IdleTimeout  Duration   `json:"idle_timeout"`  // Sessions without traffic either way for this long are closed, 0 for never
+	Country      string     `json:"country"`       // For proxies: exit country (ISO code) for "exit-country:" rules, default the one the exit check finds
+}
+
+// RuleConfig describes a single routing rule
+type RuleConfig struct {
+	Match    string          `json:"match"`              // Matcher, e.g. "geosite:netflix", "ip:10.0.0.0/8" or "asn:13335"
+	Outbound string          `json:"outbound"`           // Outbound tag: "direct", "reject", "upstream" or a named outbound
+	Split    map[string]int  `json:"split,omitempty"`    // Outbound weights instead of outbound, e.g. {"upstream": 90, "direct": 10}
+	Fallback string          `json:"fallback,omitempty"` // Overrides the global fallback; "none" disables it
+	Warm     bool            `json:"warm,omitempty"`     // Latency-critical: keep DNS answers and upstream connections ready
+	Schedule *ScheduleConfig `json:"schedule,omitempty"` // Optional time window the rule is active in
+	DNS      string          `json:"dns,omitempty"`      // How matched domains are resolved, see Config.DNS
+	Log      string          `json:"log,omitempty"`      // Connection logging: "silent", "normal" (default) or "verbose"
+	Notify   *NotifyConfig   `json:"notify,omitempty"`   // Webhook events when matching clients start and stop connecting
+	Rewrite  string          `json:"rewrite,omitempty"`  // Destination dialed instead: "host:port", "host" or ":port"
+	NoAAAA   bool            `json:"no_aaaa,omitempty"`  // The DNS server answers AAAA queries for matched domains with no addresses
+}
+
+// ScheduleConfig restricts a rule to certain weekdays and times of day
+type ScheduleConfig struct {
+	Days     []string `json:"days,omitempty"`     // e.g. ["mon", "tuesday"]: full names or three-letter abbreviations, empty for every day
+	Times    []string `json:"times,omitempty"`    // e.g. ["09:00-17:30", "22:00-24:00"], empty for the whole day
+	Timezone string   `json:"timezone,omitempty"` // IANA zone name, empty for local time
+}
+
+// loadConfig reads and decodes a configuration file
+func loadConfig(path string) (*Config, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+		path = "stdin"
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(stripComments(data), cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// stripComments blanks out // and /* */ comments outside of JSON strings,
+// keeping offsets so parse errors still point at the right place
+func stripComments(data []byte) []byte {
+	out := make([]byte, len(data))
+	copy(out, data)
+	inString := false
+	for i := 0; i < len(out); i++ {
+		switch {
+		case inString:
+			if out[i] == '\\' {
+				i++
+			} else if out[i] == '"' {
+				inString = false
+			}
+		case out[i] == '"':
+			inString = true
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '*':
+			out[i], out[i+1] = ' ', ' '
+			for i += 2; i < len(out); i++ {
+				if out[i] == '*' && i+1 < len(out) && out[i+1] == '/' {
+					out[i], out[i+1] = ' ', ' '
+					i++
+					break
+				}
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+		}
+	}
+	return out
+}
+
+// Duration is a time.Duration written as a string such as "300ms" or "1m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
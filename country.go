@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// countryPrefix starts the outbound tags routing to any exit in a country,
+// e.g. "exit-country:JP"
+const countryPrefix = "exit-country:"
+
+// outboundCountries holds the countries set with "country" by outbound tag
+var outboundCountries = map[string]string{}
+
+// countryOf returns the exit country of an outbound: the configured one,
+// else the one the exit check found, "" when unknown
+func countryOf(tag string) string {
+	if c, ok := outboundCountries[tag]; ok {
+		return c
+	}
+	exits.mu.Lock()
+	defer exits.mu.Unlock()
+	if info := exits.info[tag]; info != nil {
+		return info.Country
+	}
+	return ""
+}
+
+// countryGroup routes through the available upstreams exiting in a
+// country, in turn, so rules can target a country without listing its
+// exits
+type countryGroup struct {
+	country string
+	next    atomic.Uint32
+}
+
+// registerCountryOutbound adds the outbound of an "exit-country:XX" tag
+// used by the rules, if it is one and was not added yet
+func registerCountryOutbound(tag string) error {
+	country, ok := strings.CutPrefix(tag, countryPrefix)
+	if !ok {
+		return nil
+	}
+	if _, ok := outbounds[tag]; ok {
+		return nil
+	}
+	if len(country) != 2 || strings.ToUpper(country) != country {
+		return fmt.Errorf("%s: country must be an upper-case ISO 3166 code like JP", tag)
+	}
+	outbounds[tag] = &countryGroup{country: country}
+	return nil
+}
+
+// members returns the upstreams exiting in the country, available or not;
+// tenant outbounds are left to their tenants
+func (g *countryGroup) members() []string {
+	members := []string{}
+	for tag, o := range outbounds {
+		if isUpstream(o) && !strings.Contains(tag, "/") && countryOf(tag) == g.country {
+			members = append(members, tag)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (g *countryGroup) String() string {
+	return "exit-country " + g.country + " (" + strings.Join(g.members(), ", ") + ")"
+}
+
+func (g *countryGroup) Dial(m *Metadata) (net.Conn, error) {
+	var available []string
+	for _, member := range g.members() {
+		if memberAvailable(member) {
+			available = append(available, member)
+		}
+	}
+	if len(available) == 0 {
+		return nil, fmt.Errorf("no available exit in %s", g.country)
+	}
+	n := g.next.Add(1)
+	return dialOutbound(available[int(n)%len(available)], m)
+}
+
+func (g *countryGroup) info() GroupInfo {
+	return GroupInfo{Type: "exit-country", Members: g.members()}
+}
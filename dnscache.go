@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSCacheConfig keeps the answers of lookups for a while in one cache
+// shared by routing, direct dials and the DNS server, so a domain resolves
+// to the same addresses for all three
+type DNSCacheConfig struct {
+	TTL         Duration `json:"ttl"`          // How long answers without a TTL of their own are kept, default 60s
+	MinTTL      Duration `json:"min_ttl"`      // Answers are kept at least this long, whatever their TTL
+	MaxTTL      Duration `json:"max_ttl"`      // Answers are kept at most this long, 0 for no limit
+	NegativeTTL Duration `json:"negative_ttl"` // How long failed lookups (NXDOMAIN, SERVFAIL, timeouts) are remembered, 0 to retry each time
+	Size        int      `json:"size"`         // Most names kept, default 4096
+	MapIPs      bool     `json:"map_ips"`      // Route connections to answered addresses by their domain
+}
+
+// dnsCacheState is the shared cache; its methods do nothing on nil, which
+// is what dnsCache is without "dns_cache"
+type dnsCacheState struct {
+	ttl, minTTL, maxTTL, negTTL time.Duration
+	size                        int
+	mapIPs                      bool
+
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry // By strategy and name
+	byIP    map[netip.Addr]dnsCacheHost
+	order   []netip.Addr // Ring of byIP insertions, the oldest is dropped first
+	next    uint64
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error // The failure of a lookup, kept for negTTL
+	expires time.Time
+}
+
+type dnsCacheHost struct {
+	host string
+	seq  uint64 // Position in order, so a re-answered address outlives its old slot
+}
+
+var dnsCache *dnsCacheState
+
+// setDNSCache compiles the "dns_cache" config
+func setDNSCache(cfg *DNSCacheConfig) error {
+	dnsCache = nil
+	if cfg == nil {
+		return nil
+	}
+	c := &dnsCacheState{
+		ttl:     time.Duration(cfg.TTL),
+		minTTL:  time.Duration(cfg.MinTTL),
+		maxTTL:  time.Duration(cfg.MaxTTL),
+		negTTL:  time.Duration(cfg.NegativeTTL),
+		size:    cfg.Size,
+		mapIPs:  cfg.MapIPs,
+		entries: map[string]dnsCacheEntry{},
+		byIP:    map[netip.Addr]dnsCacheHost{},
+	}
+	if c.ttl < 0 || c.minTTL < 0 || c.maxTTL < 0 || c.negTTL < 0 || c.size < 0 {
+		return fmt.Errorf("dns_cache: durations and size must not be negative")
+	}
+	if c.maxTTL > 0 && c.minTTL > c.maxTTL {
+		return fmt.Errorf("dns_cache: min_ttl is above max_ttl")
+	}
+	if c.ttl == 0 {
+		c.ttl = time.Minute
+	}
+	if c.size == 0 {
+		c.size = 4096
+	}
+	if c.mapIPs {
+		// Addresses are remembered longer than their names, for clients
+		// that keep answers beyond the TTL
+		c.order = make([]netip.Addr, 4*c.size)
+	}
+	dnsCache = c
+	return nil
+}
+
+func dnsCacheKey(strategy, host string) string {
+	return strategy + "\x00" + strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// get returns the unexpired cached answer, or failure, for a name looked
+// up with a strategy
+func (c *dnsCacheState) get(strategy, host string) (dnsCacheEntry, bool) {
+	if c == nil {
+		return dnsCacheEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[dnsCacheKey(strategy, host)]
+	if !ok || !time.Now().Before(e.expires) {
+		return dnsCacheEntry{}, false
+	}
+	return e, true
+}
+
+// put keeps an answer, and its addresses for map_ips, for its TTL clamped
+// to min_ttl and max_ttl; 0 means the answer has no TTL of its own
+func (c *dnsCacheState) put(strategy, host string, ips []net.IP, ttl time.Duration) {
+	if c == nil || len(ips) == 0 {
+		return
+	}
+	if ttl <= 0 {
+		ttl = c.ttl
+	}
+	ttl = max(ttl, c.minTTL)
+	if c.maxTTL > 0 {
+		ttl = min(ttl, c.maxTTL)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(strategy, host, dnsCacheEntry{ips: ips, expires: time.Now().Add(ttl)})
+	if !c.mapIPs {
+		return
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, ip := range ips {
+		a, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		a = a.Unmap()
+		slot := c.next % uint64(len(c.order))
+		if old := c.order[slot]; old.IsValid() && c.byIP[old].seq == c.next-uint64(len(c.order)) {
+			delete(c.byIP, old)
+		}
+		c.order[slot] = a
+		c.byIP[a] = dnsCacheHost{host: host, seq: c.next}
+		c.next++
+	}
+}
+
+// putError keeps the failure of a lookup for negative_ttl, so a failing
+// resolver is not asked again for every connection
+func (c *dnsCacheState) putError(strategy, host string, err error) {
+	if c == nil || c.negTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(strategy, host, dnsCacheEntry{err: err, expires: time.Now().Add(c.negTTL)})
+}
+
+// store adds an entry, making room when the cache is full; c.mu is held
+func (c *dnsCacheState) store(strategy, host string, e dnsCacheEntry) {
+	now := time.Now()
+	if len(c.entries) >= c.size {
+		for k, old := range c.entries {
+			if now.After(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[dnsCacheKey(strategy, host)] = e
+}
+
+// flush drops all answers, for when their sources change; addresses stay
+// mapped to their domains
+func (c *dnsCacheState) flush() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	clear(c.entries)
+	c.mu.Unlock()
+}
+
+// host returns the domain an address was last answered for, with map_ips
+func (c *dnsCacheState) host(ip net.IP) (string, bool) {
+	if c == nil || !c.mapIPs {
+		return "", false
+	}
+	a, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.byIP[a.Unmap()]
+	return h.host, ok
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DNSServerConfig runs a DNS server for clients. It answers A and AAAA
+// queries with the resolution used for routing ("dns", "dns_zones",
+// "dns_rules") or, with fake_ip, with synthetic addresses; other query
+// types get an empty answer.
+type DNSServerConfig struct {
+	Listen string        `json:"listen"`  // UDP address, e.g. "127.0.0.1:53"
+	TTL    Duration      `json:"ttl"`     // TTL of the answers, default 60s
+	FakeIP *FakeIPConfig `json:"fake_ip"` // Answer with fake addresses mapped back to domains, nil for real answers
+}
+
+// DNS query types and response codes used by the server
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+)
+
+// dnsServer answers the queries of clients
+type dnsServer struct {
+	conn   *net.UDPConn
+	ttl    uint32
+	router *Router // Routes queried names for no_aaaa
+}
+
+// startDNSServer listens for the queries of clients
+func startDNSServer(cfg *DNSServerConfig, geo *GeoData, router *Router) error {
+	if err := setFakeIP(cfg.FakeIP, geo); err != nil {
+		return err
+	}
+	addr, err := net.ResolveUDPAddr("udp", cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("dns_server: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("dns_server: %v", err)
+	}
+	ttl := time.Duration(cfg.TTL)
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	s := &dnsServer{conn: conn, ttl: uint32(ttl / time.Second), router: router}
+	mode := "real"
+	if fakeIPs != nil {
+		mode = "fake IP " + fakeIPs.v4.prefix.String()
+		if fakeIPs.v6 != nil {
+			mode += ", " + fakeIPs.v6.prefix.String()
+		}
+	}
+	log.Printf("DNS server running on %s (%s answers)\n", conn.LocalAddr(), mode)
+	go s.serve()
+	return nil
+}
+
+func (s *dnsServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DNS server: %v\n", err)
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.answer(query, from); resp != nil {
+				s.conn.WriteToUDP(resp, from)
+			}
+		}()
+	}
+}
+
+// answer builds the response to a query from a client, nil to drop it
+func (s *dnsServer) answer(query []byte, from net.Addr) []byte {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return nil
+	}
+	if binary.BigEndian.Uint16(query[4:]) != 1 || query[2]&0x78 != 0 {
+		// Only standard queries with one question
+		return dnsResponse(query, 12, dnsRcodeNotImp)
+	}
+	host, end, err := readDNSName(query, 12)
+	if err != nil || end+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end:])
+	end += 4
+	var network string
+	switch qtype {
+	case dnsTypeA:
+		network = "ip4"
+	case dnsTypeAAAA:
+		network = "ip6"
+	default:
+		return dnsResponse(query, end, 0)
+	}
+	if qtype == dnsTypeAAAA && s.noAAAA(host, from) {
+		return dnsResponse(query, end, 0)
+	}
+
+	if fakeIPs != nil {
+		if ip, ok := fakeIPs.answer(host, network); ok {
+			resp := dnsResponse(query, end, 0)
+			if ip != nil {
+				resp = appendAnswer(resp, qtype, ip, s.ttl)
+			}
+			return resp
+		}
+	}
+	ips, err := defaultDNS.dialLookup(host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return dnsResponse(query, end, dnsRcodeNXDomain)
+		}
+		log.Printf("DNS server: %s: %v\n", host, err)
+		return dnsResponse(query, end, dnsRcodeServFail)
+	}
+	// Clients keep the answer no longer than the shared cache does
+	ttl := s.ttl
+	if e, ok := dnsCache.get(defaultDNS.dialCacheKey(), host); ok {
+		ttl = min(ttl, max(uint32(time.Until(e.expires)/time.Second), 1))
+	}
+	resp := dnsResponse(query, end, 0)
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (qtype == dnsTypeA) {
+			resp = appendAnswer(resp, qtype, ip, ttl)
+		}
+	}
+	return resp
+}
+
+// noAAAA reports whether IPv6 addresses of a name are hidden from clients:
+// connections to it would be routed by a no_aaaa rule, or to a direct
+// outbound limited to IPv4, so clients do not first try an IPv6 path that
+// is going to fail. The name is routed as for port 0.
+func (s *dnsServer) noAAAA(host string, from net.Addr) bool {
+	m := newMetadata(from, Addr{Atyp: 0x03, Addr: []byte(host)})
+	tag, rule := s.router.route(m)
+	if rule != nil && rule.NoAAAA {
+		return true
+	}
+	o, ok := outbounds[tag].(directOutbound)
+	return ok && o.family == onlyIPv4
+}
+
+// dnsResponse starts the response to a query: its header and the question
+// ending at end, with no answers yet
+func dnsResponse(query []byte, end int, rcode byte) []byte {
+	resp := append([]byte(nil), query[:end]...)
+	resp[2] = 0x80 | query[2]&0x79 // QR, opcode and RD of the query
+	resp[3] = 0x80 | rcode         // RA
+	qd := uint16(0)
+	if end > 12 {
+		qd = 1
+	}
+	binary.BigEndian.PutUint16(resp[4:], qd)
+	clear(resp[6:12])
+	return resp
+}
+
+// appendAnswer adds an address record for the question's name
+func appendAnswer(resp []byte, qtype uint16, ip net.IP, ttl uint32) []byte {
+	if qtype == dnsTypeA {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+	resp = append(resp, 0xc0, 12) // Pointer to the question's name
+	resp = binary.BigEndian.AppendUint16(resp, qtype)
+	resp = binary.BigEndian.AppendUint16(resp, 1) // Class IN
+	resp = binary.BigEndian.AppendUint32(resp, ttl)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(ip)))
+	resp = append(resp, ip...)
+	binary.BigEndian.PutUint16(resp[6:], binary.BigEndian.Uint16(resp[6:])+1)
+	return resp
+}
+
+// readDNSName reads an uncompressed name, as queries carry it, and
+// returns the offset after it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	for off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if len(labels) == 0 {
+				return "", 0, errors.New("empty name")
+			}
+			return strings.ToLower(strings.Join(labels, ".")), off + 1, nil
+		case l&0xc0 != 0 || off+1+l > len(msg):
+			return "", 0, errors.New("malformed name")
+		}
+		labels = append(labels, string(msg[off+1:off+1+l]))
+		off += 1 + l
+	}
+	return "", 0, errors.New("malformed name")
+}
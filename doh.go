@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DNS-over-HTTPS (RFC 8484) resolvers send their queries over HTTPS, so
+// lookups are neither visible to nor rewritten by the local network. The
+// DoH server's own host name is resolved from "dns_bootstrap" when it is
+// listed there, else by the system resolver. Through an outbound, the
+// host name is left to the outbound.
+
+// dohBootstrap holds the addresses of DoH server host names, from
+// "dns_bootstrap"
+var dohBootstrap = map[string][]net.IP{}
+
+// setDoHBootstrap compiles the "dns_bootstrap" config
+func setDoHBootstrap(hosts map[string][]string) error {
+	dohBootstrap = map[string][]net.IP{}
+	for host, addrs := range hosts {
+		for _, a := range addrs {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return fmt.Errorf("dns_bootstrap: %s: invalid IP %q", host, a)
+			}
+			dohBootstrap[host] = append(dohBootstrap[host], ip)
+		}
+	}
+	return nil
+}
+
+// isDoHURL reports whether a DNS server setting is a DoH endpoint
+func isDoHURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// dohResolver queries a DoH endpoint
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+// newDoHResolver queries a DoH endpoint directly, or through the outbound
+// via when it is set
+func newDoHResolver(endpoint, via string) Resolver {
+	u, _ := url.Parse(endpoint)
+	bootstrap := dohBootstrap[u.Hostname()]
+	d := net.Dialer{Timeout: 5 * time.Second}
+	transport := &http.Transport{
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if via != "" {
+				return dialVia(ctx, via, addr)
+			}
+			if len(bootstrap) == 0 {
+				return d.DialContext(ctx, network, addr)
+			}
+			_, port, _ := net.SplitHostPort(addr)
+			var err error
+			for _, ip := range bootstrap {
+				var conn net.Conn
+				if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+	return dohResolver{url: endpoint, client: &http.Client{Transport: transport, Timeout: 5 * time.Second}}
+}
+
+func (r dohResolver) LookupIP(host string) ([]net.IP, error) {
+	ips, _, err := r.LookupIPTTL(host)
+	return ips, err
+}
+
+// LookupIPTTL looks up both families; the TTL is the shortest of the
+// answers that have addresses
+func (r dohResolver) LookupIPTTL(host string) ([]net.IP, time.Duration, error) {
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	v6 := make(chan answer, 1)
+	go func() {
+		ips, ttl, err := r.lookupFamily("ip6", host)
+		v6 <- answer{ips, ttl, err}
+	}()
+	ips, ttl, err4 := r.lookupFamily("ip4", host)
+	a := <-v6
+	if len(a.ips) > 0 && (len(ips) == 0 || a.ttl < ttl) {
+		ttl = a.ttl
+	}
+	ips = append(ips, a.ips...)
+	if len(ips) == 0 {
+		if err4 != nil {
+			return nil, 0, err4
+		}
+		if a.err != nil {
+			return nil, 0, a.err
+		}
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, ttl, nil
+}
+
+func (r dohResolver) LookupFamily(network, host string) ([]net.IP, error) {
+	ips, _, err := r.lookupFamily(network, host)
+	return ips, err
+}
+
+func (r dohResolver) lookupFamily(network, host string) ([]net.IP, time.Duration, error) {
+	qtype := uint16(1) // A
+	if network == "ip6" {
+		qtype = 28 // AAAA
+	}
+	query, err := dnsQuery(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: r.url, IsTemporary: true}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, &net.DNSError{Err: resp.Status, Name: host, Server: r.url, IsTemporary: true}
+	}
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: r.url, IsTemporary: true}
+	}
+	ips, ttl, err := dnsAnswerIPs(msg, qtype)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: r.url, IsNotFound: errors.Is(err, errNXDomain)}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// dnsQuery builds a recursive query for one name and type; the ID is 0 as
+// RFC 8484 recommends, for HTTP caching
+func dnsQuery(host string, qtype uint16) ([]byte, error) {
+	msg := []byte{0, 0, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg, err := appendDNSName(msg, host)
+	if err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, 1), nil // Class IN
+}
+
+// appendDNSName appends a host name in wire format
+func appendDNSName(b []byte, host string) ([]byte, error) {
+	for len(host) > 0 && host[len(host)-1] == '.' {
+		host = host[:len(host)-1]
+	}
+	if host == "" || len(host) > 253 {
+		return nil, fmt.Errorf("invalid host name %q", host)
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid host name %q", host)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+var errNXDomain = errors.New("no such host")
+
+// dnsAnswerIPs returns the addresses of the records of a type in a
+// response and their shortest TTL; CNAMEs are followed by the server, so
+// only the address records matter
+func dnsAnswerIPs(msg []byte, qtype uint16) ([]net.IP, uint32, error) {
+	if len(msg) < 12 {
+		return nil, 0, errors.New("short DNS response")
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		return nil, 0, errNXDomain
+	default:
+		return nil, 0, fmt.Errorf("DNS error code %d", rcode)
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	var err error
+	for range qd {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		off += 4
+	}
+	var ips []net.IP
+	var ttl uint32
+	for range an {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, errors.New("short DNS response")
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		recTTL := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, 0, errors.New("short DNS response")
+		}
+		if typ == qtype && (rdlen == net.IPv4len || rdlen == net.IPv6len) {
+			ips = append(ips, net.IP(bytes.Clone(msg[off:off+rdlen])))
+			if len(ips) == 1 || recTTL < ttl {
+				ttl = recTTL
+			}
+		}
+		off += rdlen
+	}
+	return ips, ttl, nil
+}
+
+// skipDNSName returns the offset after the (possibly compressed) name at
+// off
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			return off + 2, nil
+		}
+		off += 1 + l
+	}
+	return 0, errors.New("short DNS response")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ExitCheckConfig enables periodic discovery of each upstream's public exit
+// IP and country
+type ExitCheckConfig struct {
+	URL      string            `json:"url"`      // JSON IP info service fetched through each upstream, e.g. "https://ipinfo.io/json"
+	Interval Duration          `json:"interval"` // Check period, default 10m
+	Expect   map[string]string `json:"expect"`   // Expected exit country by outbound tag, e.g. {"upstream": "DE"}
+	Disable  bool              `json:"disable"`  // Stop routing to an upstream while its exit country is unexpected
+}
+
+// ExitInfo is the last exit check result of an upstream
+type ExitInfo struct {
+	IP       string    `json:"ip,omitempty"`
+	Country  string    `json:"country,omitempty"`
+	Expected string    `json:"expected,omitempty"` // Configured, or the first country seen
+	Checked  time.Time `json:"checked"`
+	Error    string    `json:"error,omitempty"`
+	Disabled bool      `json:"disabled,omitempty"`
+}
+
+// exitTable holds the exit check results by outbound tag
+type exitTable struct {
+	mu        sync.Mutex
+	info      map[string]*ExitInfo
+	ndisabled atomic.Int32 // Outbounds currently disabled, so dials skip the lock when none are
+}
+
+var exits = &exitTable{info: map[string]*ExitInfo{}}
+
+// disabled reports whether an outbound was disabled by its exit check
+func (t *exitTable) disabled(tag string) bool {
+	if t.ndisabled.Load() == 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info := t.info[tag]
+	return info != nil && info.Disabled
+}
+
+// list returns a copy of all results
+func (t *exitTable) list() map[string]ExitInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make(map[string]ExitInfo, len(t.info))
+	for tag, info := range t.info {
+		list[tag] = *info
+	}
+	return list
+}
+
+// update records a check result, warning (and disabling the outbound if
+// configured) when the exit country is not the expected one
+func (t *exitTable) update(tag string, ip, country string, err error, cfg *ExitCheckConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info := t.info[tag]
+	if info == nil {
+		info = &ExitInfo{Expected: strings.ToUpper(cfg.Expect[tag])}
+		t.info[tag] = info
+	}
+	info.Checked = time.Now()
+	if err != nil {
+		info.Error = err.Error()
+		log.Printf("Exit check %s: %v\n", tag, err)
+		return
+	}
+	info.Error = ""
+	info.IP, info.Country = ip, strings.ToUpper(country)
+	if info.Country == "" {
+		return
+	}
+	if info.Expected == "" {
+		info.Expected = info.Country
+	}
+	unexpected := info.Country != info.Expected
+	if unexpected {
+		log.Printf("Exit check %s: exit country changed to %s (%s), expected %s\n", tag, info.Country, ip, info.Expected)
+	} else if info.Disabled {
+		log.Printf("Exit check %s: exit country is %s again, enabling\n", tag, info.Country)
+	}
+	disabled := unexpected && cfg.Disable
+	if disabled != info.Disabled {
+		if disabled {
+			t.ndisabled.Add(1)
+		} else {
+			t.ndisabled.Add(-1)
+		}
+	}
+	info.Disabled = disabled
+}
+
+// startExitChecks checks every upstream outbound in the background
+func startExitChecks(cfg *ExitCheckConfig) {
+	if cfg.Interval == 0 {
+		cfg.Interval = Duration(10 * time.Minute)
+	}
+	for tag, o := range outbounds {
+		if !isUpstream(o) {
+			continue
+		}
+		go func(tag string, o Outbound) {
+			for {
+				ip, country, err := checkExit(o, cfg.URL)
+				exits.update(tag, ip, country, err, cfg)
+				time.Sleep(time.Duration(cfg.Interval))
+			}
+		}(tag, o)
+	}
+}
+
+// isUpstream reports whether an outbound goes through a remote proxy, so
+// its availability is worth checking
+func isUpstream(o Outbound) bool {
+	switch o.(type) {
+	case socksOutbound, chainOutbound, httpOutbound, vmessOutbound, vlessOutbound, *muxOutbound:
+		return true
+	}
+	return false
+}
+
+// outboundClient returns an HTTP client whose connections go through an
+// outbound
+func outboundClient(o Outbound, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				p, err := strconv.ParseUint(port, 10, 16)
+				if err != nil {
+					return nil, err
+				}
+				dest := Addr{Atyp: 0x03, Addr: []byte(host), Port: uint16(p)}
+				return o.Dial(newMetadata(nil, dest))
+			},
+		},
+	}
+}
+
+// checkExit fetches the check URL through an outbound and returns the exit
+// IP and country it reports. JSON answers from the common services
+// (ipinfo.io, ip-api.com, ifconfig.co) are understood; a plain text answer
+// is taken as the bare IP.
+func checkExit(o Outbound, url string) (string, string, error) {
+	resp, err := outboundClient(o, 30*time.Second).Get(url)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", "", err
+	}
+
+	var fields map[string]any
+	if json.Unmarshal(body, &fields) != nil {
+		ip := strings.TrimSpace(string(body))
+		if net.ParseIP(ip) == nil {
+			return "", "", fmt.Errorf("%s: unrecognized answer", url)
+		}
+		return ip, "", nil
+	}
+	str := func(keys ...string) string {
+		for _, k := range keys {
+			if v, ok := fields[k].(string); ok && v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	ip := str("ip", "query")
+	if ip == "" {
+		return "", "", fmt.Errorf("%s: no IP in answer", url)
+	}
+	return ip, str("country_iso", "countryCode", "country_code", "country"), nil
+}
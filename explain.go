@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// explainState controls decision traces; it is switched at runtime through
+// the admin API
+type explainState struct {
+	setting atomic.Pointer[explainSetting] // Swapped whole, read on every decision
+}
+
+type explainSetting struct {
+	on      bool
+	source  *net.IPNet // Only trace this client range, nil for all
+	dest    string     // Only trace this domain (and subdomains) or, when destNet is set, these addresses; empty for all
+	destNet *net.IPNet
+}
+
+var explain = &explainState{}
+
+// set turns tracing on (optionally for one client range and one
+// destination) or off; dest is a domain or a CIDR
+func (e *explainState) set(on bool, source *net.IPNet, dest string) {
+	cur := &explainSetting{on: on, source: source, dest: strings.ToLower(strings.TrimSuffix(dest, "."))}
+	if n, err := parseCIDR(dest); err == nil {
+		cur.destNet = n
+	}
+	e.setting.Store(cur)
+}
+
+// status reports the current setting for the admin API
+func (e *explainState) status() map[string]any {
+	cur := e.setting.Load()
+	if cur == nil {
+		return map[string]any{"enabled": false}
+	}
+	s := map[string]any{"enabled": cur.on}
+	if cur.source != nil {
+		s["source"] = cur.source.String()
+	}
+	if cur.dest != "" {
+		s["dest"] = cur.dest
+	}
+	return s
+}
+
+// tracing reports whether the decision for a connection is traced
+func (e *explainState) tracing(m *Metadata) bool {
+	cur := e.setting.Load()
+	if cur == nil || !cur.on {
+		return false
+	}
+	if cur.source != nil {
+		tcp, ok := m.Source.(*net.TCPAddr)
+		if !ok || !cur.source.Contains(tcp.IP) {
+			return false
+		}
+	}
+	switch {
+	case cur.dest == "":
+		return true
+	case cur.destNet != nil:
+		// Only literal destinations: resolving here would change the
+		// decision's inputs
+		return m.literal && slices.ContainsFunc(m.ips, cur.destNet.Contains)
+	default:
+		host := strings.ToLower(m.Host)
+		return host == cur.dest || strings.HasSuffix(host, "."+cur.dest)
+	}
+}
+
+// explainTrace collects the steps of one routing decision
+type explainTrace struct {
+	lines []string
+}
+
+func (t *explainTrace) add(format string, args ...any) {
+	t.lines = append(t.lines, fmt.Sprintf(format, args...))
+}
+
+// miss explains why a rule did not match: the failing condition of a
+// composite rule, and the input it was checked against
+func (t *explainTrace) miss(i int, rule *Rule, m *Metadata) {
+	why := "no match" + describeInput(rule.Matcher, m)
+	if a, ok := rule.Matcher.(andMatcher); ok {
+		parts := strings.Split(rule.Match, "&&")
+		for j, part := range a {
+			if !part.Match(m) && j < len(parts) {
+				why = fmt.Sprintf("no match at %q%s", strings.TrimSpace(parts[j]), describeInput(part, m))
+				break
+			}
+		}
+	}
+	t.add("rule %d %q: %s", i+1, rule.Match, why)
+}
+
+// hit explains why a rule matched, with the input it was checked against
+func (t *explainTrace) hit(i int, rule *Rule, m *Metadata) {
+	why := "match" + describeInput(rule.Matcher, m)
+	if a, ok := rule.Matcher.(andMatcher); ok {
+		why = fmt.Sprintf("match, all %d conditions", len(a))
+	}
+	t.add("rule %d %q: %s", i+1, rule.Match, why)
+}
+
+// describeInput names the part of the connection a condition looks at,
+// e.g. " (host example.com)"; empty when it is not one of the plain
+// conditions
+func describeInput(part Matcher, m *Metadata) string {
+	switch part.(type) {
+	case *domainMatcher:
+		if m.Host == "" {
+			return " (no domain, IP request)"
+		}
+		return fmt.Sprintf(" (host %s)", m.Host)
+	case *ipMatcher, asnMatcher, familyMatcher, countryMatcher:
+		if len(m.ips) == 0 {
+			return " (no addresses)"
+		}
+		return fmt.Sprintf(" (ips %v)", m.ips)
+	case portMatcher:
+		return fmt.Sprintf(" (port %d)", m.Dest.Port)
+	case sourceMatcher:
+		return fmt.Sprintf(" (client %v)", m.Source)
+	}
+	return ""
+}
+
+// log writes the trace with the connection and its final decision
+func (t *explainTrace) log(m *Metadata, tag string) {
+	dest := m.Dest.String()
+	if m.Host != "" && m.resolved {
+		dest += fmt.Sprintf(" (%s, ips %v)", m.Host, m.ips)
+	} else if m.Host != "" {
+		dest += fmt.Sprintf(" (%s, not resolved)", m.Host)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Explain %v -> %s:", m.Source, dest)
+	for _, line := range t.lines {
+		b.WriteString("\n  " + line)
+	}
+	fmt.Fprintf(&b, "\n  => %s", tag)
+	log.Println(b.String())
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ExportConfig sends a record of every finished session to a ClickHouse
+// table or an InfluxDB bucket, in batches
+type ExportConfig struct {
+	Format   string            `json:"format"`   // "clickhouse" (JSONEachRow inserts) or "influx" (line protocol)
+	URL      string            `json:"url"`      // ClickHouse HTTP endpoint, or the InfluxDB write URL with its org/bucket
+	Table    string            `json:"table"`    // ClickHouse table or Influx measurement, default "sessions"
+	Headers  map[string]string `json:"headers"`  // Extra request headers, e.g. an Influx "Authorization" token
+	Batch    int               `json:"batch"`    // Records per request, default 1000
+	Interval Duration          `json:"interval"` // Longest wait before a partial batch is sent, default 10s
+}
+
+// SessionRecord is the exported form of a finished session
+type SessionRecord struct {
+	ID       uint64    `json:"id"`
+	User     string    `json:"user"`
+	Source   string    `json:"source"`
+	Dest     string    `json:"dest"`
+	Outbound string    `json:"outbound"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"` // Seconds
+	Up       int64     `json:"bytes_up"`
+	Down     int64     `json:"bytes_down"`
+}
+
+// exportBacklog is how many batches of records are kept while the
+// database is unreachable; older records are dropped beyond that
+const exportBacklog = 10
+
+// sessionExporter batches session records and sends them in the background
+type sessionExporter struct {
+	cfg    *ExportConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	pending []SessionRecord
+	kick    chan struct{}
+
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// exporter is nil when session export is off
+var exporter *sessionExporter
+
+// newSessionExporter validates the export settings
+func newSessionExporter(cfg *ExportConfig) (*sessionExporter, error) {
+	switch cfg.Format {
+	case "clickhouse", "influx":
+	default:
+		return nil, fmt.Errorf("export: unknown format %q", cfg.Format)
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("export: url is required")
+	}
+	if cfg.Table == "" {
+		cfg.Table = "sessions"
+	}
+	if cfg.Batch <= 0 {
+		cfg.Batch = 1000
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = Duration(10 * time.Second)
+	}
+	return &sessionExporter{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+		kick:   make(chan struct{}, 1),
+	}, nil
+}
+
+// add queues the record of a finished session
+func (e *sessionExporter) add(s *Session) {
+	up, down := s.Bytes()
+	r := SessionRecord{
+		ID:       s.ID,
+		User:     s.User,
+		Source:   s.Source,
+		Dest:     s.Dest,
+		Outbound: s.Outbound,
+		Start:    s.Start,
+		Duration: time.Since(s.Start).Seconds(),
+		Up:       up,
+		Down:     down,
+	}
+	e.mu.Lock()
+	e.pending = append(e.pending, r)
+	if over := len(e.pending) - exportBacklog*e.cfg.Batch; over > 0 {
+		e.pending = e.pending[over:]
+		e.dropped.Add(uint64(over))
+	}
+	full := len(e.pending) >= e.cfg.Batch
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run sends batches when one is full or every interval
+func (e *sessionExporter) run() {
+	ticker := time.NewTicker(time.Duration(e.cfg.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.kick:
+		}
+		for e.flush() {
+		}
+	}
+}
+
+// flush sends one batch, reporting whether a full batch was sent and more
+// may be waiting. Failed batches stay queued for the next attempt.
+func (e *sessionExporter) flush() bool {
+	e.mu.Lock()
+	n := min(len(e.pending), e.cfg.Batch)
+	batch := e.pending[:n:n]
+	e.mu.Unlock()
+	if n == 0 {
+		return false
+	}
+	if err := e.send(batch); err != nil {
+		log.Printf("Export %d sessions: %v\n", n, err)
+		return false
+	}
+	e.mu.Lock()
+	// The queue may have been trimmed meanwhile; drop what was sent
+	if len(e.pending) >= n && len(e.pending) > 0 && e.pending[0].ID == batch[0].ID {
+		e.pending = e.pending[n:]
+	}
+	e.mu.Unlock()
+	e.sent.Add(uint64(n))
+	return n == e.cfg.Batch
+}
+
+// send posts a batch in the configured format
+func (e *sessionExporter) send(batch []SessionRecord) error {
+	var body bytes.Buffer
+	target := e.cfg.URL
+	switch e.cfg.Format {
+	case "clickhouse":
+		enc := json.NewEncoder(&body)
+		for _, r := range batch {
+			enc.Encode(r)
+		}
+		sep := "?"
+		if strings.Contains(target, "?") {
+			sep = "&"
+		}
+		// RFC 3339 start times need the best_effort parser
+		target += sep + "date_time_input_format=best_effort&query=" +
+			url.QueryEscape("INSERT INTO "+e.cfg.Table+" FORMAT JSONEachRow")
+	case "influx":
+		for _, r := range batch {
+			writeInfluxLine(&body, e.cfg.Table, r)
+		}
+	}
+
+	req, err := http.NewRequest("POST", target, &body)
+	if err != nil {
+		return err
+	}
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", e.cfg.URL, resp.Status)
+	}
+	return nil
+}
+
+// stats reports the export counters for the admin API
+func (e *sessionExporter) stats() map[string]any {
+	e.mu.Lock()
+	pending := len(e.pending)
+	e.mu.Unlock()
+	return map[string]any{
+		"sent":    e.sent.Load(),
+		"pending": pending,
+		"dropped": e.dropped.Load(),
+	}
+}
+
+// influxTag escapes a tag value for the line protocol
+var influxTag = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// writeInfluxLine writes a record with outbound and user as tags and the
+// session start as timestamp (nanoseconds)
+func writeInfluxLine(b *bytes.Buffer, measurement string, r SessionRecord) {
+	fmt.Fprintf(b, "%s,outbound=%s", influxTag.Replace(measurement), influxTag.Replace(r.Outbound))
+	if r.User != "" {
+		fmt.Fprintf(b, ",user=%s", influxTag.Replace(r.User))
+	}
+	fmt.Fprintf(b, " id=%di,source=%q,dest=%q,duration=%g,bytes_up=%di,bytes_down=%di %d\n",
+		r.ID, r.Source, r.Dest, r.Duration, r.Up, r.Down, r.Start.UnixNano())
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// FakeIPConfig makes the DNS server answer with synthetic addresses from a
+// pool. Connections to them are mapped back to the domain, so they are
+// always routed by domain, and proxied destinations are never resolved
+// locally.
+type FakeIPConfig struct {
+	Range   string   `json:"range"`   // IPv4 pool, default 198.18.0.0/15
+	Range6  string   `json:"range6"`  // IPv6 pool, empty to answer AAAA queries with no addresses
+	Exclude []string `json:"exclude"` // Domain conditions answered with real addresses, e.g. "geosite:private"
+}
+
+// fakePool hands out the addresses of a range to domains in turn; when it
+// wraps around, the oldest mappings are reused
+type fakePool struct {
+	prefix netip.Prefix
+	size   uint64 // Usable addresses, without the first and last
+
+	mu     sync.Mutex
+	next   uint64
+	byHost map[string]netip.Addr
+	byAddr map[netip.Addr]string
+}
+
+func newFakePool(cidr string) (*fakePool, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	prefix = prefix.Masked()
+	bits := min(prefix.Addr().BitLen()-prefix.Bits(), 32)
+	if bits < 4 {
+		return nil, fmt.Errorf("%s is too small", cidr)
+	}
+	return &fakePool{
+		prefix: prefix,
+		size:   1<<bits - 2,
+		byHost: map[string]netip.Addr{},
+		byAddr: map[netip.Addr]string{},
+	}, nil
+}
+
+// addr returns the address of a domain, allocating one on first use
+func (p *fakePool) addr(host string) netip.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if a, ok := p.byHost[host]; ok {
+		return a
+	}
+	a := p.at(p.next%p.size + 1)
+	p.next++
+	if old, ok := p.byAddr[a]; ok {
+		delete(p.byHost, old)
+	}
+	p.byHost[host] = a
+	p.byAddr[a] = host
+	return a
+}
+
+// at returns the address at an offset into the range
+func (p *fakePool) at(offset uint64) netip.Addr {
+	if p.prefix.Addr().Is4() {
+		b := p.prefix.Addr().As4()
+		binary.BigEndian.PutUint32(b[:], binary.BigEndian.Uint32(b[:])+uint32(offset))
+		return netip.AddrFrom4(b)
+	}
+	b := p.prefix.Addr().As16()
+	binary.BigEndian.PutUint64(b[8:], binary.BigEndian.Uint64(b[8:])+offset)
+	return netip.AddrFrom16(b)
+}
+
+// host returns the domain an address was handed out to
+func (p *fakePool) host(a netip.Addr) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	host, ok := p.byAddr[a]
+	return host, ok
+}
+
+// fakeIPs holds the pools and exclusions of FakeIP mode, nil when it is
+// off
+var fakeIPs *fakeIPState
+
+type fakeIPState struct {
+	v4, v6  *fakePool // v6 is nil without range6
+	exclude []Matcher
+}
+
+// setFakeIP compiles the "fake_ip" config of the DNS server
+func setFakeIP(cfg *FakeIPConfig, geo *GeoData) error {
+	fakeIPs = nil
+	if cfg == nil {
+		return nil
+	}
+	s := &fakeIPState{}
+	r := cfg.Range
+	if r == "" {
+		r = "198.18.0.0/15"
+	}
+	var err error
+	if s.v4, err = newFakePool(r); err != nil || !s.v4.prefix.Addr().Is4() {
+		return fmt.Errorf("fake_ip: range: %q is not an IPv4 range", r)
+	}
+	if cfg.Range6 != "" {
+		if s.v6, err = newFakePool(cfg.Range6); err != nil || !s.v6.prefix.Addr().Is6() {
+			return fmt.Errorf("fake_ip: range6: %q is not an IPv6 range", cfg.Range6)
+		}
+	}
+	for _, cond := range cfg.Exclude {
+		m, err := parseDomainCondition(cond, geo)
+		if err != nil {
+			return fmt.Errorf("fake_ip: exclude: %v", err)
+		}
+		s.exclude = append(s.exclude, m)
+	}
+	fakeIPs = s
+	return nil
+}
+
+// answer returns the fake address of a domain for a query of a family
+// ("ip4" or "ip6"); ok is false when the domain gets real addresses
+func (s *fakeIPState) answer(host, network string) (ip net.IP, ok bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	m := &Metadata{Host: host}
+	for _, e := range s.exclude {
+		if e.Match(m) {
+			return nil, false
+		}
+	}
+	pool := s.v4
+	if network == "ip6" {
+		if s.v6 == nil {
+			return nil, true
+		}
+		pool = s.v6
+	}
+	return pool.addr(host).AsSlice(), true
+}
+
+// restoreFakeIP maps a destination with a fake address back to its
+// domain; other destinations are returned as they are. A fake address
+// that was not handed out (e.g. before a restart) is an error.
+func restoreFakeIP(dest Addr) (Addr, error) {
+	if fakeIPs == nil || dest.Atyp == 0x03 {
+		return dest, nil
+	}
+	ip, ok := netip.AddrFromSlice(dest.Addr)
+	if !ok {
+		return dest, nil
+	}
+	ip = ip.Unmap()
+	pool := fakeIPs.v4
+	if ip.Is6() {
+		pool = fakeIPs.v6
+	}
+	if pool == nil || !pool.prefix.Contains(ip) {
+		return dest, nil
+	}
+	host, ok := pool.host(ip)
+	if !ok {
+		return dest, fmt.Errorf("fake IP %s is not mapped to a domain", ip)
+	}
+	return Addr{Atyp: 0x03, Addr: []byte(host), Port: dest.Port}, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// GeoSourceConfig adds a database that geosite: and geoip: categories are
+// looked up in
+type GeoSourceConfig struct {
+	Format string `json:"format"` // "dat", "mmdb", "text" or another compiled-in format
+	Kind   string `json:"kind"`   // For "dat": "geosite" or "geoip"
+	Path   string `json:"path"`   // Database file, or directory for "text"
+}
+
+// GeoSource provides geosite and/or geoip categories from one database.
+// Sources load their data on first use; a database that cannot be read is
+// reported as an unavailableError so soft-fail mode can retry it.
+type GeoSource interface {
+	// Site returns a matcher for the domains of a geosite category, or
+	// errNoCategory when the source does not have it
+	Site(code string) (Matcher, error)
+	// IP returns a matcher for the addresses of a geoip category, or
+	// errNoCategory when the source does not have it
+	IP(code string) (Matcher, error)
+	// Loaded describes the database once it was read
+	Loaded() (DataFileSummary, bool)
+}
+
+// errNoCategory is returned by sources lacking a category, so the next
+// source is asked
+var errNoCategory = errors.New("category not found")
+
+// geoSourceFormats holds the compiled-in database formats; a file adding a
+// format registers it from an init function
+var geoSourceFormats = map[string]func(cfg GeoSourceConfig) (GeoSource, error){}
+
+// registerGeoSourceFormat makes a database format available to the config
+func registerGeoSourceFormat(name string, open func(cfg GeoSourceConfig) (GeoSource, error)) {
+	if _, ok := geoSourceFormats[name]; ok {
+		panic("geo source format registered twice: " + name)
+	}
+	geoSourceFormats[name] = open
+}
+
+// newGeoSources builds the configured sources in order of precedence,
+// followed by the geosite/geoip .dat files of the config
+func newGeoSources(cfgs []GeoSourceConfig, sitePath, ipPath string) ([]GeoSource, error) {
+	cfgs = append(cfgs,
+		GeoSourceConfig{Format: "dat", Kind: "geosite", Path: sitePath},
+		GeoSourceConfig{Format: "dat", Kind: "geoip", Path: ipPath})
+	var sources []GeoSource
+	for i, sc := range cfgs {
+		open, ok := geoSourceFormats[sc.Format]
+		if !ok {
+			var known []string
+			for name := range geoSourceFormats {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("geo_sources %d: unknown format %q (available: %s)", i+1, sc.Format, strings.Join(known, ", "))
+		}
+		if sc.Path == "" {
+			return nil, fmt.Errorf("geo_sources %d: path is required", i+1)
+		}
+		s, err := open(sc)
+		if err != nil {
+			return nil, fmt.Errorf("geo_sources %d: %v", i+1, err)
+		}
+		sources = append(sources, s)
+	}
+	return sources, nil
+}
+
+// lookupGeo asks the sources in order for a category; the first one
+// having it wins
+func lookupGeo(sources []GeoSource, kind, code string, get func(GeoSource, string) (Matcher, error)) (Matcher, error) {
+	for _, s := range sources {
+		m, err := get(s, code)
+		if errors.Is(err, errNoCategory) {
+			continue
+		}
+		return m, err
+	}
+	return nil, fmt.Errorf("%s:%s not found in any geo source", kind, code)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GroupTestConfig configures the latency tests of a "urltest" group
+type GroupTestConfig struct {
+	URL       string   `json:"url"`       // Probe URL, default "http://www.gstatic.com/generate_204"
+	Interval  Duration `json:"interval"`  // Test period, default 5m
+	Timeout   Duration `json:"timeout"`   // Probe timeout, default 5s
+	Tolerance Duration `json:"tolerance"` // How much faster another member must be to switch, default 50ms
+}
+
+// urlTestGroup routes through the member with the lowest measured latency,
+// switching only when another member is faster by more than the tolerance
+type urlTestGroup struct {
+	name    string
+	members []string
+	test    GroupTestConfig
+
+	mu      sync.Mutex
+	current string                   // Member in use
+	latency map[string]time.Duration // Last measurement per member, absent when it failed
+}
+
+// newURLTestGroup builds a group of outbounds, which must be defined already
+func newURLTestGroup(name string, oc OutboundConfig) (*urlTestGroup, error) {
+	if len(oc.Members) == 0 {
+		return nil, fmt.Errorf("outbound %s: a group needs members", name)
+	}
+	for _, member := range oc.Members {
+		if _, ok := outbounds[member]; !ok || member == "reject" {
+			return nil, fmt.Errorf("outbound %s: unknown member %q", name, member)
+		}
+	}
+	g := &urlTestGroup{name: name, members: oc.Members, current: oc.Members[0], latency: map[string]time.Duration{}}
+	if oc.Test != nil {
+		g.test = *oc.Test
+	}
+	if g.test.URL == "" {
+		g.test.URL = "http://www.gstatic.com/generate_204"
+	}
+	if g.test.Interval == 0 {
+		g.test.Interval = Duration(5 * time.Minute)
+	}
+	if g.test.Timeout == 0 {
+		g.test.Timeout = Duration(5 * time.Second)
+	}
+	if g.test.Tolerance == 0 {
+		g.test.Tolerance = Duration(50 * time.Millisecond)
+	}
+	return g, nil
+}
+
+func (g *urlTestGroup) String() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := "urltest " + strings.Join(g.members, ", ") + " (using " + g.current
+	if d, ok := g.latency[g.current]; ok {
+		s += fmt.Sprintf(", %dms", d.Milliseconds())
+	}
+	return s + ")"
+}
+
+func (g *urlTestGroup) Dial(m *Metadata) (net.Conn, error) {
+	g.mu.Lock()
+	member := g.current
+	g.mu.Unlock()
+	return dialOutbound(member, m)
+}
+
+// run tests the members every interval
+func (g *urlTestGroup) run() {
+	for {
+		g.testMembers()
+		time.Sleep(time.Duration(g.test.Interval))
+	}
+}
+
+// testMembers measures every member in parallel and picks the one to use
+func (g *urlTestGroup) testMembers() {
+	results := make([]time.Duration, len(g.members))
+	var wg sync.WaitGroup
+	for i, member := range g.members {
+		wg.Add(1)
+		go func(i int, member string) {
+			defer wg.Done()
+			latency, err := probeOutbound(outbounds[member], g.test.URL, time.Duration(g.test.Timeout))
+			if err != nil {
+				log.Printf("Group %s: test of %s failed: %v\n", g.name, member, err)
+				latency = -1
+			}
+			results[i] = latency
+		}(i, member)
+	}
+	wg.Wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	clear(g.latency)
+	best := ""
+	for i, member := range g.members {
+		if results[i] < 0 {
+			continue
+		}
+		g.latency[member] = results[i]
+		if best == "" || results[i] < g.latency[best] {
+			best = member
+		}
+	}
+	if best == "" || best == g.current {
+		return
+	}
+	cur, ok := g.latency[g.current]
+	if ok && g.latency[best]+time.Duration(g.test.Tolerance) >= cur {
+		return
+	}
+	log.Printf("Group %s: switching from %s to %s (%dms)\n", g.name, g.current, best, g.latency[best].Milliseconds())
+	g.current = best
+}
+
+// loadBalanceGroup spreads new connections across its members, in
+// weighted round-robin order or by a consistent hash of the destination
+type loadBalanceGroup struct {
+	members []string
+	weights []int
+	hash    bool // Consistent hashing instead of round-robin
+	mu      sync.Mutex
+	current []int // Smooth weighted round-robin state per member
+}
+
+// newLoadBalanceGroup builds a load-balance group of outbounds, which must
+// be defined already
+func newLoadBalanceGroup(name string, oc OutboundConfig) (*loadBalanceGroup, error) {
+	if len(oc.Members) == 0 {
+		return nil, fmt.Errorf("outbound %s: a group needs members", name)
+	}
+	g := &loadBalanceGroup{members: oc.Members, current: make([]int, len(oc.Members))}
+	for _, member := range oc.Members {
+		if _, ok := outbounds[member]; !ok || member == "reject" {
+			return nil, fmt.Errorf("outbound %s: unknown member %q", name, member)
+		}
+		w, ok := oc.Weights[member]
+		if !ok {
+			w = 1
+		}
+		if w <= 0 {
+			return nil, fmt.Errorf("outbound %s: weight of %q must be positive", name, member)
+		}
+		g.weights = append(g.weights, w)
+	}
+	for member := range oc.Weights {
+		if !slices.Contains(oc.Members, member) {
+			return nil, fmt.Errorf("outbound %s: weight for %q, which is not a member", name, member)
+		}
+	}
+	switch oc.Strategy {
+	case "", "round-robin":
+	case "hash":
+		g.hash = true
+	default:
+		return nil, fmt.Errorf("outbound %s: unknown strategy %q", name, oc.Strategy)
+	}
+	return g, nil
+}
+
+func (g *loadBalanceGroup) String() string {
+	parts := make([]string, len(g.members))
+	for i, member := range g.members {
+		parts[i] = fmt.Sprintf("%s:%d", member, g.weights[i])
+	}
+	strategy := "round-robin"
+	if g.hash {
+		strategy = "hash"
+	}
+	return "loadbalance " + strategy + " " + strings.Join(parts, ",")
+}
+
+func (g *loadBalanceGroup) Dial(m *Metadata) (net.Conn, error) {
+	var member string
+	if g.hash {
+		member = g.pickHash(m)
+	} else {
+		member = g.pickNext()
+	}
+	if member == "" {
+		return nil, errors.New("no member available")
+	}
+	return dialOutbound(member, m)
+}
+
+// memberAvailable reports whether a member is not taken out of routing by
+// its health or exit check
+func memberAvailable(tag string) bool {
+	return !health.down(tag) && !exits.disabled(tag)
+}
+
+// pickNext chooses the next available member by smooth weighted
+// round-robin, which interleaves members instead of sending runs of
+// connections to the heaviest one
+func (g *loadBalanceGroup) pickNext() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	best, total := -1, 0
+	for i, member := range g.members {
+		if !memberAvailable(member) {
+			continue
+		}
+		g.current[i] += g.weights[i]
+		total += g.weights[i]
+		if best < 0 || g.current[i] > g.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	g.current[best] -= total
+	return g.members[best]
+}
+
+// pickHash chooses a member by weighted rendezvous hashing of the
+// destination host, so a destination keeps its member and only the share
+// of a member that is added, removed or down moves elsewhere
+func (g *loadBalanceGroup) pickHash(m *Metadata) string {
+	key := strings.ToLower(m.Host)
+	if key == "" {
+		key = string(m.Dest.Addr)
+	}
+	best, bestScore := "", 0.0
+	for i, member := range g.members {
+		if !memberAvailable(member) {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(member))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		// Uniform in (0, 1); -w/ln(u) picks members in proportion to weight
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -float64(g.weights[i]) / math.Log(u)
+		if best == "" || score > bestScore {
+			best, bestScore = member, score
+		}
+	}
+	return best
+}
+
+// selectGroup routes through the member chosen by hand through the admin
+// API, so all traffic it handles can be moved between exits at runtime
+type selectGroup struct {
+	members []string
+	current atomic.Pointer[string]
+}
+
+// newSelectGroup builds a select group of outbounds, which must be defined
+// already; the first member is selected at startup
+func newSelectGroup(name string, oc OutboundConfig) (*selectGroup, error) {
+	if len(oc.Members) == 0 {
+		return nil, fmt.Errorf("outbound %s: a group needs members", name)
+	}
+	for _, member := range oc.Members {
+		if _, ok := outbounds[member]; !ok {
+			return nil, fmt.Errorf("outbound %s: unknown member %q", name, member)
+		}
+	}
+	g := &selectGroup{members: oc.Members}
+	g.current.Store(&oc.Members[0])
+	return g, nil
+}
+
+func (g *selectGroup) String() string {
+	return "select " + strings.Join(g.members, ", ") + " (using " + *g.current.Load() + ")"
+}
+
+func (g *selectGroup) Dial(m *Metadata) (net.Conn, error) {
+	return dialOutbound(*g.current.Load(), m)
+}
+
+// selectMember switches new connections to a member; established sessions
+// keep their outbound
+func (g *selectGroup) selectMember(member string) error {
+	if !slices.Contains(g.members, member) {
+		return fmt.Errorf("%q is not a member", member)
+	}
+	g.current.Store(&member)
+	return nil
+}
+
+// GroupInfo describes a group for the admin API
+type GroupInfo struct {
+	Type    string   `json:"type"`
+	Members []string `json:"members"`
+	Current string   `json:"current,omitempty"` // Member new connections use, for select and urltest; the last winner for race
+}
+
+func (g *urlTestGroup) info() GroupInfo {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return GroupInfo{Type: "urltest", Members: g.members, Current: g.current}
+}
+
+func (g *loadBalanceGroup) info() GroupInfo {
+	return GroupInfo{Type: "loadbalance", Members: g.members}
+}
+
+func (g *selectGroup) info() GroupInfo {
+	return GroupInfo{Type: "select", Members: g.members, Current: *g.current.Load()}
+}
+
+// raceGroup dials the destination through all its available members at
+// once and keeps the connection that is established first, so the member
+// that happens to be fastest right now carries the session. The slower
+// connections are closed as they complete.
+type raceGroup struct {
+	members []string
+	last    atomic.Pointer[string] // Member that won the last race
+}
+
+// newRaceGroup builds a race group of outbounds, which must be defined
+// already
+func newRaceGroup(name string, oc OutboundConfig) (*raceGroup, error) {
+	if len(oc.Members) < 2 {
+		return nil, fmt.Errorf("outbound %s: a race group needs at least two members", name)
+	}
+	for _, member := range oc.Members {
+		if _, ok := outbounds[member]; !ok || member == "reject" {
+			return nil, fmt.Errorf("outbound %s: unknown member %q", name, member)
+		}
+	}
+	return &raceGroup{members: oc.Members}, nil
+}
+
+func (g *raceGroup) String() string {
+	return "race " + strings.Join(g.members, ", ")
+}
+
+func (g *raceGroup) Dial(m *Metadata) (net.Conn, error) {
+	type result struct {
+		member string
+		conn   net.Conn
+		m      *Metadata
+		err    error
+	}
+	var racers []string
+	for _, member := range g.members {
+		if memberAvailable(member) {
+			racers = append(racers, member)
+		}
+	}
+	if len(racers) == 0 {
+		return nil, errors.New("no member available")
+	}
+	// Each dial works on its own copy of the metadata, and the winner's
+	// copy becomes the session's
+	results := make(chan result, len(racers))
+	for _, member := range racers {
+		mc := *m
+		mc.failed = maps.Clone(m.failed)
+		go func(member string, mc *Metadata) {
+			conn, err := dialOutbound(member, mc)
+			results <- result{member, conn, mc, err}
+		}(member, &mc)
+	}
+	var errs []error
+	for i := range racers {
+		r := <-results
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.member, r.err))
+			continue
+		}
+		*m = *r.m
+		g.last.Store(&r.member)
+		m.logf(logVerbose, "Race %s: won by %s\n", m.Dest, r.member)
+		go func(left int) {
+			for ; left > 0; left-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}(len(racers) - i - 1)
+		return r.conn, nil
+	}
+	// The first error stays wrapped, so callers can tell e.g. unreachable
+	// proxies apart
+	err := errs[0]
+	for _, e := range errs[1:] {
+		err = fmt.Errorf("%w; %v", err, e)
+	}
+	return nil, err
+}
+
+func (g *raceGroup) info() GroupInfo {
+	info := GroupInfo{Type: "race", Members: g.members}
+	if last := g.last.Load(); last != nil {
+		info.Current = *last
+	}
+	return info
+}
+
+// handleGroups lists the groups (GET) or selects the member of a select
+// group (POST ?group=&member=)
+func handleGroups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list := map[string]GroupInfo{}
+		for tag, o := range outbounds {
+			if g, ok := o.(interface{ info() GroupInfo }); ok {
+				list[tag] = g.info()
+			}
+		}
+		writeJSON(w, list)
+	case http.MethodPost:
+		tag := r.URL.Query().Get("group")
+		g, ok := outbounds[tag].(*selectGroup)
+		if !ok {
+			http.Error(w, "not a select group", http.StatusNotFound)
+			return
+		}
+		member := r.URL.Query().Get("member")
+		if err := g.selectMember(member); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Group %s: selected %s\n", tag, member)
+		writeJSON(w, g.info())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startGroups starts the background tests of the groups
+func startGroups() {
+	for _, o := range outbounds {
+		if g, ok := o.(*urlTestGroup); ok {
+			go g.run()
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheckConfig enables active health checks of the upstreams: a probe
+// URL is fetched through each one, and upstreams failing repeatedly are
+// taken out of routing until they recover
+type HealthCheckConfig struct {
+	URL      string   `json:"url"`      // Probe URL, default "http://www.gstatic.com/generate_204"
+	Interval Duration `json:"interval"` // Check period, default 30s
+	Timeout  Duration `json:"timeout"`  // Probe timeout, default 5s
+	Fall     int      `json:"fall"`     // Consecutive failures before an upstream is marked down, default 3
+	Rise     int      `json:"rise"`     // Consecutive successes before it is marked up again, default 2
+}
+
+// HealthInfo is the health check state of an upstream
+type HealthInfo struct {
+	Up        bool      `json:"up"`
+	LatencyMS int64     `json:"latency_ms,omitempty"` // Time to the probe's response headers
+	Checked   time.Time `json:"checked"`
+	Failures  int       `json:"failures,omitempty"`  // Consecutive failed probes
+	Successes int       `json:"successes,omitempty"` // Consecutive successful probes while down
+	Error     string    `json:"error,omitempty"`
+}
+
+// healthTable holds the health check state by outbound tag
+type healthTable struct {
+	mu    sync.Mutex
+	info  map[string]*HealthInfo
+	ndown atomic.Int32 // Outbounds currently down, so dials skip the lock when none are
+}
+
+var health = &healthTable{info: map[string]*HealthInfo{}}
+
+// down reports whether an outbound was marked down by its health check
+func (t *healthTable) down(tag string) bool {
+	if t.ndown.Load() == 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info := t.info[tag]
+	return info != nil && !info.Up
+}
+
+// list returns a copy of all states
+func (t *healthTable) list() map[string]HealthInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make(map[string]HealthInfo, len(t.info))
+	for tag, info := range t.info {
+		list[tag] = *info
+	}
+	return list
+}
+
+// update records a probe result, marking the outbound down after fall
+// failures in a row and up again after rise successes
+func (t *healthTable) update(tag string, latency time.Duration, err error, cfg *HealthCheckConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info := t.info[tag]
+	if info == nil {
+		// Upstreams are assumed up until proven otherwise
+		info = &HealthInfo{Up: true}
+		t.info[tag] = info
+	}
+	info.Checked = time.Now()
+	if err != nil {
+		info.Error = err.Error()
+		info.Successes = 0
+		info.Failures++
+		if info.Up && info.Failures >= cfg.Fall {
+			info.Up = false
+			t.ndown.Add(1)
+			log.Printf("Health check %s: down after %d failures: %v\n", tag, info.Failures, err)
+		}
+		return
+	}
+	info.Error = ""
+	info.Failures = 0
+	info.LatencyMS = latency.Milliseconds()
+	if !info.Up {
+		info.Successes++
+		if info.Successes >= cfg.Rise {
+			info.Up = true
+			info.Successes = 0
+			t.ndown.Add(-1)
+			log.Printf("Health check %s: up again (%dms)\n", tag, info.LatencyMS)
+		}
+	}
+}
+
+// startHealthChecks probes every upstream outbound in the background
+func startHealthChecks(cfg *HealthCheckConfig) {
+	if cfg.URL == "" {
+		cfg.URL = "http://www.gstatic.com/generate_204"
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = Duration(30 * time.Second)
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = Duration(5 * time.Second)
+	}
+	if cfg.Fall <= 0 {
+		cfg.Fall = 3
+	}
+	if cfg.Rise <= 0 {
+		cfg.Rise = 2
+	}
+	for tag, o := range outbounds {
+		if !isUpstream(o) {
+			continue
+		}
+		go func(tag string, o Outbound) {
+			for {
+				latency, err := probeOutbound(o, cfg.URL, time.Duration(cfg.Timeout))
+				health.update(tag, latency, err, cfg)
+				time.Sleep(time.Duration(cfg.Interval))
+			}
+		}(tag, o)
+	}
+}
+
+// probeOutbound fetches a probe URL through an outbound over a new
+// connection and returns how long the response took; server errors count
+// as failures since proxies report their own failures that way
+func probeOutbound(o Outbound, url string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	resp, err := outboundClient(o, timeout).Get(url)
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return 0, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return latency, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DialFunc dials a destination through one outbound
+type DialFunc func(m *Metadata) (net.Conn, error)
+
+// DialHook wraps the dials of an outbound, e.g. to record telemetry, wrap
+// the returned connection or try an experimental transport. It is called
+// with the outbound tag and the next dial in the chain and returns the dial
+// to use instead; returning next unchanged skips the outbound.
+//
+// Hooks are compiled in: a file in this package registers its hook from an
+// init function with registerDialHook, and the "dial_hooks" config turns
+// it on by name.
+type DialHook func(tag string, next DialFunc) DialFunc
+
+// dialHookRegistry holds the compiled-in hooks by name
+var dialHookRegistry = map[string]DialHook{}
+
+// dialHooks are the hooks turned on by the config, outermost first
+var dialHooks []DialHook
+
+// registerDialHook makes a hook available to the config under name; it
+// panics on duplicate names, like other init-time registration mistakes
+func registerDialHook(name string, h DialHook) {
+	if _, ok := dialHookRegistry[name]; ok {
+		panic("dial hook registered twice: " + name)
+	}
+	dialHookRegistry[name] = h
+}
+
+// setDialHooks turns on the named hooks in order
+func setDialHooks(names []string) error {
+	for _, name := range names {
+		h, ok := dialHookRegistry[name]
+		if !ok {
+			var known []string
+			for n := range dialHookRegistry {
+				known = append(known, n)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("dial_hooks: unknown hook %q (available: %s)", name, strings.Join(known, ", "))
+		}
+		dialHooks = append(dialHooks, h)
+	}
+	return nil
+}
+
+// hookedDial returns the dial of an outbound wrapped in the enabled hooks
+func hookedDial(tag string, o Outbound) DialFunc {
+	dial := DialFunc(o.Dial)
+	for i := len(dialHooks) - 1; i >= 0; i-- {
+		dial = dialHooks[i](tag, dial)
+	}
+	return dial
+}
+
+func init() {
+	// dial-log logs the duration and outcome of every outbound dial
+	registerDialHook("dial-log", func(tag string, next DialFunc) DialFunc {
+		return func(m *Metadata) (net.Conn, error) {
+			start := time.Now()
+			conn, err := next(m)
+			if err != nil {
+				log.Printf("Dial %s via %s failed after %v: %v\n", m.Dest, tag, time.Since(start).Round(time.Millisecond), err)
+			} else {
+				log.Printf("Dial %s via %s took %v\n", m.Dest, tag, time.Since(start).Round(time.Millisecond))
+			}
+			return conn, err
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostsCheck is how often hosts files are checked for changes
+const hostsCheck = 5 * time.Second
+
+// hostsTable holds the names of /etc/hosts-style files, which take
+// precedence over DNS for every strategy that resolves
+type hostsTable struct {
+	files []string
+
+	mu    sync.RWMutex
+	names map[string][]net.IP
+	stamp string // Sizes and modification times of the files as loaded
+}
+
+// hostsFiles is nil without "hosts_files"
+var hostsFiles *hostsTable
+
+// setHostsFiles loads the "hosts_files" config and rereads the files in the
+// background whenever one changes
+func setHostsFiles(files []string) error {
+	hostsFiles = nil
+	if len(files) == 0 {
+		return nil
+	}
+	t := &hostsTable{files: files}
+	if err := t.load(); err != nil {
+		return fmt.Errorf("hosts_files: %v", err)
+	}
+	hostsFiles = t
+	go t.watch()
+	return nil
+}
+
+// lookup returns the addresses a hosts file gives a name
+func (t *hostsTable) lookup(host string) ([]net.IP, bool) {
+	if t == nil {
+		return nil, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ips, ok := t.names[strings.ToLower(strings.TrimSuffix(host, "."))]
+	return ips, ok
+}
+
+// stat describes the files' current versions; an unreadable file shows
+// as such, so its return is noticed too
+func (t *hostsTable) stat() string {
+	var b strings.Builder
+	for _, f := range t.files {
+		info, err := os.Stat(f)
+		if err != nil {
+			fmt.Fprintf(&b, "%s:-;", f)
+			continue
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", f, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String()
+}
+
+// load reads all files; later entries for a name add to earlier ones
+func (t *hostsTable) load() error {
+	stamp := t.stat()
+	names := map[string][]net.IP{}
+	for _, f := range t.files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		parseHosts(data, names)
+	}
+	t.mu.Lock()
+	t.names, t.stamp = names, stamp
+	t.mu.Unlock()
+	return nil
+}
+
+// parseHosts adds the entries of a hosts file: an address followed by
+// names, '#' starting a comment. Lines with an invalid address are
+// skipped, as the system resolver does.
+func parseHosts(data []byte, names map[string][]net.IP) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			names[name] = append(names[name], ip)
+		}
+	}
+}
+
+// watch rereads the files when their size or modification time changes,
+// keeping the old entries when that fails
+func (t *hostsTable) watch() {
+	for {
+		time.Sleep(hostsCheck)
+		t.mu.RLock()
+		stamp := t.stamp
+		t.mu.RUnlock()
+		if t.stat() == stamp {
+			continue
+		}
+		if err := t.load(); err != nil {
+			log.Printf("Hosts files: reload failed: %v\n", err)
+			// Retry only once the files change again
+			t.mu.Lock()
+			t.stamp = t.stat()
+			t.mu.Unlock()
+			continue
+		}
+		dnsCache.flush()
+		log.Printf("Hosts files: reloaded\n")
+	}
+}
+
+// staticHosts holds the "hosts" records of the config, which take
+// precedence over the hosts files: addresses, or another name resolved in
+// place of the name
+var staticHosts struct {
+	ips     map[string][]net.IP
+	aliases map[string]string
+}
+
+// setStaticHosts compiles the "hosts" config
+func setStaticHosts(records map[string][]string) error {
+	staticHosts.ips = map[string][]net.IP{}
+	staticHosts.aliases = map[string]string{}
+	for name, values := range records {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if len(values) == 0 {
+			return fmt.Errorf("hosts: %s: no addresses", name)
+		}
+		if len(values) == 1 && net.ParseIP(values[0]) == nil {
+			target := strings.ToLower(strings.TrimSuffix(values[0], "."))
+			if target == "" || strings.ContainsAny(target, " /:") {
+				return fmt.Errorf("hosts: %s: %q is neither an address nor a host name", name, values[0])
+			}
+			staticHosts.aliases[name] = target
+			continue
+		}
+		for _, v := range values {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return fmt.Errorf("hosts: %s: invalid address %q; a host name must be the only value", name, v)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			staticHosts.ips[name] = append(staticHosts.ips[name], ip)
+		}
+	}
+	return nil
+}
+
+// hostsLookup returns the addresses the "hosts" config or the hosts files
+// give a name
+func hostsLookup(host string) ([]net.IP, bool) {
+	if ips, ok := staticHosts.ips[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+		return ips, true
+	}
+	return hostsFiles.lookup(host)
+}
+
+// maxAliases bounds how many "hosts" aliases are followed for one name
+const maxAliases = 8
+
+// hostsAlias returns the name to resolve in place of host: the target of
+// its "hosts" alias, followed through further aliases, else host itself
+func hostsAlias(host string) string {
+	for range maxAliases {
+		target, ok := staticHosts.aliases[strings.ToLower(strings.TrimSuffix(host, "."))]
+		if !ok {
+			break
+		}
+		host = target
+	}
+	return host
+}
+
+// staticResolver answers with fixed addresses
+type staticResolver []net.IP
+
+func (r staticResolver) LookupIP(host string) ([]net.IP, error) {
+	return append([]net.IP(nil), r...), nil
+}
+
+func (r staticResolver) LookupFamily(network, host string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, ip := range r {
+		if (ip.To4() != nil) == (network == "ip4") {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
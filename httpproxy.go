@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// httpOutbound connects through an HTTP proxy with the CONNECT method
+type httpOutbound struct {
+	addr      string
+	username  string // Empty for no Proxy-Authorization
+	password  string
+	transport *TransportConfig // nil for plain TCP; set tls for an HTTPS proxy
+	spare     *sparePool       // Connections with the transport set up, nil when not pooled
+	dialer    *net.Dialer      // Binds connections to an interface, source address or mark, nil for none
+}
+
+func (o httpOutbound) String() string {
+	s := "http " + o.addr
+	if o.username != "" {
+		s = "http " + o.username + "@" + o.addr
+	}
+	return s + transportSuffix(o.transport)
+}
+
+func (o httpOutbound) Dial(m *Metadata) (net.Conn, error) {
+	if o.spare != nil {
+		if conn := o.spare.take(); conn != nil {
+			conn, err := o.connect(conn, m)
+			var stale *noReplyError
+			if !errors.As(err, &stale) {
+				return conn, err
+			}
+		}
+	}
+	conn, err := dialTransport(o.addr, o.transport, o.dialer)
+	if err != nil {
+		return nil, err
+	}
+	return o.connect(conn, m)
+}
+
+// connect sends the CONNECT request on a connection to the proxy; conn is
+// closed on failure. A failure before any byte of the response is a
+// *noReplyError.
+func (o httpOutbound) connect(conn net.Conn, m *Metadata) (net.Conn, error) {
+	target := m.Dest.String()
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if o.username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(o.username + ":" + o.password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, &noReplyError{err}
+	}
+
+	br := bufio.NewReader(conn)
+	if _, err := br.Peek(1); err != nil {
+		conn.Close()
+		return nil, &noReplyError{err}
+	}
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream CONNECT %s: %s", target, resp.Status)
+	}
+	if n := br.Buffered(); n > 0 {
+		// The destination spoke first and its bytes were read along with
+		// the response
+		early, _ := br.Peek(n)
+		return &peekConn{Conn: conn, buf: early}, nil
+	}
+	return conn, nil
+}
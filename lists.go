@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+)
+
+// ListConfig is a named list of domains and CIDRs defined in the config,
+// inline or in a text file, referenced like a geosite/geoip category
+type ListConfig struct {
+	Entries []string `json:"entries"` // "example.com", "full:host", "keyword:", "regexp:", "10.0.0.0/8", ...
+	Path    string   `json:"path"`    // Text file with one entry per line, '#' comments
+}
+
+// customList is a compiled custom list
+type customList struct {
+	domains *domainMatcher
+	ips     *ipMatcher
+}
+
+func (l *customList) Match(m *Metadata) bool {
+	return l.domains.Match(m) || l.ips.Match(m)
+}
+
+func (l *customList) entries() int {
+	return l.domains.entries() + l.ips.entries()
+}
+
+// loadLists compiles the custom lists of a configuration
+func loadLists(cfgs map[string]ListConfig) (map[string]*customList, error) {
+	lists := map[string]*customList{}
+	for name, lc := range cfgs {
+		l := &customList{domains: newDomainMatcher(), ips: &ipMatcher{}}
+		entries := lc.Entries
+		if lc.Path != "" {
+			more, err := readListFile(lc.Path)
+			if err != nil {
+				return nil, fmt.Errorf("list %s: %v", name, err)
+			}
+			entries = append(entries, more...)
+		}
+		for _, e := range entries {
+			if err := l.add(e); err != nil {
+				return nil, fmt.Errorf("list %s: %v", name, err)
+			}
+		}
+		lists[strings.ToLower(name)] = l
+	}
+	return lists, nil
+}
+
+// readListFile reads the entries of a list file, one per line with '#'
+// comments
+func readListFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries, nil
+}
+
+// add inserts an entry: an IP or CIDR, a domain with an optional
+// "domain:", "full:", "keyword:" or "regexp:" prefix, or a bare domain
+// matching itself and its subdomains
+func (l *customList) add(entry string) error {
+	kind, value, _ := strings.Cut(entry, ":")
+	if typ, ok := map[string]routercommon.Domain_Type{
+		"domain":  routercommon.Domain_RootDomain,
+		"full":    routercommon.Domain_Full,
+		"keyword": routercommon.Domain_Plain,
+		"regexp":  routercommon.Domain_Regex,
+	}[kind]; ok {
+		return l.domains.add(typ, value)
+	}
+	if strings.Contains(entry, "/") || net.ParseIP(entry) != nil {
+		n, err := parseCIDR(entry)
+		if err != nil {
+			return err
+		}
+		l.ips.nets = append(l.ips.nets, n)
+		return nil
+	}
+	if strings.Contains(entry, ":") {
+		return fmt.Errorf("invalid entry %q", entry)
+	}
+	return l.domains.add(routercommon.Domain_RootDomain, entry)
+}
+
+func init() {
+	registerGeoSourceFormat("text", newTextSource)
+}
+
+// textSource serves categories from a directory of "<code>.txt" files in
+// the custom list format; a category matches both its domains and its
+// addresses, so the same file works for geosite: and geoip:
+type textSource struct {
+	dir string
+
+	mu    sync.Mutex
+	lists map[string]*customList // Compiled files by lower-case code
+}
+
+func newTextSource(cfg GeoSourceConfig) (GeoSource, error) {
+	return &textSource{dir: cfg.Path, lists: map[string]*customList{}}, nil
+}
+
+func (s *textSource) Site(code string) (Matcher, error) {
+	return s.list(code)
+}
+
+func (s *textSource) IP(code string) (Matcher, error) {
+	return s.list(code)
+}
+
+// list compiles the file of a category on first use
+func (s *textSource) list(code string) (Matcher, error) {
+	code = strings.ToLower(code)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l := s.lists[code]; l != nil {
+		return l, nil
+	}
+	if _, err := os.Stat(s.dir); err != nil {
+		return nil, &unavailableError{fmt.Errorf("load text: %v", err)}
+	}
+	if strings.ContainsAny(code, `/\`) {
+		return nil, errNoCategory
+	}
+	entries, err := readListFile(filepath.Join(s.dir, code+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNoCategory
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &customList{domains: newDomainMatcher(), ips: &ipMatcher{}}
+	for _, e := range entries {
+		if err := l.add(e); err != nil {
+			return nil, fmt.Errorf("%s.txt: %v", code, err)
+		}
+	}
+	s.lists[code] = l
+	return l, nil
+}
+
+func (s *textSource) Loaded() (DataFileSummary, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return DataFileSummary{Kind: "text", Path: s.dir}, len(s.lists) > 0
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// memConn is a client connection replaying a fixed byte stream and
+// discarding what is written to it, so the parsing paths can be measured
+// without sockets. Methods other than Read, Write and Close are not
+// implemented.
+type memConn struct {
+	net.Conn
+	r bytes.Reader
+}
+
+func newMemConn(data []byte) *memConn {
+	c := &memConn{}
+	c.r.Reset(data)
+	return c
+}
+
+func (c *memConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *memConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *memConn) Close() error                { return nil }
+
+// requests are CONNECT requests for each address type
+var requests = []struct {
+	name string
+	req  []byte
+	want Addr
+}{
+	{"ipv4", []byte{0x05, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0x01, 0xbb}, Addr{Atyp: 0x01, Addr: []byte{192, 0, 2, 1}, Port: 443}},
+	{"domain", append(append([]byte{0x05, 0x01, 0x00, 0x03, 11}, "example.com"...), 0x00, 0x50), Addr{Atyp: 0x03, Addr: []byte("example.com"), Port: 80}},
+	{"ipv6", append(append([]byte{0x05, 0x01, 0x00, 0x04}, net.ParseIP("2001:db8::1")...), 0x00, 0x16), Addr{Atyp: 0x04, Addr: net.ParseIP("2001:db8::1"), Port: 22}},
+}
+
+func TestReadRequest(t *testing.T) {
+	for _, tt := range requests {
+		cmd, addr, err := readRequest(newMemConn(tt.req))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if cmd != 0x01 || addr.Atyp != tt.want.Atyp || !bytes.Equal(addr.Addr, tt.want.Addr) || addr.Port != tt.want.Port {
+			t.Errorf("%s: got command %d, %+v, want CONNECT %+v", tt.name, cmd, addr, tt.want)
+		}
+	}
+}
+
+// TestReadRequestAllocs guards the allocations of request parsing: only
+// the returned address is allocated, the rest uses pooled buffers
+func TestReadRequestAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts differ under the race detector")
+	}
+	for _, tt := range requests {
+		conn := newMemConn(tt.req)
+		allocs := testing.AllocsPerRun(100, func() {
+			conn.r.Reset(tt.req)
+			readRequest(conn)
+		})
+		if allocs > 1 {
+			t.Errorf("%s: readRequest allocates %v times, want at most 1", tt.name, allocs)
+		}
+	}
+}
+
+func BenchmarkReadRequest(b *testing.B) {
+	for _, tt := range requests {
+		b.Run(tt.name, func(b *testing.B) {
+			conn := newMemConn(tt.req)
+			b.ReportAllocs()
+			for range b.N {
+				conn.r.Reset(tt.req)
+				if _, _, err := readRequest(conn); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+)
+
+// Matcher decides whether a connection matches a rule
+type Matcher interface {
+	Match(m *Metadata) bool
+}
+
+// domainMatcher matches the requested host name against domain lists
+type domainMatcher struct {
+	full     map[string]bool
+	suffix   map[string]bool
+	keywords []string
+	regexps  []*regexp.Regexp
+}
+
+func newDomainMatcher() *domainMatcher {
+	return &domainMatcher{full: map[string]bool{}, suffix: map[string]bool{}}
+}
+
+// add inserts a domain of the given v2ray type into the matcher
+func (d *domainMatcher) add(typ routercommon.Domain_Type, value string) error {
+	value = strings.ToLower(value)
+	switch typ {
+	case routercommon.Domain_Full:
+		d.full[value] = true
+	case routercommon.Domain_RootDomain:
+		d.suffix[value] = true
+	case routercommon.Domain_Plain:
+		d.keywords = append(d.keywords, value)
+	case routercommon.Domain_Regex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return err
+		}
+		d.regexps = append(d.regexps, re)
+	default:
+		return fmt.Errorf("unknown domain type %v", typ)
+	}
+	return nil
+}
+
+func (d *domainMatcher) Match(m *Metadata) bool {
+	if m.Host == "" {
+		return false
+	}
+	return d.matchHost(strings.ToLower(m.Host))
+}
+
+// matchHost checks a lower-cased host name against all lists
+func (d *domainMatcher) matchHost(host string) bool {
+	if d.full[host] {
+		return true
+	}
+	// Walk up the labels: a.b.example.com, b.example.com, example.com, com
+	for h := host; ; {
+		if d.suffix[h] {
+			return true
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+	for _, k := range d.keywords {
+		if strings.Contains(host, k) {
+			return true
+		}
+	}
+	for _, re := range d.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipMatcher matches the destination addresses against a list of networks
+type ipMatcher struct {
+	nets    []*net.IPNet
+	inverse bool
+}
+
+func (i *ipMatcher) Match(m *Metadata) bool {
+	for _, ip := range m.IPs() {
+		if i.contains(ip) != i.inverse {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *ipMatcher) contains(ip net.IP) bool {
+	for _, n := range i.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateMatcher is the built-in geoip:private: RFC 1918, loopback,
+// link-local and unique local addresses
+var privateMatcher = &ipMatcher{nets: mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"::1/128",
+	"fe80::/10",
+	"fc00::/7",
+)}
+
+// mustParseCIDRs parses a list of constant CIDRs
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// portMatcher matches the destination port against an inclusive range
+type portMatcher struct {
+	from, to uint16
+}
+
+func (p portMatcher) Match(m *Metadata) bool {
+	return m.Dest.Port >= p.from && m.Dest.Port <= p.to
+}
+
+// sourceMatcher matches the client address against CIDRs
+type sourceMatcher []*net.IPNet
+
+func (s sourceMatcher) Match(m *Metadata) bool {
+	var ip net.IP
+	switch a := m.Source.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	for _, n := range s {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// perClient marks the decision as depending on the client, not just the
+// destination
+func (sourceMatcher) perClient() {}
+
+// andMatcher matches when all of its parts match; parts are evaluated in
+// order and stop at the first miss
+type andMatcher []Matcher
+
+func (a andMatcher) Match(m *Metadata) bool {
+	for _, part := range a {
+		if !part.Match(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// familyMatcher matches the address families the destination resolves to
+type familyMatcher struct {
+	v4, v6 bool // Family that must be present
+	only   bool // The other family must be absent
+}
+
+func (f familyMatcher) Match(m *Metadata) bool {
+	var has4, has6 bool
+	for _, ip := range m.IPs() {
+		if ip.To4() != nil {
+			has4 = true
+		} else {
+			has6 = true
+		}
+	}
+	if f.v4 && f.v6 {
+		return has4 && has6
+	}
+	if f.v4 {
+		return has4 && (!f.only || !has6)
+	}
+	return has6 && (!f.only || !has4)
+}
+
+// asnMatcher matches the autonomous system of the destination addresses
+type asnMatcher struct {
+	db  *mmdbReader
+	asn uint64
+}
+
+func (a asnMatcher) Match(m *Metadata) bool {
+	for _, ip := range m.IPs() {
+		if asn, ok := lookupASN(a.db, ip); ok && asn == a.asn {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupASN returns the autonomous system number of ip from a
+// GeoLite2-ASN style database
+func lookupASN(db *mmdbReader, ip net.IP) (uint64, bool) {
+	v, err := db.Lookup(ip)
+	if err != nil {
+		log.Printf("ASN lookup %s: %v", ip, err)
+		return 0, false
+	}
+	rec, ok := v.(map[string]any)
+	if !ok {
+		return 0, false
+	}
+	asn, ok := rec["autonomous_system_number"].(uint64)
+	return asn, ok
+}
+
+// parseMatcher builds a Matcher from its textual form, e.g. "geosite:cn",
+// "domain:example.com", "ip:10.0.0.0/8", "asn:13335" or "port:8000-9000"
+func parseMatcher(s string, geo *GeoData) (Matcher, error) {
+	if strings.Contains(s, "&&") {
+		var a andMatcher
+		for _, part := range strings.Split(s, "&&") {
+			m, err := parseMatcher(strings.TrimSpace(part), geo)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, m)
+		}
+		return a, nil
+	}
+	kind, value, ok := strings.Cut(s, ":")
+	if !ok || value == "" {
+		return nil, fmt.Errorf("invalid matcher %q", s)
+	}
+	switch kind {
+	case "geosite", "geoip", "asn":
+		if kind == "geoip" && strings.EqualFold(value, "private") {
+			return privateMatcher, nil
+		}
+		if l := geo.Lists[strings.ToLower(value)]; l != nil && kind != "asn" {
+			if kind == "geosite" {
+				return l.domains, nil
+			}
+			return l.ips, nil
+		}
+		m, err := parseGeoMatcher(kind, value, geo)
+		var unavailable *unavailableError
+		if err != nil && geo.SoftFail && errors.As(err, &unavailable) {
+			log.Printf("%s: %v, retrying in the background\n", s, err)
+			return newPendingMatcher(s, func() (Matcher, error) {
+				return parseGeoMatcher(kind, value, geo)
+			}), nil
+		}
+		return m, err
+	case "domain", "full", "keyword", "regexp":
+		typ := map[string]routercommon.Domain_Type{
+			"domain":  routercommon.Domain_RootDomain,
+			"full":    routercommon.Domain_Full,
+			"keyword": routercommon.Domain_Plain,
+			"regexp":  routercommon.Domain_Regex,
+		}[kind]
+		d := newDomainMatcher()
+		if err := d.add(typ, value); err != nil {
+			return nil, fmt.Errorf("%s: %v", s, err)
+		}
+		return d, nil
+	case "ip", "cidr":
+		n, err := parseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return &ipMatcher{nets: []*net.IPNet{n}}, nil
+	case "provider":
+		p, ok := providers[value]
+		if !ok {
+			return nil, fmt.Errorf("unknown provider %q", value)
+		}
+		return p, nil
+	case "family":
+		f, ok := map[string]familyMatcher{
+			"ipv4":      {v4: true},
+			"ipv6":      {v6: true},
+			"ipv4-only": {v4: true, only: true},
+			"ipv6-only": {v6: true, only: true},
+			"dual":      {v4: true, v6: true},
+		}[strings.ToLower(value)]
+		if !ok {
+			return nil, fmt.Errorf("invalid family %q", value)
+		}
+		return f, nil
+	case "process":
+		return processMatcher(value), nil
+	case "label", "namespace":
+		return parsePodMatcher(kind, value)
+	case "port":
+		from, to, _ := strings.Cut(value, "-")
+		if to == "" {
+			to = from
+		}
+		f, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", value)
+		}
+		t, err := strconv.ParseUint(to, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", value)
+		}
+		return portMatcher{from: uint16(f), to: uint16(t)}, nil
+	case "list":
+		l := geo.Lists[strings.ToLower(value)]
+		if l == nil {
+			return nil, fmt.Errorf("unknown list %q", value)
+		}
+		return l, nil
+	case "threat":
+		return parseThreatMatcher(value)
+	case "source":
+		n, err := parseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return sourceMatcher{n}, nil
+	default:
+		return nil, fmt.Errorf("unknown matcher type %q", kind)
+	}
+}
+
+// parseGeoMatcher builds geosite:, geoip: and asn: matchers from the
+// databases in geo
+func parseGeoMatcher(kind, value string, geo *GeoData) (Matcher, error) {
+	switch kind {
+	case "geosite":
+		return geo.Site(value)
+	case "geoip":
+		return geo.IP(value)
+	case "asn":
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(value), "AS"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ASN %q", value)
+		}
+		db, err := geo.ASN()
+		if err != nil {
+			return nil, err
+		}
+		return asnMatcher{db: db, asn: asn}, nil
+	default:
+		return nil, fmt.Errorf("unknown matcher type %q", kind)
+	}
+}
+
+// parseCIDR accepts either a CIDR or a single IP address
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// mmdbMetadataMarker precedes the metadata section of a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbReader is a minimal reader for MaxMind DB (.mmdb) files such as
+// GeoLite2-ASN, see https://maxmind.github.io/MaxMind-DB/
+type mmdbReader struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	treeSize   uint
+	ipv4Start  uint
+	data       []byte
+}
+
+// openMMDB reads a MaxMind DB file into memory
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	meta := buf[i+len(mmdbMetadataMarker):]
+	v, _, err := mmdbDecode(meta, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: metadata: %v", path, err)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid metadata", path)
+	}
+	r := &mmdbReader{
+		buf:        buf,
+		nodeCount:  uint(mmdbUint(m["node_count"])),
+		recordSize: uint(mmdbUint(m["record_size"])),
+		ipVersion:  uint(mmdbUint(m["ip_version"])),
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, r.recordSize)
+	}
+	r.treeSize = r.nodeCount * r.recordSize / 4
+	if r.treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%s: truncated search tree", path)
+	}
+	r.data = buf[r.treeSize+16 : i]
+
+	// IPv4 addresses live under ::/96 in IPv6 trees
+	if r.ipVersion == 6 {
+		for n := 0; n < 96 && r.ipv4Start < r.nodeCount; n++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	off := node * r.recordSize / 4
+	b := r.buf[off:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Lookup returns the data record for an IP, or nil when it is not covered
+func (r *mmdbReader) Lookup(ip net.IP) (any, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, fmt.Errorf("invalid search tree")
+	}
+	v, _, err := mmdbDecode(r.data, node-r.nodeCount-16)
+	return v, err
+}
+
+// mmdbDecode decodes the data field at off, returning it and the offset
+// of the next field
+func mmdbDecode(data []byte, off uint) (any, uint, error) {
+	if off >= uint(len(data)) {
+		return nil, 0, fmt.Errorf("offset out of range")
+	}
+	ctrl := data[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == 1 { // Pointer
+		ss := uint(ctrl>>3) & 0x3
+		vvv := uint(ctrl & 0x7)
+		if off+ss+1 > uint(len(data)) {
+			return nil, 0, fmt.Errorf("pointer out of range")
+		}
+		var p uint
+		switch ss {
+		case 0:
+			p = vvv<<8 | uint(data[off])
+		case 1:
+			p = (vvv<<16 | uint(data[off])<<8 | uint(data[off+1])) + 2048
+		case 2:
+			p = (vvv<<24 | uint(data[off])<<16 | uint(data[off+1])<<8 | uint(data[off+2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(data[off:]))
+		}
+		v, _, err := mmdbDecode(data, p)
+		return v, off + ss + 1, err
+	}
+	if typ == 0 { // Extended type
+		if off >= uint(len(data)) {
+			return nil, 0, fmt.Errorf("offset out of range")
+		}
+		typ = 7 + uint(data[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(data)) {
+			return nil, 0, fmt.Errorf("size out of range")
+		}
+		var ext uint
+		for _, b := range data[off : off+n] {
+			ext = ext<<8 | uint(b)
+		}
+		off += n
+		size = []uint{29, 285, 65821}[n-1] + ext
+	}
+
+	switch typ {
+	case 7: // Map
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := mmdbDecode(data, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a string")
+			}
+			m[key], off, err = mmdbDecode(data, next)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case 11: // Array
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v any
+			var err error
+			v, off, err = mmdbDecode(data, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+	case 14: // Boolean, the value is stored in the size
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(data)) {
+		return nil, 0, fmt.Errorf("field out of range")
+	}
+	b := data[off : off+size]
+	off += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), off, nil
+	case 3: // Double
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 4: // Bytes
+		return b, off, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, off, nil
+	case 8: // int32
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		return int64(int32(u)), off, nil
+	case 10: // uint128, kept as raw bytes
+		return b, off, nil
+	case 15: // Float
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
+
+// mmdbUint converts a decoded unsigned value, returning 0 for other types
+func mmdbUint(v any) uint64 {
+	u, _ := v.(uint64)
+	return u
+}
+
+func init() {
+	registerGeoSourceFormat("mmdb", newCountrySource)
+}
+
+// countrySource serves geoip categories by country code from a
+// GeoLite2-Country style database
+type countrySource struct {
+	path string
+
+	mu sync.Mutex
+	db *mmdbReader
+}
+
+func newCountrySource(cfg GeoSourceConfig) (GeoSource, error) {
+	return &countrySource{path: cfg.Path}, nil
+}
+
+func (s *countrySource) Site(code string) (Matcher, error) {
+	return nil, errNoCategory
+}
+
+func (s *countrySource) IP(code string) (Matcher, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		db, err := openMMDB(s.path)
+		if err != nil {
+			return nil, &unavailableError{fmt.Errorf("load mmdb: %v", err)}
+		}
+		s.db = db
+	}
+	if len(code) != 2 {
+		return nil, errNoCategory
+	}
+	return countryMatcher{db: s.db, code: strings.ToUpper(code)}, nil
+}
+
+func (s *countrySource) Loaded() (DataFileSummary, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return DataFileSummary{Kind: "geoip", Path: s.path}, s.db != nil
+}
+
+// countryMatcher matches destination addresses located in a country
+type countryMatcher struct {
+	db   *mmdbReader
+	code string
+}
+
+func (c countryMatcher) Match(m *Metadata) bool {
+	for _, ip := range m.IPs() {
+		v, err := c.db.Lookup(ip)
+		if err != nil {
+			continue
+		}
+		rec, _ := v.(map[string]any)
+		country, _ := rec["country"].(map[string]any)
+		if code, _ := country["iso_code"].(string); code == c.code {
+			return true
+		}
+	}
+	return false
+}
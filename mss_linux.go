@@ -0,0 +1,26 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// pathMSS returns the maximum segment size of a TCP connection, which
+// follows the path MTU, 0 when it is not a TCP connection
+func pathMSS(conn net.Conn) int {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	mss := 0
+	raw.Control(func(fd uintptr) {
+		mss, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG)
+	})
+	return mss
+}
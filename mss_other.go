@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// pathMSS is only implemented on Linux; elsewhere frames are sized for a
+// 1500-byte MTU
+func pathMSS(conn net.Conn) int {
+	return 0
+}
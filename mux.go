@@ -0,0 +1,759 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Multiplexing follows the sing-mux framing, which sing-box servers accept
+// on their inbounds with "multiplex" enabled: the client connects through
+// the outbound to sp.mux.sing-box.arpa:444, sends a version and protocol
+// byte and runs smux or yamux over the connection. Every stream starts with
+// flags and a SOCKS5 address; the server answers with a status byte,
+// followed by a length-prefixed message on failure.
+const (
+	muxHost = "sp.mux.sing-box.arpa"
+	muxPort = 444
+
+	muxProtocolSmux  = 0
+	muxProtocolYamux = 1
+
+	muxFlagUDP    = 1
+	muxStatusOK   = 0
+	muxStatusFail = 1
+
+	muxMaxBuffer   = 4 << 20          // smux: data buffered per session, at most; reading pauses at it
+	muxFrameSize   = 32 << 10         // Largest data frame sent
+	yamuxWindow    = 256 << 10        // yamux: initial stream window
+	muxIdleTimeout = 90 * time.Second // Client sessions without streams are closed after this
+)
+
+// MuxConfig multiplexes the connections of an outbound over a few
+// long-lived upstream connections; the server must accept sing-mux with
+// the same protocol
+type MuxConfig struct {
+	Protocol       string `json:"protocol"`        // "smux" (default) or "yamux"
+	MaxConnections int    `json:"max_connections"` // Upstream connections opened at most, default 4
+	MaxStreams     int    `json:"max_streams"`     // Client connections per upstream connection before another is opened, default 16
+}
+
+var (
+	errMuxClosed = errors.New("mux session closed")
+	errMuxWindow = errors.New("mux: peer overran the receive window")
+)
+
+// isMuxDest reports whether a requested destination starts a mux session
+func isMuxDest(a Addr) bool {
+	return a.Atyp == 0x03 && string(a.Addr) == muxHost && a.Port == muxPort
+}
+
+// muxOutbound carries the connections of an outbound as streams of shared
+// upstream connections
+type muxOutbound struct {
+	next Outbound
+	cfg  MuxConfig
+
+	mu       sync.Mutex
+	sessions []*muxSession
+}
+
+// newMuxOutbound wraps an outbound in a mux layer
+func newMuxOutbound(next Outbound, cfg MuxConfig) (*muxOutbound, error) {
+	switch cfg.Protocol {
+	case "", "smux", "yamux":
+	default:
+		return nil, fmt.Errorf("mux: unknown protocol %q", cfg.Protocol)
+	}
+	if cfg.Protocol == "" {
+		cfg.Protocol = "smux"
+	}
+	if cfg.MaxConnections <= 0 {
+		cfg.MaxConnections = 4
+	}
+	if cfg.MaxStreams <= 0 {
+		cfg.MaxStreams = 16
+	}
+	return &muxOutbound{next: next, cfg: cfg}, nil
+}
+
+func (o *muxOutbound) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return fmt.Sprintf("%v (%s, %d sessions)", o.next, o.cfg.Protocol, len(o.sessions))
+}
+
+func (o *muxOutbound) Dial(m *Metadata) (net.Conn, error) {
+	st, err := o.openStream(m)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := st.Write(appendAddr([]byte{0, 0}, m.Dest)); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return &muxClientConn{muxStream: st}, nil
+}
+
+// openStream opens a stream on the least loaded session, opening another
+// session while all have MaxStreams streams and fewer than MaxConnections
+// are open
+func (o *muxOutbound) openStream(m *Metadata) (*muxStream, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	live := o.sessions[:0]
+	var best *muxSession
+	for _, s := range o.sessions {
+		if s.dead() {
+			continue
+		}
+		live = append(live, s)
+		if best == nil || s.count() < best.count() {
+			best = s
+		}
+	}
+	clear(o.sessions[len(live):])
+	o.sessions = live
+	if best != nil && (best.count() < o.cfg.MaxStreams || len(o.sessions) >= o.cfg.MaxConnections) {
+		return best.open()
+	}
+	conn, err := o.next.Dial(newMetadata(m.Source, Addr{Atyp: 0x03, Addr: []byte(muxHost), Port: muxPort}))
+	if err != nil {
+		return nil, err
+	}
+	protocol := byte(muxProtocolSmux)
+	if o.cfg.Protocol == "yamux" {
+		protocol = muxProtocolYamux
+	}
+	if _, err := conn.Write([]byte{0, protocol}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s := newMuxSession(conn, protocol == muxProtocolYamux, true)
+	o.sessions = append(o.sessions, s)
+	return s.open()
+}
+
+// muxClientConn is a stream opened by the client; the server's status is
+// read before the first data, so the request and data go out without
+// waiting for it
+type muxClientConn struct {
+	*muxStream
+	status bool // Status read
+}
+
+func (c *muxClientConn) Read(p []byte) (int, error) {
+	if !c.status {
+		c.status = true
+		var status [1]byte
+		if _, err := io.ReadFull(c.muxStream, status[:]); err != nil {
+			return 0, err
+		}
+		if status[0] != muxStatusOK {
+			msg, err := readMuxMessage(c.muxStream)
+			if err != nil {
+				return 0, fmt.Errorf("mux: upstream request failed")
+			}
+			return 0, fmt.Errorf("mux: upstream request failed: %s", msg)
+		}
+	}
+	return c.muxStream.Read(p)
+}
+
+// readMuxMessage reads a message prefixed with its uvarint length
+func readMuxMessage(r io.Reader) (string, error) {
+	br := bufio.NewReaderSize(r, 16)
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	if n > reasonMaxLen {
+		return "", fmt.Errorf("message too long")
+	}
+	msg := make([]byte, n)
+	_, err = io.ReadFull(br, msg)
+	return string(msg), err
+}
+
+// serveMux runs a mux session requested by a client, handling each stream
+// like a CONNECT request
+func serveMux(client net.Conn, user string, cfg *Config, router *Router) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(client, hdr[:]); err != nil {
+		return
+	}
+	if hdr[0] != 0 || hdr[1] > muxProtocolYamux {
+		// Version 1 adds padding and protocol 2 is HTTP/2, neither is
+		// supported
+		log.Printf("Mux from %s: unsupported version %d or protocol %d\n", client.RemoteAddr(), hdr[0], hdr[1])
+		return
+	}
+	s := newMuxSession(client, hdr[1] == muxProtocolYamux, false)
+	defer s.close(errMuxClosed)
+	for st := range s.accept {
+		go serveMuxStream(st, user, cfg, router)
+	}
+}
+
+// serveMuxStream reads a stream's destination and connects it
+func serveMuxStream(st *muxStream, user string, cfg *Config, router *Router) {
+	defer st.Close()
+	st.SetReadDeadline(time.Now().Add(30 * time.Second))
+	var flags [2]byte
+	if _, err := io.ReadFull(st, flags[:]); err != nil {
+		return
+	}
+	dest, err := readAddr(st)
+	if err != nil {
+		return
+	}
+	st.SetReadDeadline(time.Time{})
+	reply := func(rep byte, reason error) error {
+		if rep == 0x00 {
+			_, err := st.Write([]byte{muxStatusOK})
+			return err
+		}
+		if reason == nil {
+			reason = fmt.Errorf("request failed with SOCKS5 reply %d", rep)
+		}
+		msg := reason.Error()
+		if len(msg) > reasonMaxLen {
+			msg = msg[:reasonMaxLen]
+		}
+		b := binary.AppendUvarint([]byte{muxStatusFail}, uint64(len(msg)))
+		_, err := st.Write(append(b, msg...))
+		return err
+	}
+	if binary.BigEndian.Uint16(flags[:])&muxFlagUDP != 0 {
+		reply(0x07, fmt.Errorf("UDP over mux is not supported"))
+		return
+	}
+	connectClient(st, user, dest, cfg, router, reply)
+}
+
+// muxSession runs smux (version 1) or yamux over one connection
+type muxSession struct {
+	conn  net.Conn
+	yamux bool
+
+	wmu sync.Mutex // Serializes frames
+
+	mu       sync.Mutex
+	cond     *sync.Cond // smux: signals buffered dropping
+	streams  map[uint32]*muxStream
+	nextID   uint32
+	buffered int             // smux: bytes received but not read yet
+	err      error           // Why the session ended, nil while it runs
+	accept   chan *muxStream // Streams opened by the peer; nil on the client
+	idle     *time.Timer     // Client: closes the session once it has no streams
+	done     chan struct{}   // Closed when the session ends
+}
+
+func newMuxSession(conn net.Conn, yamux, client bool) *muxSession {
+	s := &muxSession{conn: conn, yamux: yamux, streams: map[uint32]*muxStream{}, done: make(chan struct{})}
+	s.cond = sync.NewCond(&s.mu)
+	if client {
+		s.nextID = 1
+	} else {
+		s.nextID = 2
+		s.accept = make(chan *muxStream, 16)
+	}
+	go s.readLoop()
+	return s
+}
+
+// dead reports whether the session ended
+func (s *muxSession) dead() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// count returns the number of open streams
+func (s *muxSession) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// close ends the session and all its streams
+func (s *muxSession) close(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = map[uint32]*muxStream{}
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+	close(s.done)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.conn.Close()
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+// open starts a stream
+func (s *muxSession) open() (*muxStream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := s.newStream(id)
+	s.mu.Unlock()
+	var err error
+	if s.yamux {
+		err = s.writeFrame(yamuxWindowUpdate, yamuxSYN, id, 0, nil)
+	} else {
+		err = s.writeFrame(smuxSYN, 0, id, 0, nil)
+	}
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// newStream registers a stream; s.mu must be held
+func (s *muxSession) newStream(id uint32) *muxStream {
+	st := &muxStream{s: s, id: id, sendWindow: yamuxWindow, recvWindow: yamuxWindow}
+	st.cond = sync.NewCond(&st.mu)
+	s.streams[id] = st
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+	return st
+}
+
+// remove forgets a closed stream, scheduling the close of a client
+// session left without streams
+func (s *muxSession) remove(st *muxStream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams[st.id] != st {
+		return
+	}
+	delete(s.streams, st.id)
+	if len(s.streams) == 0 && s.accept == nil && s.err == nil {
+		if s.idle == nil {
+			s.idle = time.AfterFunc(muxIdleTimeout, func() {
+				if s.count() == 0 {
+					s.close(errMuxClosed)
+				}
+			})
+		} else {
+			s.idle.Reset(muxIdleTimeout)
+		}
+	}
+}
+
+// stream returns an open stream by ID
+func (s *muxSession) stream(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// consumed releases smux buffer space after a stream was read from
+func (s *muxSession) consumed(n int) {
+	s.mu.Lock()
+	s.buffered -= n
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Frame types: smux commands and yamux message types and flags
+const (
+	smuxSYN = 0
+	smuxFIN = 1
+	smuxPSH = 2
+	smuxNOP = 3
+
+	yamuxData         = 0
+	yamuxWindowUpdate = 1
+	yamuxPing         = 2
+	yamuxGoAway       = 3
+
+	yamuxSYN = 1
+	yamuxACK = 2
+	yamuxFIN = 4
+	yamuxRST = 8
+
+	yamuxProtocolError = 1 // Go away code
+)
+
+// writeFrame sends one frame. For yamux, value is the window delta or
+// ping payload of frames without data.
+func (s *muxSession) writeFrame(typ byte, flags uint16, id, value uint32, data []byte) error {
+	var hdr [12]byte
+	var h []byte
+	if s.yamux {
+		h = hdr[:12]
+		h[0], h[1] = 0, typ
+		binary.BigEndian.PutUint16(h[2:], flags)
+		binary.BigEndian.PutUint32(h[4:], id)
+		if data != nil {
+			value = uint32(len(data))
+		}
+		binary.BigEndian.PutUint32(h[8:], value)
+	} else {
+		h = hdr[:8]
+		h[0], h[1] = 1, typ
+		binary.LittleEndian.PutUint16(h[2:], uint16(len(data)))
+		binary.LittleEndian.PutUint32(h[4:], id)
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.dead() {
+		return errMuxClosed
+	}
+	bufs := net.Buffers{h, data}
+	if _, err := bufs.WriteTo(s.conn); err != nil {
+		go s.close(err)
+		return err
+	}
+	return nil
+}
+
+// readLoop dispatches the frames of the session until it fails
+func (s *muxSession) readLoop() {
+	r := bufio.NewReaderSize(s.conn, 16<<10)
+	var err error
+	for err == nil {
+		if s.yamux {
+			err = s.readYamux(r)
+		} else {
+			err = s.readSmux(r)
+		}
+	}
+	if err == io.EOF {
+		err = errMuxClosed
+	}
+	s.close(err)
+	if s.accept != nil {
+		close(s.accept)
+	}
+}
+
+// readSmux handles one smux frame
+func (s *muxSession) readSmux(r *bufio.Reader) error {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return err
+	}
+	if h[0] != 1 {
+		return fmt.Errorf("smux: unsupported version %d", h[0])
+	}
+	n := int(binary.LittleEndian.Uint16(h[2:]))
+	id := binary.LittleEndian.Uint32(h[4:])
+	switch h[1] {
+	case smuxSYN:
+		return s.accepted(id)
+	case smuxFIN:
+		if st := s.stream(id); st != nil {
+			st.fail(io.EOF)
+		}
+	case smuxPSH:
+		st := s.stream(id)
+		if st == nil {
+			_, err := r.Discard(n)
+			return err
+		}
+		// smux v1 has no per-stream window: the session stops reading
+		// until the frame fits, so streams never buffer more than
+		// muxMaxBuffer together
+		s.mu.Lock()
+		for s.buffered+n > muxMaxBuffer && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			s.mu.Unlock()
+			return s.err
+		}
+		s.buffered += n
+		s.mu.Unlock()
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		if kept, _ := st.push(data); !kept {
+			s.consumed(n)
+		}
+	case smuxNOP:
+	default:
+		return fmt.Errorf("smux: unknown command %d", h[1])
+	}
+	return nil
+}
+
+// readYamux handles one yamux frame
+func (s *muxSession) readYamux(r *bufio.Reader) error {
+	var h [12]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return err
+	}
+	if h[0] != 0 {
+		return fmt.Errorf("yamux: unsupported version %d", h[0])
+	}
+	flags := binary.BigEndian.Uint16(h[2:])
+	id := binary.BigEndian.Uint32(h[4:])
+	value := binary.BigEndian.Uint32(h[8:])
+	switch h[1] {
+	case yamuxPing:
+		if flags&yamuxSYN != 0 {
+			return s.writeFrame(yamuxPing, yamuxACK, 0, value, nil)
+		}
+		return nil
+	case yamuxGoAway:
+		return errMuxClosed
+	case yamuxData, yamuxWindowUpdate:
+	default:
+		return fmt.Errorf("yamux: unknown type %d", h[1])
+	}
+	if flags&yamuxSYN != 0 {
+		if err := s.accepted(id); err != nil {
+			return err
+		}
+	}
+	st := s.stream(id)
+	if h[1] == yamuxData {
+		if value > yamuxWindow {
+			return fmt.Errorf("yamux: frame exceeds the window")
+		}
+		data := make([]byte, value)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		if st != nil {
+			if _, err := st.push(data); err != nil {
+				s.writeFrame(yamuxGoAway, 0, 0, yamuxProtocolError, nil)
+				return err
+			}
+		}
+	} else if st != nil && value > 0 {
+		st.mu.Lock()
+		st.sendWindow += value
+		st.cond.Broadcast()
+		st.mu.Unlock()
+	}
+	if st != nil && flags&yamuxRST != 0 {
+		st.fail(fmt.Errorf("stream reset by peer"))
+	} else if st != nil && flags&yamuxFIN != 0 {
+		st.fail(io.EOF)
+	}
+	return nil
+}
+
+// accepted registers a stream opened by the peer
+func (s *muxSession) accepted(id uint32) error {
+	if s.accept == nil {
+		return fmt.Errorf("mux: server opened stream %d", id)
+	}
+	s.mu.Lock()
+	if s.streams[id] != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("mux: stream %d opened twice", id)
+	}
+	st := s.newStream(id)
+	s.mu.Unlock()
+	if s.yamux {
+		if err := s.writeFrame(yamuxWindowUpdate, yamuxACK, id, 0, nil); err != nil {
+			return err
+		}
+	}
+	s.accept <- st
+	return nil
+}
+
+// muxStream is one connection carried by a session
+type muxStream struct {
+	s  *muxSession
+	id uint32
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buf        []byte    // Received, not yet read
+	rerr       error     // Returned by Read once buf is drained: io.EOF after the peer's FIN
+	closed     bool      // Closed locally
+	sendWindow uint32    // yamux: bytes the peer accepts
+	recvWindow uint32    // yamux: bytes the peer may send before our next window update
+	unacked    uint32    // yamux: bytes read but not yet returned to the peer's window
+	deadline   time.Time // Read deadline
+	timer      *time.Timer
+}
+
+// push appends received data, reporting whether it was kept; yamux data
+// beyond the receive window fails with errMuxWindow
+func (st *muxStream) push(data []byte) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.s.yamux {
+		if uint32(len(data)) > st.recvWindow {
+			return false, errMuxWindow
+		}
+		st.recvWindow -= uint32(len(data))
+	}
+	if st.closed {
+		return false, nil
+	}
+	st.buf = append(st.buf, data...)
+	st.cond.Broadcast()
+	return true, nil
+}
+
+// fail ends the reads of the stream with err once buffered data is read
+func (st *muxStream) fail(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.rerr == nil {
+		st.rerr = err
+	}
+	st.cond.Broadcast()
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.buf) == 0 && st.rerr == nil && !st.closed {
+		if !st.deadline.IsZero() && !time.Now().Before(st.deadline) {
+			st.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		st.cond.Wait()
+	}
+	if len(st.buf) == 0 {
+		err := st.rerr
+		if st.closed {
+			err = net.ErrClosed
+		}
+		st.mu.Unlock()
+		return 0, err
+	}
+	n := copy(p, st.buf)
+	st.buf = st.buf[n:]
+	if len(st.buf) == 0 {
+		st.buf = nil
+	}
+	var update uint32
+	if st.s.yamux {
+		st.unacked += uint32(n)
+		if st.unacked >= yamuxWindow/2 && st.rerr == nil {
+			update, st.unacked = st.unacked, 0
+			st.recvWindow += update
+		}
+	}
+	st.mu.Unlock()
+	if update > 0 {
+		st.s.writeFrame(yamuxWindowUpdate, 0, st.id, update, nil)
+	} else if !st.s.yamux {
+		st.s.consumed(n)
+	}
+	return n, nil
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), muxFrameSize)
+		st.mu.Lock()
+		for st.s.yamux && st.sendWindow == 0 && !st.closed && !st.s.dead() {
+			st.cond.Wait()
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if st.s.yamux && st.sendWindow == 0 {
+			st.mu.Unlock()
+			return written, errMuxClosed
+		}
+		typ := byte(smuxPSH)
+		if st.s.yamux {
+			n = min(n, int(st.sendWindow))
+			st.sendWindow -= uint32(n)
+			typ = yamuxData
+		}
+		st.mu.Unlock()
+		if err := st.s.writeFrame(typ, 0, st.id, 0, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close sends FIN and drops data still buffered
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	dropped := len(st.buf)
+	st.buf = nil
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if !st.s.yamux && dropped > 0 {
+		st.s.consumed(dropped)
+	}
+	st.s.remove(st)
+	if st.s.yamux {
+		return st.s.writeFrame(yamuxWindowUpdate, yamuxFIN, st.id, 0, nil)
+	}
+	return st.s.writeFrame(smuxFIN, 0, st.id, 0, nil)
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.s.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.s.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	return st.SetReadDeadline(t)
+}
+
+// SetReadDeadline wakes a blocked Read at t
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.deadline = t
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+	if !t.IsZero() {
+		st.timer = time.AfterFunc(time.Until(t), func() {
+			st.mu.Lock()
+			st.cond.Broadcast()
+			st.mu.Unlock()
+		})
+	}
+	st.cond.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline is not supported: writes go straight to the shared
+// connection
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// muxPair runs a client and a server session of a protocol over loopback
+// TCP
+func muxPair(t *testing.T, yamux bool) (client, server *muxSession) {
+	t.Helper()
+	c, s := tcpPair(t)
+	client, server = newMuxSession(c, yamux, true), newMuxSession(s, yamux, false)
+	t.Cleanup(func() {
+		client.close(errMuxClosed)
+		server.close(errMuxClosed)
+	})
+	return client, server
+}
+
+// muxProtocols names the session protocols, for subtests
+var muxProtocols = []struct {
+	name  string
+	yamux bool
+}{{"smux", false}, {"yamux", true}}
+
+// acceptStream waits for the next stream opened by the peer
+func acceptStream(t *testing.T, s *muxSession) *muxStream {
+	t.Helper()
+	select {
+	case st, ok := <-s.accept:
+		if !ok {
+			t.Fatal("session ended before the stream was accepted")
+		}
+		return st
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not accepted")
+	}
+	return nil
+}
+
+// waitFor polls cond until it holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// TestMuxStream opens a stream, exchanges data both ways and closes it
+// from each side in turn
+func TestMuxStream(t *testing.T) {
+	for _, p := range muxProtocols {
+		t.Run(p.name, func(t *testing.T) {
+			client, server := muxPair(t, p.yamux)
+			cst, err := client.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cst.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			sst := acceptStream(t, server)
+			sst.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(sst, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("server read %q, %v", buf, err)
+			}
+			if _, err := sst.Write([]byte("world")); err != nil {
+				t.Fatal(err)
+			}
+			// FIN from the server: the client reads the data, then EOF
+			sst.Close()
+			cst.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if got, err := io.ReadAll(cst); err != nil || string(got) != "world" {
+				t.Fatalf("client read %q, %v", got, err)
+			}
+			cst.Close()
+			waitFor(t, "both streams removed", func() bool { return client.count() == 0 && server.count() == 0 })
+
+			// A second stream gets the next client ID
+			cst, err = client.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sst := acceptStream(t, server); sst.id != cst.id || cst.id != 3 {
+				t.Errorf("stream IDs %d and %d, want 3", cst.id, sst.id)
+			}
+		})
+	}
+}
+
+// TestMuxReset resets a yamux stream: the peer's reads fail
+func TestMuxReset(t *testing.T) {
+	client, server := muxPair(t, true)
+	cst, err := client.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sst := acceptStream(t, server)
+	if err := server.writeFrame(yamuxWindowUpdate, yamuxRST, sst.id, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	cst.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cst.Read(make([]byte, 1)); err == nil || !strings.Contains(err.Error(), "reset") {
+		t.Errorf("read after reset: %v", err)
+	}
+}
+
+// TestMuxWindow streams more than a yamux window: the writer stalls until
+// the reader reads, the receiver buffers at most a window and the data
+// arrives intact through the window updates
+func TestMuxWindow(t *testing.T) {
+	client, server := muxPair(t, true)
+	cst, err := client.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := testStream(4 * yamuxWindow)
+	werr := make(chan error, 1)
+	go func() {
+		_, err := cst.Write(stream)
+		werr <- err
+	}()
+	sst := acceptStream(t, server)
+	buffered := func() int {
+		sst.mu.Lock()
+		defer sst.mu.Unlock()
+		return len(sst.buf)
+	}
+	waitFor(t, "a full window", func() bool { return buffered() == yamuxWindow })
+	time.Sleep(50 * time.Millisecond)
+	if n := buffered(); n != yamuxWindow {
+		t.Fatalf("%d bytes buffered without reading, want the %d-byte window", n, yamuxWindow)
+	}
+	sst.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(stream))
+	if _, err := io.ReadFull(sst, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, stream) {
+		t.Error("received stream differs from the one sent")
+	}
+	if err := <-werr; err != nil {
+		t.Error(err)
+	}
+}
+
+// TestMuxPing pings a yamux session from a raw peer, which must get the
+// payload back in an ACK
+func TestMuxPing(t *testing.T) {
+	c, s := tcpPair(t)
+	defer c.Close()
+	server := newMuxSession(s, true, false)
+	defer server.close(errMuxClosed)
+	ping := []byte{0, yamuxPing, 0, yamuxSYN, 0, 0, 0, 0, 0, 0, 0x12, 0x34}
+	if _, err := c.Write(ping); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var ack [12]byte
+	if _, err := io.ReadFull(c, ack[:]); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, yamuxPing, 0, yamuxACK, 0, 0, 0, 0, 0, 0, 0x12, 0x34}; !bytes.Equal(ack[:], want) {
+		t.Errorf("got % x, want % x", ack, want)
+	}
+}
+
+// TestMuxSessionClose ends a session: the streams of both sides fail,
+// the server stops accepting and the client cannot open streams
+func TestMuxSessionClose(t *testing.T) {
+	for _, p := range muxProtocols {
+		t.Run(p.name, func(t *testing.T) {
+			client, server := muxPair(t, p.yamux)
+			cst, err := client.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sst := acceptStream(t, server)
+			client.close(errMuxClosed)
+			sst.SetReadDeadline(time.Now().Add(5 * time.Second))
+			// The server sees EOF or a reset, depending on unread bytes
+			if _, err := sst.Read(make([]byte, 1)); err == nil {
+				t.Error("server stream read succeeded")
+			}
+			if _, err := cst.Read(make([]byte, 1)); !errors.Is(err, errMuxClosed) {
+				t.Errorf("client stream read: %v, want %v", err, errMuxClosed)
+			}
+			if _, ok := <-server.accept; ok {
+				t.Error("server accepted a stream after the close")
+			}
+			if !client.dead() || !server.dead() {
+				t.Error("session still running")
+			}
+			if _, err := client.open(); err == nil {
+				t.Error("opened a stream on a closed session")
+			}
+		})
+	}
+}
+
+// TestMuxWindowOverrun sends a yamux stream more than its window, as a
+// peer ignoring window updates would: the server resets the session with
+// a protocol error instead of buffering
+func TestMuxWindowOverrun(t *testing.T) {
+	client, server := muxPair(t, true)
+	cst, err := client.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptStream(t, server)
+	// Frames straight to the connection, bypassing the send window
+	frame := make([]byte, yamuxWindow/4)
+	for range 5 {
+		if err := client.writeFrame(yamuxData, 0, cst.id, 0, frame); err != nil {
+			break
+		}
+	}
+	waitFor(t, "the server session to end", server.dead)
+	if !errors.Is(server.err, errMuxWindow) {
+		t.Errorf("server session ended with %v, want %v", server.err, errMuxWindow)
+	}
+	waitFor(t, "the client session to end", client.dead)
+}
+
+// TestMuxSmuxBuffer floods an unread smux stream: the session stops
+// reading once muxMaxBuffer is buffered, and resumes as the stream is read
+func TestMuxSmuxBuffer(t *testing.T) {
+	client, server := muxPair(t, false)
+	cst, err := client.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := testStream(3 * muxMaxBuffer)
+	go cst.Write(stream)
+	sst := acceptStream(t, server)
+	buffered := func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return server.buffered
+	}
+	waitFor(t, "the buffer to fill", func() bool { return buffered() > muxMaxBuffer-muxFrameSize })
+	time.Sleep(50 * time.Millisecond)
+	if n := buffered(); n > muxMaxBuffer {
+		t.Fatalf("%d bytes buffered, limit %d", n, muxMaxBuffer)
+	}
+	sst.mu.Lock()
+	n := len(sst.buf)
+	sst.mu.Unlock()
+	if n > muxMaxBuffer {
+		t.Fatalf("stream buffers %d bytes, limit %d", n, muxMaxBuffer)
+	}
+	sst.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(stream))
+	if _, err := io.ReadFull(sst, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, stream) {
+		t.Error("received stream differs from the one sent")
+	}
+}
+
+// TestMuxNegotiation runs a client stream through muxOutbound to a
+// serving inbound's session header parsing: the version and protocol
+// bytes come first, then the stream request
+func TestMuxNegotiation(t *testing.T) {
+	for _, p := range muxProtocols {
+		t.Run(p.name, func(t *testing.T) {
+			c, s := tcpPair(t)
+			defer s.Close()
+			next := &pipeOutbound{conn: c}
+			o, err := newMuxOutbound(next, MuxConfig{Protocol: p.name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dest := Addr{Atyp: 0x03, Addr: []byte("example.com"), Port: 443}
+			conn, err := o.Dial(newMetadata(nil, dest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if !isMuxDest(next.dest) {
+				t.Errorf("session dialed %s, want the mux destination", next.dest)
+			}
+			var hdr [2]byte
+			s.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(s, hdr[:]); err != nil {
+				t.Fatal(err)
+			}
+			if hdr != [2]byte{0, map[bool]byte{false: muxProtocolSmux, true: muxProtocolYamux}[p.yamux]} {
+				t.Fatalf("session header % x", hdr)
+			}
+			server := newMuxSession(s, p.yamux, false)
+			defer server.close(errMuxClosed)
+			sst := acceptStream(t, server)
+			sst.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var flags [2]byte
+			if _, err := io.ReadFull(sst, flags[:]); err != nil || binary.BigEndian.Uint16(flags[:]) != 0 {
+				t.Fatalf("stream flags % x, %v", flags, err)
+			}
+			if got, err := readAddr(sst); err != nil || got.String() != dest.String() {
+				t.Fatalf("stream request for %v, %v", got, err)
+			}
+			// A failure status carries the reason to the client
+			msg := "no route"
+			sst.Write(append(binary.AppendUvarint([]byte{muxStatusFail}, uint64(len(msg))), msg...))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Read(make([]byte, 1)); err == nil || !strings.Contains(err.Error(), msg) {
+				t.Errorf("client read: %v, want the server's reason", err)
+			}
+		})
+	}
+}
+
+// pipeOutbound hands out one prepared connection, recording the
+// destination it was dialed for
+type pipeOutbound struct {
+	conn net.Conn
+	dest Addr
+}
+
+func (o *pipeOutbound) Dial(m *Metadata) (net.Conn, error) {
+	o.dest = m.Dest
+	return o.conn, nil
+}
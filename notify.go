@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NotifyConfig posts webhook events when connections matching a rule open
+// and close, e.g. so home automation can react to a console going online
+type NotifyConfig struct {
+	URL      string            `json:"url"`      // Webhook receiving a JSON POST per event
+	Headers  map[string]string `json:"headers"`  // Extra request headers, e.g. an "Authorization" token
+	Debounce Duration          `json:"debounce"` // How long a client must stay without matching connections before "close", default 1m
+	Events   []string          `json:"events"`   // "open", "close" or both (default)
+}
+
+// NotifyEvent is the webhook payload
+type NotifyEvent struct {
+	Event    string    `json:"event"` // "open" or "close"
+	Rule     string    `json:"rule"`
+	Outbound string    `json:"outbound"`
+	Source   string    `json:"source"` // Client IP
+	Dest     string    `json:"dest"`   // Destination of the connection that caused the event
+	Time     time.Time `json:"time"`
+}
+
+// notifier tracks, per client IP, whether connections matching its rule are
+// active. A client goes "open" with its first connection and "close" once
+// it has had none for the debounce period, so short gaps between
+// connections do not produce events.
+type notifier struct {
+	cfg     *NotifyConfig
+	rule    string
+	open    bool // Send "open" events
+	close   bool // Send "close" events
+	client  *http.Client
+	mu      sync.Mutex
+	clients map[string]*notifyState
+}
+
+type notifyState struct {
+	active int
+	online bool
+	timer  *time.Timer // Pending "close", nil when none
+}
+
+// newNotifier validates a rule's notify settings
+func newNotifier(rule string, cfg *NotifyConfig) (*notifier, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("notify: url is required")
+	}
+	if cfg.Debounce == 0 {
+		cfg.Debounce = Duration(time.Minute)
+	}
+	n := &notifier{cfg: cfg, rule: rule, client: &http.Client{Timeout: 10 * time.Second}, clients: map[string]*notifyState{}}
+	if len(cfg.Events) == 0 {
+		n.open, n.close = true, true
+	}
+	for _, e := range cfg.Events {
+		switch e {
+		case "open":
+			n.open = true
+		case "close":
+			n.close = true
+		default:
+			return nil, fmt.Errorf("notify: unknown event %q", e)
+		}
+	}
+	return n, nil
+}
+
+// sourceIP returns the client IP a session is tracked by
+func sourceIP(src net.Addr) string {
+	if tcp, ok := src.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(src.String())
+	if err != nil {
+		return src.String()
+	}
+	return host
+}
+
+// opened records a new matching connection
+func (n *notifier) opened(src net.Addr, dest, tag string) {
+	ip := sourceIP(src)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	st := n.clients[ip]
+	if st == nil {
+		st = &notifyState{}
+		n.clients[ip] = st
+	}
+	st.active++
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+	if !st.online {
+		st.online = true
+		if n.open {
+			go n.send(NotifyEvent{Event: "open", Rule: n.rule, Outbound: tag, Source: ip, Dest: dest, Time: time.Now()})
+		}
+	}
+}
+
+// closed records the end of a matching connection, scheduling "close"
+// when it was the client's last one
+func (n *notifier) closed(src net.Addr, dest, tag string) {
+	ip := sourceIP(src)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	st := n.clients[ip]
+	if st == nil {
+		return
+	}
+	st.active--
+	if st.active > 0 {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(n.cfg.Debounce), func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if st.timer != timer || st.active > 0 {
+			return
+		}
+		delete(n.clients, ip)
+		if n.close {
+			go n.send(NotifyEvent{Event: "close", Rule: n.rule, Outbound: tag, Source: ip, Dest: dest, Time: time.Now()})
+		}
+	})
+	st.timer = timer
+}
+
+// send posts an event to the webhook
+func (n *notifier) send(e NotifyEvent) {
+	body, _ := json.Marshal(e)
+	req, err := http.NewRequest(http.MethodPost, n.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Notify %s: %v\n", n.rule, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		log.Printf("Notify %s: %v\n", n.rule, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Notify %s: %s\n", n.rule, resp.Status)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// familyAnswers answers family lookups with fixed slices, the IPv4 one
+// after a delay
+type familyAnswers struct {
+	ip4, ip6 []net.IP
+	delay4   time.Duration
+}
+
+func (r familyAnswers) LookupFamily(network, host string) ([]net.IP, error) {
+	if network == "ip4" {
+		time.Sleep(r.delay4)
+		return r.ip4, nil
+	}
+	return r.ip6, nil
+}
+
+// TestDialPipelinedAnswerCopy checks that pinning the answer of a
+// pipelined dial does not write into the slices the resolver returned,
+// which may be the shared DNS cache's own
+func TestDialPipelinedAnswerCopy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// The IPv4 answer has spare capacity holding another entry's address
+	sentinel := net.IPv4(192, 0, 2, 99)
+	shared := make([]net.IP, 2, 4)
+	shared[0], shared[1] = net.IPv4(127, 0, 0, 1), sentinel
+	r := familyAnswers{ip4: shared[:1], ip6: []net.IP{net.IPv6loopback}, delay4: 10 * time.Millisecond}
+
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	m := newMetadata(nil, Addr{Atyp: 0x03, Addr: []byte("svc.test"), Port: port})
+	conn, err := directOutbound{}.dialPipelined(m, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !shared[1].Equal(sentinel) {
+		t.Errorf("the resolver's slice was overwritten with %v", shared[1])
+	}
+	if len(m.answer) != 2 || !m.answer[0].Equal(shared[0]) || !m.answer[1].Equal(net.IPv6loopback) {
+		t.Errorf("pinned answer %v, want both families", m.answer)
+	}
+}
+
+// gatedAnswers answers IPv4 lookups at once and holds IPv6 ones until
+// release is closed, counting the lookups of each family
+type gatedAnswers struct {
+	ip4, ip6 []net.IP
+	release  chan struct{}
+	lookups  map[string]*atomic.Int64
+}
+
+func newGatedAnswers(ip4, ip6 []net.IP) *gatedAnswers {
+	return &gatedAnswers{ip4: ip4, ip6: ip6, release: make(chan struct{}),
+		lookups: map[string]*atomic.Int64{"ip4": {}, "ip6": {}}}
+}
+
+func (r *gatedAnswers) LookupFamily(network, host string) ([]net.IP, error) {
+	r.lookups[network].Add(1)
+	if network == "ip4" {
+		return r.ip4, nil
+	}
+	<-r.release
+	return r.ip6, nil
+}
+
+// listenLoopback accepts and closes connections on 127.0.0.1, counting
+// them; it returns the port
+func listenLoopback(t *testing.T, accepts *atomic.Int64) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepts.Add(1)
+			conn.Close()
+		}
+	}()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// dialWithin runs dial, failing the test if it does not return in time
+func dialWithin(t *testing.T, d time.Duration, dial func() (net.Conn, error)) net.Conn {
+	t.Helper()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.conn
+	case <-time.After(d):
+		t.Fatalf("dial still waiting after %v", d)
+	}
+	return nil
+}
+
+// TestDialPipelinedFirstAnswer checks that a pipelined dial connects to
+// the first answered family while the other lookup is still running:
+// at once for the preferred family, after the resolution delay for the
+// other
+func TestDialPipelinedFirstAnswer(t *testing.T) {
+	for _, family := range []ipFamily{preferIPv4, preferIPv6} {
+		r := newGatedAnswers([]net.IP{net.IPv4(127, 0, 0, 1)}, []net.IP{net.ParseIP("2001:db8::1")})
+		var accepts atomic.Int64
+		port := listenLoopback(t, &accepts)
+		m := newMetadata(nil, Addr{Atyp: 0x03, Addr: []byte("svc.test"), Port: port})
+		conn := dialWithin(t, time.Second, func() (net.Conn, error) {
+			return directOutbound{family: family}.dialPipelined(m, r)
+		})
+		conn.Close()
+		waitFor(t, "the connection", func() bool { return accepts.Load() == 1 })
+		if r.lookups["ip6"].Load() != 1 {
+			t.Errorf("family %d: IPv6 not looked up in parallel", family)
+		}
+		close(r.release)
+	}
+}
+
+// testUpstream is a proxy counting connections and requests; handle serves
+// the nth connection (from 1)
+type testUpstream struct {
+	ln       net.Listener
+	accepts  atomic.Int64
+	requests atomic.Int64
+}
+
+func startUpstream(t *testing.T, handle func(u *testUpstream, n int64, conn net.Conn)) *testUpstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	u := &testUpstream{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(u, u.accepts.Add(1), conn)
+			}()
+		}
+	}()
+	return u
+}
+
+func (u *testUpstream) addr() string {
+	return u.ln.Addr().String()
+}
+
+// spareWith returns a pool holding one prepared connection and never
+// opening more
+func spareWith(conn net.Conn) *sparePool {
+	p := &sparePool{ch: make(chan spareConn, 1)}
+	p.once.Do(func() {})
+	p.ch <- spareConn{conn: conn, made: time.Now()}
+	return p
+}
+
+// serveSocks answers the greeting, then, unless the connection is to go
+// stale, the CONNECT request with rep
+func serveSocks(u *testUpstream, conn net.Conn, stale bool, rep byte) {
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	conn.Write([]byte{0x05, 0x00})
+	if stale {
+		return
+	}
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return
+	}
+	if _, err := readAddr(conn); err != nil {
+		return
+	}
+	u.requests.Add(1)
+	conn.Write([]byte{0x05, rep, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	if rep == 0 {
+		io.Copy(conn, conn)
+	}
+}
+
+// serveHTTPConnect answers, unless the connection is to go stale, the
+// CONNECT request with status
+func serveHTTPConnect(u *testUpstream, conn net.Conn, stale bool, status int) {
+	if stale {
+		return
+	}
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	u.requests.Add(1)
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+	if status == http.StatusOK {
+		io.Copy(conn, conn)
+	}
+}
+
+// TestSpareRetry dials through a pooled connection: a connection that went
+// stale in the pool is replaced by a fresh one, while a refusal of the
+// proxy is returned without sending the request again
+func TestSpareRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		protocol     string
+		stale        bool // The pooled connection is closed by the proxy
+		refuse       bool // The proxy refuses every request
+		wantErr      bool
+		wantAccepts  int64
+		wantRequests int64
+	}{
+		{"socks5 refused", "socks5", false, true, true, 1, 1},
+		{"socks5 stale", "socks5", true, false, false, 2, 1},
+		{"socks5 stale, then refused", "socks5", true, true, true, 2, 1},
+		{"http refused", "http", false, true, true, 1, 1},
+		{"http stale", "http", true, false, false, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := startUpstream(t, func(u *testUpstream, n int64, conn net.Conn) {
+				stale := tt.stale && n == 1
+				switch {
+				case tt.protocol == "socks5" && tt.refuse:
+					serveSocks(u, conn, stale, 0x02)
+				case tt.protocol == "socks5":
+					serveSocks(u, conn, stale, 0x00)
+				case tt.refuse:
+					serveHTTPConnect(u, conn, stale, http.StatusForbidden)
+				default:
+					serveHTTPConnect(u, conn, stale, http.StatusOK)
+				}
+			})
+			pooled, err := net.Dial("tcp", u.addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var o Outbound
+			if tt.protocol == "socks5" {
+				if err := greetSocks(pooled, "", ""); err != nil {
+					t.Fatal(err)
+				}
+				o = socksOutbound{addr: u.addr(), spare: spareWith(pooled), pooled: true}
+			} else {
+				o = httpOutbound{addr: u.addr(), spare: spareWith(pooled)}
+			}
+			if tt.stale {
+				// Let the proxy close the pooled connection
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			m := newMetadata(nil, Addr{Atyp: 0x03, Addr: []byte("example.com"), Port: 443})
+			conn, err := o.Dial(m)
+			if conn != nil {
+				conn.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("dial error %v, want error %v", err, tt.wantErr)
+			}
+			time.Sleep(50 * time.Millisecond) // Let a repeated request arrive
+			if n := u.accepts.Load(); n != tt.wantAccepts {
+				t.Errorf("proxy accepted %d connections, want %d", n, tt.wantAccepts)
+			}
+			if n := u.requests.Load(); n != tt.wantRequests {
+				t.Errorf("proxy received %d requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+// gatedResolver is a gatedAnswers usable as the global resolver, counting
+// full lookups
+type gatedResolver struct {
+	*gatedAnswers
+	full atomic.Int64
+}
+
+func (r *gatedResolver) LookupIP(host string) ([]net.IP, error) {
+	r.full.Add(1)
+	return append(r.ip4, r.ip6...), nil
+}
+
+// TestDialPipelinedCached checks that with the shared DNS cache a direct
+// dial still starts on the first family answered, and that the families
+// end up cached as the full answer later dials and the DNS server use
+func TestDialPipelinedCached(t *testing.T) {
+	r := &gatedResolver{gatedAnswers: newGatedAnswers([]net.IP{net.IPv4(127, 0, 0, 1)}, []net.IP{net.ParseIP("2001:db8::1")})}
+	oldResolver := resolver
+	resolver = r
+	if err := setDNSCache(&DNSCacheConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		resolver = oldResolver
+		setDNSCache(nil)
+	})
+	var accepts atomic.Int64
+	port := listenLoopback(t, &accepts)
+	dest := Addr{Atyp: 0x03, Addr: []byte("svc.test"), Port: port}
+
+	conn := dialWithin(t, time.Second, func() (net.Conn, error) {
+		return directOutbound{}.Dial(newMetadata(nil, dest))
+	})
+	conn.Close()
+	if r.lookups["ip6"].Load() != 1 || r.full.Load() != 0 {
+		t.Fatalf("%d IPv6 and %d full lookups, want a pipelined dial", r.lookups["ip6"].Load(), r.full.Load())
+	}
+	close(r.release)
+	waitFor(t, "the full answer to be cached", func() bool {
+		e, ok := dnsCache.get(defaultDNS.dialCacheKey(), "svc.test")
+		return ok && len(e.ips) == 2
+	})
+
+	// Later dials and the DNS server's lookups are answered from the cache
+	conn = dialWithin(t, time.Second, func() (net.Conn, error) {
+		return directOutbound{}.Dial(newMetadata(nil, dest))
+	})
+	conn.Close()
+	if ips, err := defaultDNS.dialLookup("svc.test"); err != nil || len(ips) != 2 {
+		t.Errorf("DNS server lookup: %v, %v", ips, err)
+	}
+	if n4, n6, full := r.lookups["ip4"].Load(), r.lookups["ip6"].Load(), r.full.Load(); n4 != 1 || n6 != 1 || full != 0 {
+		t.Errorf("%d IPv4, %d IPv6 and %d full lookups, want one per family", n4, n6, full)
+	}
+}
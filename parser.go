@@ -3,100 +3,153 @@ package main
 import (
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"os"
-	"time"
+	"strings"
+	"sync"
 
 	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
 	"google.golang.org/protobuf/proto"
 )
 
-func parseGeoSite() {
-	f, err := os.Open("geosite.dat")
+func init() {
+	registerGeoSourceFormat("dat", newDatSource)
+}
+
+// datSource is a v2ray geosite.dat or geoip.dat file
+type datSource struct {
+	kind string // "geosite" or "geoip"
+	path string
+
+	mu    sync.Mutex
+	sites *routercommon.GeoSiteList
+	ips   *routercommon.GeoIPList
+}
+
+func newDatSource(cfg GeoSourceConfig) (GeoSource, error) {
+	if cfg.Kind != "geosite" && cfg.Kind != "geoip" {
+		return nil, fmt.Errorf("dat: kind must be \"geosite\" or \"geoip\"")
+	}
+	return &datSource{kind: cfg.Kind, path: cfg.Path}, nil
+}
+
+func (s *datSource) Site(code string) (Matcher, error) {
+	if s.kind != "geosite" {
+		return nil, errNoCategory
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sites == nil {
+		list, err := loadGeoSite(s.path)
+		if err != nil {
+			return nil, &unavailableError{fmt.Errorf("load geosite: %v", err)}
+		}
+		s.sites = list
+	}
+	group := findGeoSite(s.sites, code)
+	if group == nil {
+		return nil, errNoCategory
+	}
+	d := newDomainMatcher()
+	for _, domain := range group.GetDomain() {
+		if err := d.add(domain.GetType(), domain.GetValue()); err != nil {
+			return nil, fmt.Errorf("geosite:%s: %v", code, err)
+		}
+	}
+	return d, nil
+}
+
+func (s *datSource) IP(code string) (Matcher, error) {
+	if s.kind != "geoip" {
+		return nil, errNoCategory
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ips == nil {
+		list, err := loadGeoIP(s.path)
+		if err != nil {
+			return nil, &unavailableError{fmt.Errorf("load geoip: %v", err)}
+		}
+		s.ips = list
+	}
+	entry := findGeoIP(s.ips, code)
+	if entry == nil {
+		return nil, errNoCategory
+	}
+	i := &ipMatcher{inverse: entry.InverseMatch}
+	for _, cidr := range entry.GetCidr() {
+		ip := net.IP(cidr.GetIp())
+		i.nets = append(i.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(int(cidr.GetPrefix()), len(ip)*8)})
+	}
+	return i, nil
+}
+
+func (s *datSource) Loaded() (DataFileSummary, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return DataFileSummary{Kind: s.kind, Path: s.path}, s.sites != nil || s.ips != nil
+}
+
+// loadGeoSite reads a v2ray geosite.dat file
+func loadGeoSite(path string) (*routercommon.GeoSiteList, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatal("failed to open file:", err)
+		return nil, err
 	}
 	defer f.Close()
 
 	// Read the file directly without gzip decompression
 	geositeBytes, err := io.ReadAll(f)
 	if err != nil {
-		log.Fatal("failed to read data:", err)
+		return nil, err
 	}
 
 	// Unmarshal the protobuf data.
 	var geositeList routercommon.GeoSiteList
 	if err := proto.Unmarshal(geositeBytes, &geositeList); err != nil {
-		log.Fatal("failed to unmarshal data:", err)
-	}
-
-	i := 0
-	// Iterate over the SiteGroup field in the GeoSiteList.
-	for _, group := range geositeList.Entry {
-		i++
-		log.Printf("%d, Group: %s", i, group.CountryCode)
-		for _, domain := range group.GetDomain() {
-			log.Printf("  Domain: type=%v, value=%s", domain.GetType(), domain.GetValue())
-			// Optionally, iterate over domain attributes if available.
-			for _, attr := range domain.GetAttribute() {
-				log.Printf("    Attribute: key=%s", attr.GetKey())
-			}
-		}
+		return nil, err
 	}
+	return &geositeList, nil
 }
 
-func parseGeoIP() {
-	// Open the geoip.dat file
-	f, err := os.Open("geoip.dat")
+// loadGeoIP reads a v2ray geoip.dat file
+func loadGeoIP(path string) (*routercommon.GeoIPList, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatal("failed to open file:", err)
+		return nil, err
 	}
 	defer f.Close()
 
 	// Read the file directly
 	geoipBytes, err := io.ReadAll(f)
 	if err != nil {
-		log.Fatal("failed to read data:", err)
+		return nil, err
 	}
 
 	// Unmarshal the protobuf data
 	var geoipList routercommon.GeoIPList
 	if err := proto.Unmarshal(geoipBytes, &geoipList); err != nil {
-		log.Fatal("failed to unmarshal data:", err)
-	}
-
-	i := 0
-	// Iterate over the entries in the GeoIPList
-	for _, entry := range geoipList.Entry {
-		i++
-		log.Printf("%d, Country: %s", i, entry.CountryCode)
-		time.Sleep(1 * time.Second)
-
-		// Iterate over CIDR entries
-		for _, cidr := range entry.GetCidr() {
-			// Extract IP and prefix from CIDR
-			ip := cidr.GetIp()
-			prefix := cidr.GetPrefix()
-
-			// Convert IP bytes to string representation
-			ipStr := ""
-			if len(ip) == 4 {
-				// IPv4
-				ipStr = fmt.Sprintf("%d.%d.%d.%d", ip[0], ip[1], ip[2], ip[3])
-			} else if len(ip) == 16 {
-				// IPv6 - simplified display
-				ipStr = fmt.Sprintf("%x:%x:%x:%x:...", ip[0], ip[1], ip[2], ip[3])
-			}
-
-			log.Printf("  CIDR: %s/%d", ipStr, prefix)
-		}
+		return nil, err
 	}
+	return &geoipList, nil
 }
 
-func main() {
-	parseGeoSite()
-	parseGeoIP()
-
-	time.Sleep(5 * time.Second)
+// findGeoSite returns the geosite group with the given code (case-insensitive)
+func findGeoSite(list *routercommon.GeoSiteList, code string) *routercommon.GeoSite {
+	for _, group := range list.GetEntry() {
+		if strings.EqualFold(group.GetCountryCode(), code) {
+			return group
+		}
+	}
+	return nil
+}
 
+// findGeoIP returns the geoip entry with the given code (case-insensitive)
+func findGeoIP(list *routercommon.GeoIPList, code string) *routercommon.GeoIP {
+	for _, entry := range list.GetEntry() {
+		if strings.EqualFold(entry.GetCountryCode(), code) {
+			return entry
+		}
+	}
+	return nil
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+)
+
+// peekConn is a connection whose incoming bytes can be looked at before
+// they are consumed. Bytes read ahead by peek, or read after mark and
+// given back by rewind, are returned by Read before anything new, so what
+// sniffing and protocol detection read always reaches the destination.
+type peekConn struct {
+	net.Conn
+	buf    []byte // Bytes read from the connection; buf[off:] are unread
+	off    int
+	marked bool // Read keeps what it returns, for rewind
+}
+
+// newPeekConn wraps a connection, or returns it when it already is one
+func newPeekConn(conn net.Conn) *peekConn {
+	if pc, ok := conn.(*peekConn); ok {
+		return pc
+	}
+	return &peekConn{Conn: conn}
+}
+
+// errPeekFull means the buffer already holds the most peek may read ahead
+var errPeekFull = errors.New("peek buffer full")
+
+// Read returns the unread buffered bytes first, then reads from the
+// connection
+func (c *peekConn) Read(p []byte) (int, error) {
+	if c.off < len(c.buf) {
+		n := copy(p, c.buf[c.off:])
+		c.off += n
+		c.release()
+		return n, nil
+	}
+	n, err := c.Conn.Read(p)
+	if c.marked && n > 0 {
+		c.buf = append(c.buf, p[:n]...)
+		c.off = len(c.buf)
+	}
+	return n, err
+}
+
+// peek reads once from the connection into the buffer, holding at most
+// limit unread bytes, and returns all unread bytes without consuming
+// them. The bytes are valid until the next call.
+func (c *peekConn) peek(limit int) ([]byte, error) {
+	unread := len(c.buf) - c.off
+	if unread >= limit {
+		return c.buf[c.off:], errPeekFull
+	}
+	if len(c.buf) == cap(c.buf) {
+		c.buf = slices.Grow(c.buf, min(limit-unread, max(2048, unread)))
+	}
+	end := min(cap(c.buf), len(c.buf)+limit-unread)
+	n, err := c.Conn.Read(c.buf[len(c.buf):end])
+	c.buf = c.buf[:len(c.buf)+n]
+	return c.buf[c.off:], err
+}
+
+// mark starts keeping the bytes Read returns, so rewind can return them
+// again
+func (c *peekConn) mark() {
+	c.buf = c.buf[c.off:]
+	c.off = 0
+	c.marked = true
+}
+
+// rewind makes the bytes read since mark unread again and stops keeping
+// them
+func (c *peekConn) rewind() {
+	c.off = 0
+	c.marked = false
+}
+
+// unmark drops the bytes read since mark and stops keeping them
+func (c *peekConn) unmark() {
+	c.marked = false
+	c.release()
+}
+
+// release frees the buffer once everything in it was read and nothing is
+// kept for rewind
+func (c *peekConn) release() {
+	if !c.marked && c.off == len(c.buf) {
+		c.buf, c.off = nil, 0
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// chunkConn delivers a stream in fixed pieces, one per Read, then io.EOF,
+// like a client whose bytes arrive in several segments
+type chunkConn struct {
+	net.Conn
+	data  []byte
+	chunk int
+}
+
+func (c *chunkConn) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.data[:min(c.chunk, len(c.data))])
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *chunkConn) SetReadDeadline(time.Time) error { return nil }
+
+// testStream returns n reproducible pseudo-random bytes
+func testStream(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// readAllBy reads until EOF with reads of at most size bytes
+func readAllBy(t *testing.T, r io.Reader, size int) []byte {
+	t.Helper()
+	var out []byte
+	buf := make([]byte, size)
+	for {
+		n, err := r.Read(buf)
+		out = append(out, buf[:n]...)
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readN reads exactly n bytes with reads of at most size bytes
+func readN(t *testing.T, r io.Reader, n, size int) []byte {
+	t.Helper()
+	out := make([]byte, 0, n)
+	buf := make([]byte, size)
+	for len(out) < n {
+		m, err := r.Read(buf[:min(size, n-len(out))])
+		out = append(out, buf[:m]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out
+}
+
+// TestPeekConnPartialReads peeks in several steps as the bytes arrive in
+// pieces, then reads the whole stream in reads that straddle the end of
+// the peeked bytes: nothing may be lost or repeated
+func TestPeekConnPartialReads(t *testing.T) {
+	stream := testStream(5000)
+	tests := []struct {
+		name               string
+		chunk, limit, read int
+	}{
+		{"byte chunks, short reads", 1, 10, 3},
+		{"byte chunks, long reads", 1, 10, 4096},
+		{"odd chunks across the limit", 7, 100, 13},
+		{"chunks larger than the limit", 300, 100, 64},
+		{"limit beyond a growth step", 1500, 4000, 1000},
+		{"whole stream peeked", 1000, 8000, 512},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := newPeekConn(&chunkConn{data: stream, chunk: tt.chunk})
+			var peeked []byte
+			for {
+				buf, err := pc.peek(tt.limit)
+				if !bytes.Equal(buf, stream[:len(buf)]) {
+					t.Fatalf("peeked %d bytes that are not the start of the stream", len(buf))
+				}
+				if len(buf) < len(peeked) {
+					t.Fatalf("peeked %d bytes after %d", len(buf), len(peeked))
+				}
+				peeked = buf
+				if err == errPeekFull || err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if want := min(tt.limit, len(stream)); len(peeked) < want {
+				t.Fatalf("peeked %d bytes, want %d", len(peeked), want)
+			}
+			if got := readAllBy(t, pc, tt.read); !bytes.Equal(got, stream) {
+				t.Errorf("read %d bytes differing from the %d-byte stream", len(got), len(stream))
+			}
+		})
+	}
+}
+
+// TestPeekConnMarkRewind reads after mark, rewinds and reads again, with
+// and without bytes peeked before the mark
+func TestPeekConnMarkRewind(t *testing.T) {
+	stream := testStream(3000)
+	tests := []struct {
+		name    string
+		chunk   int
+		peek    int // Bytes peeked before mark, 0 for none
+		consume int // Bytes read before mark
+		marked  int // Bytes read between mark and rewind
+		read    int
+	}{
+		{"fresh connection", 100, 0, 0, 250, 64},
+		{"after a peek", 100, 200, 0, 250, 64},
+		{"within the peeked bytes", 100, 500, 0, 120, 7},
+		{"after consuming peeked bytes", 100, 500, 300, 400, 33},
+		{"single bytes", 1, 0, 0, 40, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := newPeekConn(&chunkConn{data: stream, chunk: tt.chunk})
+			for tt.peek > 0 {
+				if buf, err := pc.peek(tt.peek); len(buf) >= tt.peek || err != nil {
+					break
+				}
+			}
+			if got := readN(t, pc, tt.consume, 16); !bytes.Equal(got, stream[:tt.consume]) {
+				t.Fatal("bytes before the mark differ")
+			}
+			pc.mark()
+			first := readN(t, pc, tt.marked, tt.read)
+			pc.rewind()
+			again := readN(t, pc, tt.marked, tt.read)
+			if !bytes.Equal(first, again) || !bytes.Equal(first, stream[tt.consume:tt.consume+tt.marked]) {
+				t.Fatal("bytes read after rewind differ from those read after mark")
+			}
+			if got := readAllBy(t, pc, tt.read); !bytes.Equal(got, stream[tt.consume+tt.marked:]) {
+				t.Error("bytes after the rewound ones differ from the stream")
+			}
+		})
+	}
+}
+
+// TestPeekConnUnmark drops or keeps the bytes read since mark
+func TestPeekConnUnmark(t *testing.T) {
+	stream := testStream(2000)
+	t.Run("without rewind", func(t *testing.T) {
+		pc := newPeekConn(&chunkConn{data: stream, chunk: 100})
+		pc.mark()
+		readN(t, pc, 150, 64)
+		pc.unmark()
+		if pc.buf != nil {
+			t.Errorf("%d bytes still buffered after unmark", len(pc.buf))
+		}
+		if got := readAllBy(t, pc, 64); !bytes.Equal(got, stream[150:]) {
+			t.Error("bytes after unmark differ from the stream")
+		}
+	})
+	t.Run("after rewind", func(t *testing.T) {
+		pc := newPeekConn(&chunkConn{data: stream, chunk: 100})
+		pc.mark()
+		readN(t, pc, 150, 64)
+		pc.rewind()
+		readN(t, pc, 40, 64)
+		// The rewound bytes not yet read again must survive unmark
+		pc.unmark()
+		if got := readAllBy(t, pc, 64); !bytes.Equal(got, stream[40:]) {
+			t.Error("bytes after unmark differ from the stream")
+		}
+	})
+	t.Run("new mark after rewind", func(t *testing.T) {
+		pc := newPeekConn(&chunkConn{data: stream, chunk: 100})
+		pc.mark()
+		readN(t, pc, 150, 64)
+		pc.rewind()
+		readN(t, pc, 40, 64)
+		pc.mark()
+		first := readN(t, pc, 200, 64)
+		pc.rewind()
+		if got := readN(t, pc, 200, 64); !bytes.Equal(got, first) || !bytes.Equal(got, stream[40:240]) {
+			t.Error("second rewind returned other bytes")
+		}
+		pc.unmark()
+		if got := readAllBy(t, pc, 64); !bytes.Equal(got, stream[240:]) {
+			t.Error("bytes after the second mark differ from the stream")
+		}
+	})
+}
+
+// TestPeekConnEOF ends the stream while peeking: the peeked bytes are
+// still read before io.EOF
+func TestPeekConnEOF(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		chunk  int
+	}{
+		{"empty", nil, 1},
+		{"shorter than the limit", []byte("GET / HT"), 3},
+		{"in one piece", []byte("\x16\x03\x01"), 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := newPeekConn(&chunkConn{data: tt.stream, chunk: tt.chunk})
+			var buf []byte
+			var err error
+			for err == nil {
+				buf, err = pc.peek(64)
+			}
+			if err != io.EOF {
+				t.Fatalf("peek ended with %v, want io.EOF", err)
+			}
+			if !bytes.Equal(buf, tt.stream) {
+				t.Fatalf("peeked %q, want %q", buf, tt.stream)
+			}
+			if got := readAllBy(t, pc, 2); !bytes.Equal(got, tt.stream) {
+				t.Errorf("read %q, want %q", got, tt.stream)
+			}
+		})
+	}
+}
+
+func TestPeekConnFull(t *testing.T) {
+	pc := newPeekConn(&chunkConn{data: testStream(100), chunk: 100})
+	if buf, err := pc.peek(50); len(buf) != 50 || err != nil {
+		t.Fatalf("peeked %d bytes, %v, want 50", len(buf), err)
+	}
+	if buf, err := pc.peek(50); len(buf) != 50 || err != errPeekFull {
+		t.Errorf("peeked %d bytes, %v, want 50 and %v", len(buf), err, errPeekFull)
+	}
+}
+
+// clientHello returns the first flight of a crypto/tls client for a
+// server name
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+		client.Close()
+	}()
+	var head [5]byte
+	if _, err := io.ReadFull(server, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(head[3])<<8|int(head[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(head[:], body...)
+}
+
+// TestSniffReplay sniffs the host of a client's first bytes, arriving in
+// pieces, then relays the connection to a destination, which must receive
+// the stream unchanged
+func TestSniffReplay(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	request := []byte("GET /index.html HTTP/1.1\r\nHost: Media.Example.NET:8080\r\nUser-Agent: test\r\n\r\n")
+	body := testStream(40000)
+	tests := []struct {
+		name   string
+		stream []byte
+		chunk  int
+		want   string
+	}{
+		{"TLS in one piece", append(hello, body...), 1 << 16, "www.example.com"},
+		{"TLS in small pieces", append(hello, body...), 7, "www.example.com"},
+		{"TLS byte by byte", hello, 1, "www.example.com"},
+		{"HTTP in one piece", append(request, body...), 1 << 16, "media.example.net"},
+		{"HTTP in small pieces", append(request, body...), 5, "media.example.net"},
+		{"neither", body, 1000, ""},
+		{"truncated ClientHello", hello[:len(hello)/2], 10, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := newPeekConn(&chunkConn{data: tt.stream, chunk: tt.chunk})
+			if host := sniffHost(pc, time.Second); host != tt.want {
+				t.Errorf("sniffed %q, want %q", host, tt.want)
+			}
+			dest, peer := net.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				_, err := io.Copy(dest, pc)
+				dest.Close()
+				done <- err
+			}()
+			got, err := io.ReadAll(peer)
+			if err != nil && !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.stream) {
+				t.Errorf("destination received %d bytes differing from the %d sent", len(got), len(tt.stream))
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"net"
+	"path/filepath"
+)
+
+// ProcessInfo identifies the local process that opened a connection
+type ProcessInfo struct {
+	PID  int
+	Name string // Command name, e.g. "firefox"
+	Path string // Executable path, e.g. "/usr/lib/firefox/firefox"
+}
+
+// Process returns the local process that owns the client side of the
+// connection, or nil for remote clients and unsupported platforms. The
+// lookup happens once per connection and only when a rule asks for it.
+func (m *Metadata) Process() *ProcessInfo {
+	if m.processLooked {
+		return m.process
+	}
+	m.processLooked = true
+	src, ok := m.Source.(*net.TCPAddr)
+	if !ok || !isLocalIP(src.IP) {
+		return nil
+	}
+	p, err := findProcess(src)
+	if err != nil {
+		log.Printf("Process lookup for %s: %v\n", src, err)
+		return nil
+	}
+	m.process = p
+	return p
+}
+
+// isLocalIP reports whether ip belongs to this host
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// processMatcher matches the name or, when it contains a slash, the
+// executable path of the local process that opened the connection
+type processMatcher string
+
+func (p processMatcher) Match(m *Metadata) bool {
+	proc := m.Process()
+	if proc == nil {
+		return false
+	}
+	if filepath.IsAbs(string(p)) {
+		return proc.Path == string(p)
+	}
+	return proc.Name == string(p) || filepath.Base(proc.Path) == string(p)
+}
+
+// perClient marks the decision as depending on the client, not just the
+// destination
+func (processMatcher) perClient() {}
@@ -0,0 +1,102 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// findProcess looks the client socket up in /proc/net/tcp{,6} and then
+// searches /proc/*/fd for the process holding its inode
+func findProcess(addr *net.TCPAddr) (*ProcessInfo, error) {
+	inode, err := socketInode(addr)
+	if err != nil {
+		return nil, err
+	}
+	pid, err := pidOfInode(inode)
+	if err != nil {
+		return nil, err
+	}
+	p := &ProcessInfo{PID: pid}
+	if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+		p.Name = strings.TrimSpace(string(comm))
+	}
+	p.Path, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	return p, nil
+}
+
+// socketInode finds the inode of the TCP socket bound to addr
+func socketInode(addr *net.TCPAddr) (string, error) {
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // Header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			ip, port, err := parseProcAddr(fields[1])
+			if err != nil {
+				continue
+			}
+			if port == addr.Port && ip.Equal(addr.IP) {
+				f.Close()
+				return fields[9], nil
+			}
+		}
+		f.Close()
+	}
+	return "", fmt.Errorf("no socket for %s", addr)
+}
+
+// parseProcAddr decodes "0100007F:1F90"; the address is stored as 32-bit
+// words in host (little-endian) byte order, the port in big-endian
+func parseProcAddr(s string) (net.IP, int, error) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	b, err := hex.DecodeString(ipHex)
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	return net.IP(b), int(port), nil
+}
+
+// pidOfInode scans the open file descriptors of all processes for the socket
+func pidOfInode(inode string) (int, error) {
+	target := "socket:[" + inode + "]"
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/[0-9]*")
+	if err != nil {
+		return 0, err
+	}
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || link != target {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.Split(fd, "/")[2])
+		if err == nil {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("no process owns socket inode %s", inode)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// findProcess is only implemented on Linux
+func findProcess(addr *net.TCPAddr) (*ProcessInfo, error) {
+	return nil, errors.New("process lookup is only supported on Linux")
+}
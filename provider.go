@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ProviderConfig describes a Clash-style rule provider: a rule list fetched
+// from a URL, cached on disk and refreshed periodically
+type ProviderConfig struct {
+	URL      string   `json:"url"`      // Where to fetch the list, empty for a local file
+	Path     string   `json:"path"`     // Cache file (or the local list when URL is empty)
+	Format   string   `json:"format"`   // "domain", "ipcidr", "classical", "hosts", "adblock" or "threat"
+	Interval Duration `json:"interval"` // Refresh period, default 24h
+	Category string   `json:"category"` // Threat category for feed lines without one
+}
+
+// providers holds the rule providers by name, referenced as "provider:<name>"
+var providers = map[string]*RuleProvider{}
+
+// RuleProvider is a loaded rule provider
+type RuleProvider struct {
+	Name    string
+	cfg     ProviderConfig
+	matcher atomic.Pointer[anyMatcher]
+	pending atomic.Bool // Not loaded yet, retried every softFailRetry
+}
+
+// anyMatcher matches when any of its matchers does
+type anyMatcher []Matcher
+
+func (a anyMatcher) Match(m *Metadata) bool {
+	for _, matcher := range a {
+		if matcher.Match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RuleProvider) Match(m *Metadata) bool {
+	return p.matcher.Load().Match(m)
+}
+
+// newRuleProvider loads a provider from its cache file, fetching it first
+// when the cache is missing or older than the refresh interval. With
+// softFail a provider that cannot be loaded starts empty and is retried.
+func newRuleProvider(name string, cfg ProviderConfig, softFail bool) (*RuleProvider, error) {
+	if cfg.Path == "" {
+		cfg.Path = filepath.Join("providers", name+".txt")
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = Duration(24 * time.Hour)
+	}
+	switch cfg.Format {
+	case "domain", "ipcidr", "classical", "hosts", "adblock", "threat":
+	default:
+		return nil, fmt.Errorf("provider %s: unknown format %q", name, cfg.Format)
+	}
+	p := &RuleProvider{Name: name, cfg: cfg}
+
+	info, err := os.Stat(cfg.Path)
+	if cfg.URL != "" && (err != nil || time.Since(info.ModTime()) > time.Duration(cfg.Interval)) {
+		if err := p.fetch(); err != nil {
+			log.Printf("Provider %s: fetch failed, using cache: %v\n", name, err)
+		}
+	}
+	if err := p.load(); err != nil {
+		if !softFail {
+			return nil, fmt.Errorf("provider %s: %v", name, err)
+		}
+		log.Printf("Provider %s: unavailable, starting without it: %v\n", name, err)
+		p.matcher.Store(&anyMatcher{})
+		p.pending.Store(true)
+	}
+	return p, nil
+}
+
+// fetch downloads the list and atomically replaces the cache file
+func (p *RuleProvider) fetch() error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(p.cfg.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", p.cfg.URL, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// Make sure the new list parses before replacing the old one
+	if _, err := parseProviderList(p.cfg, data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.cfg.Path), 0755); err != nil {
+		return err
+	}
+	tmp := p.cfg.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.cfg.Path)
+}
+
+// load compiles the cache file into the active matcher
+func (p *RuleProvider) load() error {
+	data, err := os.ReadFile(p.cfg.Path)
+	if err != nil {
+		return err
+	}
+	matcher, err := parseProviderList(p.cfg, data)
+	if err != nil {
+		return err
+	}
+	p.matcher.Store(&matcher)
+	return nil
+}
+
+// refreshLoop refetches (or rereads) the list every interval, calling
+// onReload after each successful reload
+func (p *RuleProvider) refreshLoop(onReload func()) {
+	for {
+		wait := time.Duration(p.cfg.Interval)
+		if p.pending.Load() {
+			wait = softFailRetry
+		}
+		time.Sleep(wait)
+
+		if p.cfg.URL != "" {
+			if err := p.fetch(); err != nil {
+				log.Printf("Provider %s: refresh failed: %v\n", p.Name, err)
+				continue
+			}
+		}
+		if err := p.load(); err != nil {
+			log.Printf("Provider %s: reload failed: %v\n", p.Name, err)
+			continue
+		}
+		p.pending.Store(false)
+		onReload()
+		log.Printf("Provider %s: refreshed\n", p.Name)
+	}
+}
+
+// loadProviders creates all configured providers
+func loadProviders(cfgs map[string]ProviderConfig, softFail bool) error {
+	for name, pc := range cfgs {
+		p, err := newRuleProvider(name, pc, softFail)
+		if err != nil {
+			return err
+		}
+		providers[name] = p
+	}
+	return nil
+}
+
+// startRefresh starts refreshing every provider, and retrying data that
+// was unavailable at startup, in the background
+func startRefresh(onReload func()) {
+	for _, p := range providers {
+		go p.refreshLoop(onReload)
+	}
+	for _, p := range pendingMatchers {
+		go p.retryLoop(onReload)
+	}
+}
+
+// parseProviderList compiles a rule list. Plain text lists have one entry
+// per line; Clash YAML payloads ("payload:" followed by "- entry") work too.
+func parseProviderList(cfg ProviderConfig, data []byte) (anyMatcher, error) {
+	format := cfg.Format
+	domains := newDomainMatcher()
+	allowed := newDomainMatcher()
+	ips := &ipMatcher{}
+	threats := threatList{}
+	var other anyMatcher
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line == "payload:" {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "- "))
+		line = strings.Trim(line, `'"`)
+
+		switch format {
+		case "domain":
+			addProviderDomain(domains, line)
+		case "ipcidr":
+			n, err := parseCIDR(line)
+			if err != nil {
+				return nil, err
+			}
+			ips.nets = append(ips.nets, n)
+		case "hosts":
+			addHostsEntry(domains, line)
+		case "threat":
+			if err := addThreatEntry(threats, line, cfg.Category); err != nil {
+				return nil, err
+			}
+		case "adblock":
+			addAdblockRule(domains, allowed, line)
+		case "classical":
+			fields := strings.Split(line, ",")
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("invalid rule %q", line)
+			}
+			value := strings.TrimSpace(fields[1])
+			switch strings.ToUpper(strings.TrimSpace(fields[0])) {
+			case "DOMAIN":
+				domains.full[strings.ToLower(value)] = true
+			case "DOMAIN-SUFFIX":
+				domains.suffix[strings.ToLower(value)] = true
+			case "DOMAIN-KEYWORD":
+				domains.keywords = append(domains.keywords, strings.ToLower(value))
+			case "IP-CIDR", "IP-CIDR6":
+				n, err := parseCIDR(value)
+				if err != nil {
+					return nil, err
+				}
+				ips.nets = append(ips.nets, n)
+			case "DST-PORT":
+				m, err := parseMatcher("port:"+value, nil)
+				if err != nil {
+					return nil, err
+				}
+				other = append(other, m)
+			default:
+				// Unsupported rule types are skipped so lists written for
+				// Clash still load
+				continue
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	switch format {
+	case "threat":
+		return anyMatcher{threats}, nil
+	case "adblock":
+		return anyMatcher{exceptMatcher{match: domains, except: allowed}}, nil
+	}
+	return append(anyMatcher{domains, ips}, other...), nil
+}
+
+// exceptMatcher matches what match does unless except also matches
+type exceptMatcher struct {
+	match, except Matcher
+}
+
+func (e exceptMatcher) Match(m *Metadata) bool {
+	return e.match.Match(m) && !e.except.Match(m)
+}
+
+// hostsLocalNames are hosts file entries that are not blocklist entries
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+// addHostsEntry adds the names of a hosts file line ("0.0.0.0 ads.example.com")
+// as exact matches; lines with just a domain are accepted too
+func addHostsEntry(d *domainMatcher, line string) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 1 {
+		fields = fields[1:]
+	}
+	for _, name := range fields {
+		name = strings.ToLower(name)
+		if !hostsLocalNames[name] {
+			d.full[name] = true
+		}
+	}
+}
+
+// addAdblockRule adds an AdGuard/Adblock Plus network rule. Only the
+// domain-level forms make sense for a proxy: "||example.com^" blocks the
+// domain and its subdomains, "@@||example.com^" allows them again and a
+// bare "example.com" blocks the exact name. Cosmetic rules, URL patterns
+// and rules with modifiers other than $important are skipped.
+func addAdblockRule(blocked, allowed *domainMatcher, line string) {
+	if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#$#") {
+		return
+	}
+	d := blocked
+	if strings.HasPrefix(line, "@@") {
+		d = allowed
+		line = line[2:]
+	}
+	if rule, mods, ok := strings.Cut(line, "$"); ok {
+		if mods != "important" {
+			return
+		}
+		line = rule
+	}
+	line = strings.ToLower(line)
+	if strings.HasPrefix(line, "||") {
+		name := strings.TrimSuffix(line[2:], "^")
+		if name != "" && !strings.ContainsAny(name, "/*^|") {
+			d.suffix[name] = true
+		}
+		return
+	}
+	if line != "" && !strings.ContainsAny(line, "/*^|") {
+		d.full[line] = true
+	}
+}
+
+// addProviderDomain adds a Clash domain list entry: "+.example.com" and
+// ".example.com" match the domain and its subdomains, "*.example.com" only
+// the subdomains, anything else the exact name
+func addProviderDomain(d *domainMatcher, entry string) {
+	entry = strings.ToLower(entry)
+	switch {
+	case strings.HasPrefix(entry, "+."):
+		d.suffix[entry[2:]] = true
+	case strings.HasPrefix(entry, "."):
+		d.suffix[entry[1:]] = true
+	case strings.HasPrefix(entry, "*."):
+		d.regexps = append(d.regexps, regexp.MustCompile(`^[^.]+`+regexp.QuoteMeta(entry[1:])+`$`))
+	default:
+		d.full[entry] = true
+	}
+}
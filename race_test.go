@@ -0,0 +1,6 @@
+//go:build race
+
+package main
+
+// raceEnabled skips allocation guards, which the race detector inflates
+const raceEnabled = true
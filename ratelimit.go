@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnRateConfig limits how fast new connections to any single destination
+// host are opened, so a client retrying in a tight loop cannot flood it
+type ConnRateConfig struct {
+	Rate  float64 `json:"rate"`  // Sustained new connections per second per host
+	Burst int     `json:"burst"` // Connections allowed at once before the rate applies, default 2*rate
+}
+
+// connBucketMax is the number of hosts tracked before idle buckets are
+// pruned
+const connBucketMax = 10000
+
+// connLimiter keeps a token bucket per destination host
+type connLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*connBucket
+}
+
+type connBucket struct {
+	tokens float64
+	last   time.Time
+	warned time.Time // Last time a refusal was logged
+}
+
+// limiter is nil when connection rates are not limited
+var limiter *connLimiter
+
+func newConnLimiter(cfg *ConnRateConfig) *connLimiter {
+	burst := float64(cfg.Burst)
+	if burst <= 0 {
+		burst = 2 * cfg.Rate
+	}
+	return &connLimiter{rate: cfg.Rate, burst: max(burst, 1), buckets: map[string]*connBucket{}}
+}
+
+// allow takes a token for a new connection to host, reporting false when
+// its bucket is empty
+func (l *connLimiter) allow(host string) bool {
+	host = strings.ToLower(host)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[host]
+	if b == nil {
+		if len(l.buckets) >= connBucketMax {
+			l.prune(now)
+		}
+		b = &connBucket{tokens: l.burst, last: now}
+		l.buckets[host] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+	if now.Sub(b.warned) >= time.Minute {
+		b.warned = now
+		log.Printf("Connection rate to %s exceeded (%.4g/s, burst %.0f), refusing\n", host, l.rate, l.burst)
+	}
+	return false
+}
+
+// prune drops the buckets that have refilled, which behave like new ones
+func (l *connLimiter) prune(now time.Time) {
+	for host, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, host)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// With "reply_reason" on, a failure reply to a SOCKS5 request is followed by
+// one line explaining it, "reason: <text>\n". Standard clients stop reading
+// after the reply and never see it; routing-socks reads it from upstreams
+// and includes it in its own errors.
+const reasonPrefix = "reason: "
+
+// reasonMaxLen bounds the reason text
+const reasonMaxLen = 200
+
+// writeReason sends the reason line after a failure reply
+func writeReason(conn net.Conn, reason error) error {
+	text := strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' {
+			return ' '
+		}
+		return r
+	}, reason.Error())
+	if len(text) > reasonMaxLen {
+		text = text[:reasonMaxLen]
+	}
+	_, err := io.WriteString(conn, reasonPrefix+text+"\n")
+	return err
+}
+
+// readReason reads the reason line an upstream may send after a failure
+// reply, returning "" when there is none. Upstreams without the extension
+// close the connection or send nothing, so the wait is short.
+func readReason(conn net.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	line, err := bufio.NewReaderSize(io.LimitReader(conn, int64(len(reasonPrefix)+reasonMaxLen+1)), 256).ReadString('\n')
+	if err != nil {
+		return ""
+	}
+	text, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), reasonPrefix)
+	if !ok {
+		return ""
+	}
+	return text
+}
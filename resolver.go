@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Resolver looks up the addresses of a host name
+type Resolver interface {
+	LookupIP(host string) ([]net.IP, error)
+}
+
+// systemResolver uses the operating system's resolver
+type systemResolver struct{}
+
+func (systemResolver) LookupIP(host string) ([]net.IP, error) {
+	return net.LookupIP(host)
+}
+
+func (systemResolver) LookupFamily(network, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(context.Background(), network, host)
+}
+
+// familyResolver is implemented by resolvers that can look up one address
+// family at a time, so direct dials can start on the first answer
+type familyResolver interface {
+	LookupFamily(network, host string) ([]net.IP, error) // network is "ip4" or "ip6"
+}
+
+// resolver is used for all destination lookups; simulation mode replaces it
+var resolver Resolver = systemResolver{}
+
+// serverResolver queries a specific DNS server over UDP, or over TCP
+// through an outbound
+type serverResolver struct {
+	r *net.Resolver
+}
+
+func newServerResolver(server string) Resolver {
+	server, via := splitDNSVia(server)
+	if isDoHURL(server) {
+		return newDoHResolver(server, via)
+	}
+	d := net.Dialer{Timeout: 5 * time.Second}
+	return serverResolver{&net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			if via != "" {
+				// A stream connection makes the resolver use DNS over TCP
+				return dialVia(ctx, via, server)
+			}
+			return d.DialContext(ctx, network, server)
+		},
+	}}
+}
+
+// splitDNSVia splits a "server@outbound" setting into the DNS server and
+// the outbound its queries go through, empty when they are sent from here
+func splitDNSVia(s string) (server, via string) {
+	i := strings.LastIndex(s, "@")
+	if i <= 0 || strings.Contains(s[i:], "/") {
+		// An @ before the path of a DoH URL is its user info
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+// dialVia connects to a DNS server through an outbound, so the query
+// leaves from the outbound's exit rather than the local network
+func dialVia(ctx context.Context, via, addr string) (net.Conn, error) {
+	o, ok := outbounds[via]
+	if !ok {
+		return nil, fmt.Errorf("unknown outbound %q", via)
+	}
+	dest, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := o.Dial(newMetadata(nil, dest))
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (s serverResolver) LookupIP(host string) ([]net.IP, error) {
+	return s.r.LookupIP(context.Background(), "ip", host)
+}
+
+func (s serverResolver) LookupFamily(network, host string) ([]net.IP, error) {
+	return s.r.LookupIP(context.Background(), network, host)
+}
+
+// dnsServerResolver builds the resolver for a "dns" server address or DoH
+// URL;
+// simulation mode replaces it so every lookup stays in the scenario
+var dnsServerResolver = newServerResolver
+
+// DNSStrategy says how a destination domain is resolved
+type DNSStrategy struct {
+	Name     string   // "local", "remote", "none" or a DNS server address
+	resolver Resolver // nil for "local", which uses the global resolver
+}
+
+// defaultDNS applies when a rule sets no "dns" of its own, and to lookups
+// made while the rules are being evaluated
+var defaultDNS = &DNSStrategy{Name: "local"}
+
+// parseDNSStrategy parses a "dns" setting: "local" (the system resolver),
+// "remote" (leave the name to the upstream), "none" (never resolve), a
+// DNS server such as "1.1.1.1" or "[2606:4700::1111]:53" or a DoH URL such
+// as "https://1.1.1.1/dns-query". A server followed by "@outbound", e.g.
+// "8.8.8.8@upstream", is queried through that outbound.
+func parseDNSStrategy(s string) (*DNSStrategy, error) {
+	switch s {
+	case "", "local":
+		return &DNSStrategy{Name: "local"}, nil
+	case "remote", "none":
+		return &DNSStrategy{Name: s}, nil
+	}
+	server, ok := dnsServerAddr(s)
+	if !ok {
+		return nil, fmt.Errorf("dns: %q is not local, remote, none, a server address or a DoH URL (optionally @outbound)", s)
+	}
+	return &DNSStrategy{Name: s, resolver: dnsServerResolver(server)}, nil
+}
+
+// dnsServerAddr returns the host:port of a DNS server given as an address,
+// with or without a port; DoH URLs are returned as they are. An "@outbound"
+// suffix is kept, and must name a known outbound other than reject.
+func dnsServerAddr(s string) (string, bool) {
+	s, via := splitDNSVia(s)
+	if via != "" {
+		if _, ok := outbounds[via]; !ok || via == "reject" {
+			return "", false
+		}
+		addr, ok := dnsServerAddr(s)
+		return addr + "@" + via, ok
+	}
+	if isDoHURL(s) {
+		return s, true
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return net.JoinHostPort(s, "53"), true
+	}
+	_, _, err := net.SplitHostPort(s)
+	return s, err == nil
+}
+
+// stubZone sends lookups of a domain and its subdomains to its own DNS
+// server, e.g. internal domains to the DNS server behind a VPN
+type stubZone struct {
+	domain   string // Lower case, without trailing dot
+	resolver Resolver
+}
+
+// stubZones are consulted, most specific first, before any lookup the DNS
+// strategy makes; "none" still resolves nothing and "remote" leaves names
+// to the upstream
+var stubZones []stubZone
+
+// setStubZones compiles the "dns_zones" config
+func setStubZones(zones map[string]string) error {
+	stubZones = nil
+	for domain, server := range zones {
+		addr, ok := dnsServerAddr(server)
+		if !ok {
+			return fmt.Errorf("dns_zones: %q is not a server address or DoH URL (optionally @outbound)", server)
+		}
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if domain == "" {
+			return fmt.Errorf("dns_zones: empty domain")
+		}
+		stubZones = append(stubZones, stubZone{domain: domain, resolver: dnsServerResolver(addr)})
+	}
+	sort.Slice(stubZones, func(i, j int) bool { return len(stubZones[i].domain) > len(stubZones[j].domain) })
+	return nil
+}
+
+// DNSRuleConfig sends the lookups of the domains matching a condition to
+// their own resolver, e.g. geosite:cn to a domestic one
+type DNSRuleConfig struct {
+	Match string `json:"match"` // Domain condition: geosite:, domain:, full:, keyword: or regexp:
+	DNS   string `json:"dns"`   // "local", a DNS server address or a DoH URL
+}
+
+// dnsRule is a compiled DNSRuleConfig
+type dnsRule struct {
+	matcher  Matcher
+	resolver Resolver // nil for "local", which uses the global resolver
+}
+
+// dnsRules are consulted in order after the stub zones
+var dnsRules []dnsRule
+
+// setDNSRules compiles the "dns_rules" config; only domain conditions are
+// allowed, since matching must not itself need a lookup
+func setDNSRules(rules []DNSRuleConfig, geo *GeoData) error {
+	dnsRules = nil
+	for i, rc := range rules {
+		m, err := parseDomainCondition(rc.Match, geo)
+		if err != nil {
+			return fmt.Errorf("dns_rules %d: %v", i+1, err)
+		}
+		rule := dnsRule{matcher: m}
+		if rc.DNS != "local" {
+			addr, ok := dnsServerAddr(rc.DNS)
+			if !ok {
+				return fmt.Errorf("dns_rules %d: %q is not local, a server address or a DoH URL (optionally @outbound)", i+1, rc.DNS)
+			}
+			rule.resolver = dnsServerResolver(addr)
+		}
+		dnsRules = append(dnsRules, rule)
+	}
+	return nil
+}
+
+// parseDomainCondition parses a condition on the domain alone, which can
+// be checked without a lookup
+func parseDomainCondition(s string, geo *GeoData) (Matcher, error) {
+	kind, _, _ := strings.Cut(s, ":")
+	switch kind {
+	case "geosite", "domain", "full", "keyword", "regexp":
+		return parseMatcher(s, geo)
+	}
+	return nil, fmt.Errorf("%q is not a domain condition", s)
+}
+
+// stubResolver returns the addresses of host from "hosts" or the hosts
+// files, else the resolver of the stub zone host is in, else of the first
+// DNS rule it matches, nil when there is none
+func stubResolver(host string) Resolver {
+	if ips, ok := hostsLookup(host); ok {
+		return staticResolver(ips)
+	}
+	if len(stubZones) == 0 && len(dnsRules) == 0 {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, z := range stubZones {
+		if host == z.domain || strings.HasSuffix(host, "."+z.domain) {
+			return z.resolver
+		}
+	}
+	m := &Metadata{Host: host}
+	for _, rule := range dnsRules {
+		if rule.matcher.Match(m) {
+			if rule.resolver == nil {
+				return resolver
+			}
+			return rule.resolver
+		}
+	}
+	return nil
+}
+
+// lookup resolves a host name through the shared cache; "remote" and
+// "none" do not resolve at all
+func (d *DNSStrategy) lookup(host string) ([]net.IP, error) {
+	return cachedLookup(d.Name, host, d.resolve)
+}
+
+// cachedLookup returns the cached answer, or failure, of a strategy for a
+// name, else looks it up with fn, in place of its "hosts" alias if it has
+// one, and caches the result
+func cachedLookup(strategy, host string, fn func(string) ([]net.IP, time.Duration, error)) ([]net.IP, error) {
+	if e, ok := dnsCache.get(strategy, host); ok {
+		return e.ips, e.err
+	}
+	ips, ttl, err := fn(hostsAlias(host))
+	if err != nil {
+		dnsCache.putError(strategy, host, err)
+	} else {
+		dnsCache.put(strategy, host, ips, ttl)
+	}
+	return ips, err
+}
+
+// ttlResolver is implemented by resolvers that know how long their answers
+// may be kept
+type ttlResolver interface {
+	LookupIPTTL(host string) ([]net.IP, time.Duration, error)
+}
+
+// lookupTTL looks a name up with r; the TTL is 0 when r does not report
+// one
+func lookupTTL(r Resolver, host string) ([]net.IP, time.Duration, error) {
+	if tr, ok := r.(ttlResolver); ok {
+		return tr.LookupIPTTL(host)
+	}
+	ips, err := r.LookupIP(host)
+	return ips, 0, err
+}
+
+func (d *DNSStrategy) resolve(host string) ([]net.IP, time.Duration, error) {
+	if r := stubResolver(host); r != nil && d.Name != "remote" && d.Name != "none" {
+		return lookupTTL(r, host)
+	}
+	switch {
+	case d.resolver != nil:
+		return lookupTTL(d.resolver, host)
+	case d.Name == "local":
+		if ips, ok := warm.get(host); ok {
+			return ips, 0, nil
+		}
+		return lookupTTL(resolver, host)
+	}
+	return nil, 0, nil
+}
+
+// familyLookup returns the resolver for a direct dial of host if it can
+// answer per address family, nil when the answer must be awaited in full.
+// With the shared cache, the families are looked up through it; aliased
+// names always take the full answer.
+func (d *DNSStrategy) familyLookup(host string) familyResolver {
+	if hostsAlias(host) != host {
+		return nil
+	}
+	r := d.resolver
+	switch {
+	case d.Name != "none" && stubResolver(host) != nil:
+		r = stubResolver(host)
+	case r != nil:
+	case d.Name == "local":
+		if _, ok := warm.get(host); ok {
+			return nil
+		}
+		r = resolver
+	case d.Name == "remote":
+		r = resolver
+	}
+	fr, _ := r.(familyResolver)
+	if fr != nil && dnsCache != nil {
+		return cachedFamilyResolver{d.dialCacheKey(), fr}
+	}
+	return fr
+}
+
+// cachedFamilyResolver looks up one address family at a time through the
+// shared cache. A full answer cached for the strategy is split by family;
+// otherwise each family is cached on its own, and once both are, their
+// union is stored as the full answer, so routing and the DNS server see
+// the addresses the dial used.
+type cachedFamilyResolver struct {
+	strategy string
+	r        familyResolver
+}
+
+func (c cachedFamilyResolver) LookupFamily(network, host string) ([]net.IP, error) {
+	if e, ok := dnsCache.get(c.strategy, host); ok {
+		if e.err != nil {
+			return nil, e.err
+		}
+		return staticResolver(e.ips).LookupFamily(network, host)
+	}
+	ips, err := cachedLookup(c.strategy+" "+network, host, func(host string) ([]net.IP, time.Duration, error) {
+		ips, err := c.r.LookupFamily(network, host)
+		return ips, 0, err
+	})
+	other := "ip6"
+	if network == "ip6" {
+		other = "ip4"
+	}
+	if e, ok := dnsCache.get(c.strategy+" "+other, host); ok {
+		dnsCache.put(c.strategy, host, slices.Concat(ips, e.ips), 0)
+	}
+	return ips, err
+}
+
+// dialLookup resolves a host name for a direct dial; "remote" has no upstream
+// to defer to there, so it falls back to the system resolver
+func (d *DNSStrategy) dialLookup(host string) ([]net.IP, error) {
+	if d.Name == "remote" {
+		return cachedLookup(d.dialCacheKey(), host, func(host string) ([]net.IP, time.Duration, error) {
+			if r := stubResolver(host); r != nil {
+				return lookupTTL(r, host)
+			}
+			return lookupTTL(resolver, host)
+		})
+	}
+	return d.lookup(host)
+}
+
+// dialCacheKey is the strategy dialLookup caches its answers under
+func (d *DNSStrategy) dialCacheKey() string {
+	if d.Name == "remote" {
+		return "remote dial"
+	}
+	return d.Name
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// RetryConfig retries dials that fail transiently before the client gets
+// an error
+type RetryConfig struct {
+	Attempts   int      `json:"attempts"`    // Retries after the first dial, default 2
+	Backoff    Duration `json:"backoff"`     // Wait before the first retry, doubling for each further one, default 200ms
+	MaxBackoff Duration `json:"max_backoff"` // Longest wait between retries, default 2s
+	NextMember bool     `json:"next_member"` // For groups: retry on the next available member instead of the one that failed
+}
+
+// retry is the retry policy from the config, nil to dial once
+var retry *RetryConfig
+
+// retryStats counts dial retries for the admin API
+var retryStats struct {
+	Retries   atomic.Uint64 // Retry dials made
+	Succeeded atomic.Uint64 // Connections that succeeded on a retry
+	Failed    atomic.Uint64 // Connections whose retries all failed
+}
+
+// setRetry applies the defaults of a retry policy and enables it
+func setRetry(cfg *RetryConfig) {
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = 2
+	}
+	if cfg.Backoff == 0 {
+		cfg.Backoff = Duration(200 * time.Millisecond)
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = Duration(2 * time.Second)
+	}
+	retry = cfg
+}
+
+// dialRetry dials through an outbound, retrying transient failures with
+// exponential backoff. With next_member, a failed group dial is retried on
+// the group's next available member right away, after any failure but a
+// rejection.
+func dialRetry(tag string, m *Metadata) (net.Conn, error) {
+	conn, err := dialOutbound(tag, m)
+	if retry == nil || err == nil || errors.Is(err, errRejected) {
+		return conn, err
+	}
+	backoff := time.Duration(retry.Backoff)
+	tried := []string{m.member}
+	for i := 1; i <= retry.Attempts; i++ {
+		target := tag
+		if next := nextMember(tag, tried); next != "" {
+			target = next
+			tried = append(tried, next)
+			m.logf(logNormal, "Dial %s via %s failed (%v), retrying on %s (%d/%d)\n", m.Dest, m.member, err, next, i, retry.Attempts)
+		} else if isTransient(err) {
+			m.logf(logNormal, "Dial %s via %s failed (%v), retrying in %v (%d/%d)\n", m.Dest, tag, err, backoff, i, retry.Attempts)
+			time.Sleep(backoff)
+			backoff = min(2*backoff, time.Duration(retry.MaxBackoff))
+			// Direct dials skip addresses that failed; the retry gives
+			// them another chance
+			m.failed = nil
+		} else {
+			break
+		}
+		retryStats.Retries.Add(1)
+		conn, err = dialOutbound(target, m)
+		if err == nil {
+			retryStats.Succeeded.Add(1)
+			return conn, nil
+		}
+		if errors.Is(err, errRejected) {
+			return nil, err
+		}
+	}
+	retryStats.Failed.Add(1)
+	return nil, err
+}
+
+// nextMember returns the member of a group to retry on: the first
+// available one after the last tried, or "" when the outbound is not a
+// group, next_member is off or all were tried
+func nextMember(tag string, tried []string) string {
+	g, ok := outbounds[tag].(interface{ info() GroupInfo })
+	if !retry.NextMember || !ok {
+		return ""
+	}
+	members := g.info().Members
+	start := slices.Index(members, tried[len(tried)-1]) + 1
+	for i := range members {
+		member := members[(start+i)%len(members)]
+		if !slices.Contains(tried, member) && memberAvailable(member) {
+			return member
+		}
+	}
+	return ""
+}
+
+// isTransient reports whether a dial error may go away on its own:
+// timeouts, refused or reset connections and unreachable networks
+func isTransient(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// rewrite replaces the host and/or port of a destination, e.g. to move
+// clients of a retired API to its new address
+type rewrite struct {
+	host string // Empty to keep the requested host
+	port uint16 // 0 to keep the requested port
+}
+
+// parseRewrite parses a rule's "rewrite": "host:port", "host" or ":port"
+func parseRewrite(s string) (*rewrite, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		// No port: "host", "::1" or "[::1]"
+		host, portStr = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), ""
+	}
+	r := &rewrite{host: host}
+	if portStr != "" {
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("rewrite: invalid port in %q", s)
+		}
+		r.port = uint16(port)
+	}
+	if r.host == "" && r.port == 0 {
+		return nil, fmt.Errorf("rewrite: %q sets neither host nor port", s)
+	}
+	if len(r.host) > 255 {
+		return nil, fmt.Errorf("rewrite: host name too long in %q", s)
+	}
+	return r, nil
+}
+
+// apply returns the rewritten destination
+func (r *rewrite) apply(dest Addr) Addr {
+	port := dest.Port
+	if r.port != 0 {
+		port = r.port
+	}
+	if r.host == "" {
+		return Addr{Atyp: dest.Atyp, Addr: dest.Addr, Port: port}
+	}
+	if ip := net.ParseIP(r.host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return Addr{Atyp: 0x01, Addr: ip4, Port: port}
+		}
+		return Addr{Atyp: 0x04, Addr: ip, Port: port}
+	}
+	return Addr{Atyp: 0x03, Addr: []byte(r.host), Port: port}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// routeCacheSize bounds the number of cached decisions; a shard is cleared
+// when it fills up
+const routeCacheSize = 10000
+
+// routeCacheShards splits the cache so lookups of different domains do not
+// contend on one lock
+const routeCacheShards = 16
+
+// routeCache remembers routing decisions per domain and port so repeat
+// connections to hot domains skip the matcher walk
+type routeCache struct {
+	ttl    time.Duration
+	shards [routeCacheShards]routeCacheShard
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type routeCacheShard struct {
+	mu sync.RWMutex
+	m  map[routeKey]routeCacheEntry
+}
+
+// routeKey is a destination domain, lowercased, and port
+type routeKey struct {
+	host string
+	port uint16
+}
+
+type routeCacheEntry struct {
+	tag     string
+	rule    *Rule
+	expires time.Time
+}
+
+func newRouteCache(ttl time.Duration) *routeCache {
+	c := &routeCache{ttl: ttl}
+	for i := range c.shards {
+		c.shards[i].m = map[routeKey]routeCacheEntry{}
+	}
+	return c
+}
+
+// shard picks the shard of a key by the FNV-1a hash of its domain
+func (c *routeCache) shard(key routeKey) *routeCacheShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key.host); i++ {
+		h = (h ^ uint32(key.host[i])) * 16777619
+	}
+	return &c.shards[h%routeCacheShards]
+}
+
+// get returns a cached decision that has not expired
+func (c *routeCache) get(key routeKey, now time.Time) (string, *Rule, bool) {
+	sh := c.shard(key)
+	sh.mu.RLock()
+	e, ok := sh.m[key]
+	sh.mu.RUnlock()
+	if !ok || now.After(e.expires) {
+		c.misses.Add(1)
+		return "", nil, false
+	}
+	c.hits.Add(1)
+	return e.tag, e.rule, true
+}
+
+// put stores a decision
+func (c *routeCache) put(key routeKey, tag string, rule *Rule, now time.Time) {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if len(sh.m) >= routeCacheSize/routeCacheShards {
+		sh.m = map[routeKey]routeCacheEntry{}
+	}
+	sh.m[key] = routeCacheEntry{tag: tag, rule: rule, expires: now.Add(c.ttl)}
+}
+
+// flush drops all decisions, used when rules change
+func (c *routeCache) flush() {
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		sh.m = map[routeKey]routeCacheEntry{}
+		sh.mu.Unlock()
+	}
+}
+
+// stats reports the cache counters for the admin API
+func (c *routeCache) stats() map[string]any {
+	entries := 0
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.RLock()
+		entries += len(sh.m)
+		sh.mu.RUnlock()
+	}
+	return map[string]any{
+		"ttl":     c.ttl.String(),
+		"entries": entries,
+		"hits":    c.hits.Load(),
+		"misses":  c.misses.Load(),
+	}
+}
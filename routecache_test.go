@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRouteCache(t *testing.T) {
+	c := newRouteCache(time.Minute)
+	now := time.Now()
+	rule := &Rule{Match: "domain:example.com"}
+	c.put(routeKey{"example.com", 443}, "direct", rule, now)
+	if tag, r, ok := c.get(routeKey{"example.com", 443}, now.Add(30*time.Second)); !ok || tag != "direct" || r != rule {
+		t.Errorf("got %q, %v, %v, want the cached decision", tag, r, ok)
+	}
+	if _, _, ok := c.get(routeKey{"example.com", 443}, now.Add(2*time.Minute)); ok {
+		t.Error("expired decision returned")
+	}
+	if _, _, ok := c.get(routeKey{"example.com", 80}, now); ok {
+		t.Error("decision of another port returned")
+	}
+	c.flush()
+	if _, _, ok := c.get(routeKey{"example.com", 443}, now); ok {
+		t.Error("decision returned after flush")
+	}
+}
+
+// routeCacheKeys are the hot domains of the cache benchmarks, as many as
+// the cache holds
+var routeCacheKeys = func() []routeKey {
+	keys := make([]routeKey, routeCacheSize*9/10)
+	for i := range keys {
+		keys[i] = routeKey{fmt.Sprintf("host%d.example.com", i), 443}
+	}
+	return keys
+}()
+
+// BenchmarkRouteCache looks up decisions from all CPUs, with one put per
+// miss or every hundredth lookup in the mixed case
+func BenchmarkRouteCache(b *testing.B) {
+	for _, putEvery := range []uint64{0, 100} {
+		name := "get"
+		if putEvery > 0 {
+			name = fmt.Sprintf("get-put-1-in-%d", putEvery)
+		}
+		b.Run(name, func(b *testing.B) {
+			c := newRouteCache(time.Hour)
+			now := time.Now()
+			rule := &Rule{}
+			for _, k := range routeCacheKeys {
+				c.put(k, "direct", rule, now)
+			}
+			var next atomic.Uint64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine walks the keys from its own offset
+				i := next.Add(7919)
+				for pb.Next() {
+					i++
+					k := routeCacheKeys[i%uint64(len(routeCacheKeys))]
+					if _, _, ok := c.get(k, now); !ok || putEvery > 0 && i%putEvery == 0 {
+						c.put(k, "direct", rule, now)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metadata carries what the router knows about a connection
+type Metadata struct {
+	Source net.Addr // Client address
+	Dest   Addr     // Destination as requested by the client
+	Host   string   // Destination domain, empty for IP requests
+	Zone   string   // IPv6 zone of a literal "fe80::1%eth0" destination
+
+	ips       []net.IP        // Resolved (or literal) destination addresses
+	literal   bool            // ips came from the request, not a lookup
+	resolved  bool            // ips is final for the current DNS strategy
+	dns       *DNSStrategy    // nil for defaultDNS
+	warm      bool            // Routed by a warm rule
+	verbosity logLevel        // Connection logging of the rule that routed it
+	notify    *notifier       // Events of the rule that routed it, nil for none
+	answer    []net.IP        // Addresses direct dials use, pinned for retries
+	failed    map[string]bool // Addresses a direct dial failed at
+	pinned    net.IP          // Address a direct dial connected to
+	member    string          // Outbound of the last dial, the member for groups
+
+	process       *ProcessInfo
+	processLooked bool
+}
+
+// newMetadata collects the routing inputs for a request; domain names are
+// resolved on first use of IPs. An address the shared DNS cache answered
+// for a domain is routed by that domain, and still dialed as requested.
+func newMetadata(src net.Addr, dest Addr) *Metadata {
+	m := &Metadata{Source: src, Dest: dest, literal: true, resolved: true}
+	if dest.Atyp == 0x03 {
+		// Literal addresses sent as domain names, possibly with a zone
+		host, zone, _ := strings.Cut(string(dest.Addr), "%")
+		if ip := net.ParseIP(host); ip != nil {
+			m.ips = []net.IP{ip}
+			m.Zone = zone
+			m.Host, _ = dnsCache.host(ip)
+			return m
+		}
+		m.Host = string(dest.Addr)
+		m.literal, m.resolved = false, false
+	} else {
+		m.ips = []net.IP{net.IP(dest.Addr)}
+		m.Host, _ = dnsCache.host(m.ips[0])
+	}
+	return m
+}
+
+// rewrite points the connection at another destination after routing;
+// the new one is resolved afresh when it is dialed
+func (m *Metadata) rewrite(dest Addr) {
+	n := newMetadata(m.Source, dest)
+	m.Dest, m.Host, m.Zone = n.Dest, n.Host, n.Zone
+	m.ips, m.literal, m.resolved = n.ips, n.literal, n.resolved
+	m.answer, m.failed, m.pinned = nil, nil, nil
+}
+
+// strategy returns the DNS strategy the destination is resolved with
+func (m *Metadata) strategy() *DNSStrategy {
+	if m.dns != nil {
+		return m.dns
+	}
+	return defaultDNS
+}
+
+// IPs returns the destination addresses, looking the domain up with the
+// current DNS strategy on first use; empty for "remote" and "none"
+func (m *Metadata) IPs() []net.IP {
+	if !m.resolved {
+		m.resolved = true
+		m.ips = m.lookup(m.strategy().lookup)
+	}
+	return m.ips
+}
+
+// DialIPs returns the addresses to dial the destination at directly
+func (m *Metadata) DialIPs() []net.IP {
+	if !m.literal && m.strategy().Name == "remote" {
+		return m.lookup(m.strategy().dialLookup)
+	}
+	return m.IPs()
+}
+
+// familyLookup returns the resolver to pipeline a direct dial with, nil
+// when the destination is literal or already resolved
+func (m *Metadata) familyLookup() familyResolver {
+	if m.literal || (m.resolved && m.strategy().Name != "remote") {
+		return nil
+	}
+	return m.strategy().familyLookup(m.Host)
+}
+
+func (m *Metadata) lookup(fn func(string) ([]net.IP, error)) []net.IP {
+	ips, err := fn(m.Host)
+	if err != nil {
+		log.Println("LookupIP error:", err)
+	}
+	return ips
+}
+
+// setDNS switches the DNS strategy once the route is known, dropping
+// addresses resolved with a different one
+func (m *Metadata) setDNS(d *DNSStrategy) {
+	if d == m.strategy() {
+		return
+	}
+	m.dns = d
+	if !m.literal {
+		m.ips, m.resolved = nil, false
+	}
+}
+
+// dialRoute routes a request and dials it through the chosen outbound,
+// returning the connection and the outbound tag
+func dialRoute(router *Router, m *Metadata) (net.Conn, string, error) {
+	tag, rule := router.Route(m)
+	if m.verbosity > logSilent {
+		if m.Source != nil {
+			fmt.Printf("New connection from %s\n", m.Source)
+		}
+		log.Printf("Request: %s\n", m.Dest)
+		if rule != nil {
+			log.Printf("Route: %s -> %s (rule %s)\n", m.Dest, tag, rule.Match)
+		} else {
+			log.Printf("Route: %s -> %s (default)\n", m.Dest, tag)
+		}
+	}
+	if m.verbosity == logVerbose {
+		// Only addresses the rules needed are shown; looking the domain up
+		// just for the log would resolve rejected destinations too
+		ips := "not resolved"
+		if m.resolved {
+			ips = fmt.Sprint(m.ips)
+		}
+		log.Printf("Route detail: %s host %q ips %s dns %s\n", m.Dest, m.Host, ips, m.strategy().Name)
+	}
+	if rule != nil && rule.Rewrite != nil {
+		dest := rule.Rewrite.apply(m.Dest)
+		m.logf(logNormal, "Rewrite: %s -> %s\n", m.Dest, dest)
+		m.rewrite(dest)
+	}
+	conn, err := dialRetry(tag, m)
+	if err == nil || errors.Is(err, errRejected) {
+		return conn, tag, err
+	}
+
+	fallback := router.fallbackFor(rule)
+	var unreachable *proxyUnreachableError
+	if fallback == "" && router.DirectIfUnreachable && errors.As(err, &unreachable) && (rule == nil || rule.Fallback != "none") {
+		fallback = "direct"
+		fallbackStats.Unreachable.Add(1)
+	}
+	if fallback == "" || fallback == tag {
+		return nil, tag, err
+	}
+	m.logf(logNormal, "Dial %s via %s failed (%v), falling back to %s\n", m.Dest, tag, err, fallback)
+	fallbackStats.Attempts.Add(1)
+	conn, ferr := dialOutbound(fallback, m)
+	if ferr != nil {
+		fallbackStats.Failed.Add(1)
+		return nil, fallback, fmt.Errorf("%v; fallback %s: %v", err, fallback, ferr)
+	}
+	fallbackStats.Succeeded.Add(1)
+	return conn, fallback, nil
+}
+
+// dialOutbound dials through the outbound with the given tag, switching to
+// its cert_fallback outbound when TLS certificate verification fails
+func dialOutbound(tag string, m *Metadata) (net.Conn, error) {
+	if exits.disabled(tag) {
+		return nil, fmt.Errorf("outbound %s disabled by exit check", tag)
+	}
+	if health.down(tag) {
+		return nil, fmt.Errorf("outbound %s down by health check", tag)
+	}
+	m.member = tag
+	conn, err := hookedDial(tag, outbounds[tag])(m)
+	if o, ok := outbounds[tag].(socksOutbound); ok && err != nil && o.certFallback != "" && isCertError(err) {
+		fallbackStats.CertFailures.Add(1)
+		certAlert(tag, o.certFallback, err)
+		conn, err = hookedDial(o.certFallback, outbounds[o.certFallback])(m)
+		if err != nil {
+			dialFailed(o.certFallback, err)
+		}
+		return conn, err
+	}
+	if err != nil {
+		dialFailed(tag, err)
+	}
+	return conn, err
+}
+
+// logLevel is the connection logging verbosity of a rule
+type logLevel int
+
+const (
+	logSilent  logLevel = iota - 1 // Nothing about the connection is logged
+	logNormal                      // Requests, routes and failures
+	logVerbose                     // Also routing inputs and session totals
+)
+
+// parseLogLevel parses a rule's log setting
+func parseLogLevel(s string) (logLevel, error) {
+	switch s {
+	case "", "normal":
+		return logNormal, nil
+	case "silent":
+		return logSilent, nil
+	case "verbose":
+		return logVerbose, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+func (l logLevel) String() string {
+	switch l {
+	case logSilent:
+		return "silent"
+	case logVerbose:
+		return "verbose"
+	}
+	return "normal"
+}
+
+// logf logs a line about the connection if its rule's verbosity allows
+func (m *Metadata) logf(level logLevel, format string, args ...any) {
+	if m.verbosity >= level {
+		log.Printf(format, args...)
+	}
+}
+
+// fallbackStats counts retries on the fallback outbound for the admin API
+var fallbackStats struct {
+	Attempts     atomic.Uint64 // Dials retried on the fallback outbound
+	Succeeded    atomic.Uint64 // Retries that connected
+	Failed       atomic.Uint64 // Retries that failed too
+	CertFailures atomic.Uint64 // Dials sent to a cert_fallback outbound
+	Unreachable  atomic.Uint64 // Dials sent direct because the proxy was unreachable
+}
+
+// Rule routes matching connections to an outbound
+type Rule struct {
+	Match    string // Matcher text, for logging
+	Matcher  Matcher
+	Outbound string
+	Split    []splitTarget // Weighted outbounds, instead of Outbound
+	Fallback string        // Overrides Router.Fallback; "none" disables it
+	Warm     bool          // Keep DNS and upstream connections ready
+	Schedule *Schedule     // nil when the rule is always active
+	DNS      *DNSStrategy  // nil to resolve with defaultDNS
+	Log      logLevel
+	Notify   *notifier // nil when the rule sends no events
+	Rewrite  *rewrite  // nil to dial the requested destination
+	NoAAAA   bool      // The DNS server hides the IPv6 addresses of matched domains
+
+	perClient bool // The matcher depends on the client, not just the destination
+}
+
+// clientMatcher is implemented by matchers whose result depends on who
+// connects; decisions involving them are not cached
+type clientMatcher interface {
+	perClient()
+}
+
+// dependsOnClient reports whether a matcher, or any part of a composite
+// one, is a clientMatcher
+func dependsOnClient(m Matcher) bool {
+	if a, ok := m.(andMatcher); ok {
+		for _, part := range a {
+			if dependsOnClient(part) {
+				return true
+			}
+		}
+		return false
+	}
+	_, ok := m.(clientMatcher)
+	return ok
+}
+
+// clock returns the current time for schedules; simulation mode replaces it
+var clock = time.Now
+
+// Router picks an outbound for each connection
+type Router struct {
+	Rules    []*Rule
+	Default  string
+	Fallback string // Outbound retried when a dial fails, empty for none
+	// DirectIfUnreachable dials directly when the proxy of the outbound
+	// cannot be reached, for decisions without a fallback
+	DirectIfUnreachable bool
+	cache               *routeCache // nil when decision caching is off
+	tenant              string      // Tenant whose rules these are, empty for the main config
+}
+
+// newRouter compiles the rules of a configuration
+func newRouter(cfg *Config, geo *GeoData) (*Router, error) {
+	r := &Router{Default: cfg.Default, Fallback: cfg.Fallback, DirectIfUnreachable: cfg.DirectIfUnreachable}
+	if cfg.RouteCache > 0 {
+		r.cache = newRouteCache(time.Duration(cfg.RouteCache))
+	}
+	tags := []string{r.Default, r.Fallback}
+	for _, rc := range cfg.Rules {
+		tags = append(tags, rc.Outbound, rc.Fallback)
+		for tag := range rc.Split {
+			tags = append(tags, tag)
+		}
+	}
+	for _, tag := range tags {
+		if err := registerCountryOutbound(tag); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := outbounds[r.Default]; !ok {
+		return nil, fmt.Errorf("default: unknown outbound %q", r.Default)
+	}
+	if _, ok := outbounds[r.Fallback]; r.Fallback != "" && !ok {
+		return nil, fmt.Errorf("fallback: unknown outbound %q", r.Fallback)
+	}
+	for i, rc := range cfg.Rules {
+		matcher, err := parseMatcher(rc.Match, geo)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		rule := &Rule{Match: rc.Match, Matcher: matcher, Outbound: rc.Outbound, Fallback: rc.Fallback}
+		if _, ok := outbounds[rc.Fallback]; rc.Fallback != "" && rc.Fallback != "none" && !ok {
+			return nil, fmt.Errorf("rule %d: unknown fallback outbound %q", i+1, rc.Fallback)
+		}
+		switch {
+		case rc.Split != nil && rc.Outbound != "":
+			return nil, fmt.Errorf("rule %d: outbound and split are exclusive", i+1)
+		case rc.Split != nil:
+			rule.Split, err = newSplit(rc.Split)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i+1, err)
+			}
+		default:
+			if _, ok := outbounds[rc.Outbound]; !ok {
+				return nil, fmt.Errorf("rule %d: unknown outbound %q", i+1, rc.Outbound)
+			}
+		}
+		rule.perClient = dependsOnClient(matcher)
+		if rc.Schedule != nil {
+			rule.Schedule, err = newSchedule(rc.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: schedule: %v", i+1, err)
+			}
+		}
+		if rc.DNS != "" {
+			rule.DNS, err = parseDNSStrategy(rc.DNS)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i+1, err)
+			}
+		}
+		rule.Log, err = parseLogLevel(rc.Log)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		if rc.Notify != nil {
+			rule.Notify, err = newNotifier(rc.Match, rc.Notify)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i+1, err)
+			}
+		}
+		if rc.Rewrite != "" {
+			rule.Rewrite, err = parseRewrite(rc.Rewrite)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i+1, err)
+			}
+		}
+		rule.NoAAAA = rc.NoAAAA
+		if rc.Warm {
+			rule.Warm = true
+			for _, host := range warmSeeds(matcher) {
+				warm.add(host)
+			}
+		}
+		r.Rules = append(r.Rules, rule)
+	}
+	return r, nil
+}
+
+// Route returns the outbound tag for a connection and the rule that
+// selected it (nil when the default outbound is used), switching m to the
+// rule's DNS strategy
+func (r *Router) Route(m *Metadata) (string, *Rule) {
+	tag, rule := r.route(m)
+	if rule != nil && rule.DNS != nil {
+		m.setDNS(rule.DNS)
+	}
+	if rule != nil {
+		m.verbosity = rule.Log
+		m.notify = rule.Notify
+	}
+	if rule != nil && rule.Warm && m.Host != "" {
+		m.warm = true
+		warm.add(m.Host)
+	}
+	return tag, rule
+}
+
+func (r *Router) route(m *Metadata) (string, *Rule) {
+	now := clock()
+	if explain.tracing(m) {
+		// Traced decisions bypass the cache so every rule is shown
+		t := &explainTrace{}
+		tag, rule, _ := r.match(m, now, t)
+		t.log(m, tag)
+		return tag, rule
+	}
+	if r.cache == nil || m.Host == "" {
+		tag, rule, _ := r.match(m, now, nil)
+		return tag, rule
+	}
+
+	// ToLower returns hosts without uppercase letters as they are, so a
+	// hit does not allocate
+	key := routeKey{strings.ToLower(m.Host), m.Dest.Port}
+	if tag, rule, ok := r.cache.get(key, now); ok {
+		return tag, rule
+	}
+	tag, rule, cacheable := r.match(m, now, nil)
+	if cacheable {
+		r.cache.put(key, tag, rule, now)
+	}
+	return tag, rule
+}
+
+// match walks the rules; the decision is cacheable unless a scheduled or
+// per-client rule was considered, since it could differ for the next
+// connection to the same destination. Each step is recorded in t unless
+// it is nil.
+func (r *Router) match(m *Metadata, now time.Time, t *explainTrace) (string, *Rule, bool) {
+	cacheable := true
+	for i, rule := range r.Rules {
+		if rule.perClient {
+			cacheable = false
+		}
+		if rule.Schedule != nil {
+			cacheable = false
+			if !rule.Schedule.Active(now) {
+				if t != nil {
+					t.add("rule %d %q: skipped, schedule inactive", i+1, rule.Match)
+				}
+				continue
+			}
+		}
+		if rule.Matcher.Match(m) {
+			tag := rule.Outbound
+			if rule.Split != nil {
+				tag = pickSplit(rule.Split, m)
+			}
+			if t != nil {
+				t.hit(i, rule, m)
+			}
+			return tag, rule, cacheable
+		}
+		if t != nil {
+			t.miss(i, rule, m)
+		}
+	}
+	if t != nil {
+		t.add("no rule matched, default")
+	}
+	return r.Default, nil, cacheable
+}
+
+// fallbackFor returns the fallback outbound for a decision, empty for none
+func (r *Router) fallbackFor(rule *Rule) string {
+	if rule == nil || rule.Fallback == "" {
+		return r.Fallback
+	}
+	if rule.Fallback == "none" {
+		return ""
+	}
+	return rule.Fallback
+}
+
+// invalidate drops cached decisions after rules changed
+func (r *Router) invalidate() {
+	if r.cache != nil {
+		r.cache.flush()
+	}
+}
+
+// GeoData lazily loads the geo databases and ASN database referenced by
+// rules
+type GeoData struct {
+	Sources  []GeoSource // geosite/geoip sources in order of precedence
+	ASNPath  string
+	SoftFail bool                   // Missing databases are retried in the background
+	Lists    map[string]*customList // Custom lists, shadowing geosite/geoip categories of the same name
+
+	mu  sync.Mutex
+	asn *mmdbReader
+}
+
+// Site returns a matcher for a geosite category from the first source
+// having it
+func (g *GeoData) Site(code string) (Matcher, error) {
+	return lookupGeo(g.Sources, "geosite", code, GeoSource.Site)
+}
+
+// IP returns a matcher for a geoip category from the first source having it
+func (g *GeoData) IP(code string) (Matcher, error) {
+	return lookupGeo(g.Sources, "geoip", code, GeoSource.IP)
+}
+
+// ASN returns the ASN database, opening it on first use
+func (g *GeoData) ASN() (*mmdbReader, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.asn == nil {
+		if g.ASNPath == "" {
+			return nil, fmt.Errorf("asn rules need an \"asn\" database in the config")
+		}
+		db, err := openMMDB(g.ASNPath)
+		if err != nil {
+			return nil, &unavailableError{fmt.Errorf("load asn: %v", err)}
+		}
+		g.asn = db
+	}
+	return g.asn, nil
+}
+
+// files lists the data files that were loaded
+func (g *GeoData) files() []DataFileSummary {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var files []DataFileSummary
+	for _, s := range g.Sources {
+		if f, ok := s.Loaded(); ok {
+			files = append(files, f)
+		}
+	}
+	if g.asn != nil {
+		files = append(files, DataFileSummary{Kind: "asn", Path: g.ASNPath})
+	}
+	return files
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io"
+	"log"
+	"maps"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingResolver answers every name with one address and counts the
+// lookups, whole or per family
+type countingResolver struct {
+	lookups atomic.Int64
+}
+
+func (r *countingResolver) LookupIP(host string) ([]net.IP, error) {
+	r.lookups.Add(1)
+	return []net.IP{net.IPv4(10, 0, 0, 1).To4()}, nil
+}
+
+func (r *countingResolver) LookupFamily(network, host string) ([]net.IP, error) {
+	r.lookups.Add(1)
+	if network == "ip6" {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []net.IP{net.IPv4(10, 0, 0, 1).To4()}, nil
+}
+
+// countingOutbound connects to an in-memory pipe and counts the dials
+type countingOutbound struct {
+	dials atomic.Int64
+}
+
+func (o *countingOutbound) Dial(m *Metadata) (net.Conn, error) {
+	o.dials.Add(1)
+	conn, peer := net.Pipe()
+	peer.Close()
+	return conn, nil
+}
+
+// useTestRouting replaces the resolver and the direct outbound with
+// counting stubs for the duration of a test
+func useTestRouting(t *testing.T) (*countingResolver, *countingOutbound) {
+	t.Helper()
+	r, o := &countingResolver{}, &countingOutbound{}
+	oldResolver, oldOutbounds, oldLog := resolver, maps.Clone(outbounds), log.Writer()
+	resolver = r
+	outbounds["direct"] = o
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		resolver, outbounds = oldResolver, oldOutbounds
+		log.SetOutput(oldLog)
+	})
+	return r, o
+}
+
+// TestRejectWithoutLookup checks that routing runs before any lookup or
+// dial: a domain rejected by a domain rule causes no resolver queries,
+// even when a later rule would need its addresses
+func TestRejectWithoutLookup(t *testing.T) {
+	tests := []struct {
+		name        string
+		log         string
+		routeCache  Duration
+		host        string
+		wantTag     string
+		wantLookups int64
+		wantDials   int64
+	}{
+		{"rejected", "", 0, "ads.blocked.example", "reject", 0, 0},
+		{"rejected with verbose logging", "verbose", 0, "ads.blocked.example", "reject", 0, 0},
+		{"rejected with route cache", "", Duration(time.Minute), "ads.blocked.example", "reject", 0, 0},
+		// The counting works: an allowed domain is resolved for the ip rule
+		{"allowed", "", 0, "www.allowed.example", "direct", 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, o := useTestRouting(t)
+			cfg := &Config{
+				Default:    "direct",
+				RouteCache: tt.routeCache,
+				Rules: []RuleConfig{
+					{Match: "domain:blocked.example", Outbound: "reject", Log: tt.log},
+					{Match: "ip:10.0.0.0/8", Outbound: "direct", Log: tt.log},
+				},
+			}
+			router, err := newRouter(cfg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Twice, so a cached decision is covered as well
+			for range 2 {
+				m := newMetadata(nil, Addr{Atyp: 0x03, Addr: []byte(tt.host), Port: 443})
+				conn, tag, err := dialRoute(router, m)
+				if conn != nil {
+					conn.Close()
+				}
+				if tag != tt.wantTag {
+					t.Errorf("routed to %s, want %s", tag, tt.wantTag)
+				}
+				if tt.wantTag == "reject" && err != errRejected {
+					t.Errorf("got %v, want %v", err, errRejected)
+				}
+			}
+			if n := r.lookups.Load(); n != 2*tt.wantLookups {
+				t.Errorf("%d resolver queries, want %d", n, 2*tt.wantLookups)
+			}
+			if n := o.dials.Load(); n != 2*tt.wantDials {
+				t.Errorf("%d dials, want %d", n, 2*tt.wantDials)
+			}
+		})
+	}
+}
+
+// routeCacheRouter returns a router with the route cache on and rules
+// that need no lookups
+func routeCacheRouter(tb testing.TB) *Router {
+	tb.Helper()
+	router, err := newRouter(&Config{
+		Default:    "direct",
+		RouteCache: Duration(time.Hour),
+		Rules: []RuleConfig{
+			{Match: "domain:blocked.example", Outbound: "reject"},
+			{Match: "domain:example.com", Outbound: "direct"},
+		},
+	}, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return router
+}
+
+// TestRouteCacheHitAllocs guards the cost of a cached routing decision:
+// none for lowercase domains
+func TestRouteCacheHitAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts differ under the race detector")
+	}
+	router := routeCacheRouter(t)
+	m := newMetadata(nil, Addr{Atyp: 0x03, Addr: []byte("www.example.com"), Port: 443})
+	router.route(m)
+	allocs := testing.AllocsPerRun(100, func() {
+		router.route(m)
+	})
+	if allocs > 0 {
+		t.Errorf("a route cache hit allocates %v times, want none", allocs)
+	}
+	if hits := router.cache.hits.Load(); hits < 100 {
+		t.Errorf("%d cache hits, want every run to hit", hits)
+	}
+	// Mixed case shares the lowercase entry
+	upper := newMetadata(nil, Addr{Atyp: 0x03, Addr: []byte("WWW.Example.com"), Port: 443})
+	misses := router.cache.misses.Load()
+	if tag, _ := router.route(upper); tag != "direct" || router.cache.misses.Load() != misses {
+		t.Errorf("mixed-case domain routed to %s with a cache miss", tag)
+	}
+}
+
+func BenchmarkRouteCacheHit(b *testing.B) {
+	router := routeCacheRouter(b)
+	m := newMetadata(nil, Addr{Atyp: 0x03, Addr: []byte("www.example.com"), Port: 443})
+	router.route(m)
+	b.ReportAllocs()
+	for range b.N {
+		router.route(m)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timeSpan is a time-of-day range in minutes since midnight
+type timeSpan struct {
+	from, to int
+}
+
+// contains reports whether minute falls inside the span; spans where
+// from > to wrap around midnight (e.g. 22:00-06:00)
+func (s timeSpan) contains(minute int) bool {
+	if s.from <= s.to {
+		return minute >= s.from && minute < s.to
+	}
+	return minute >= s.from || minute < s.to
+}
+
+// Schedule is a compiled ScheduleConfig
+type Schedule struct {
+	days  [7]bool
+	spans []timeSpan
+	loc   *time.Location
+}
+
+// newSchedule compiles a schedule from its configuration
+func newSchedule(c *ScheduleConfig) (*Schedule, error) {
+	s := &Schedule{loc: time.Local}
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		s.loc = loc
+	}
+	if len(c.Days) == 0 {
+		for i := range s.days {
+			s.days[i] = true
+		}
+	}
+	for _, d := range c.Days {
+		wd, ok := parseWeekday(d)
+		if !ok {
+			return nil, fmt.Errorf("invalid weekday %q", d)
+		}
+		s.days[wd] = true
+	}
+	for _, t := range c.Times {
+		from, to, ok := strings.Cut(t, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid time range %q", t)
+		}
+		var span timeSpan
+		var err error
+		if span.from, err = parseClock(from); err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(to) == "24:00" {
+			span.to = 24 * 60 // Until midnight, e.g. "18:00-24:00"
+		} else if span.to, err = parseClock(to); err != nil {
+			return nil, err
+		}
+		s.spans = append(s.spans, span)
+	}
+	return s, nil
+}
+
+// parseWeekday parses a day as its full English name or its three-letter
+// abbreviation, in any case
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(s)
+	if len(s) < 3 {
+		return 0, false
+	}
+	wd, ok := weekdays[s[:3]]
+	if !ok || (len(s) > 3 && s != strings.ToLower(wd.String())) {
+		return 0, false
+	}
+	return wd, true
+}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Active reports whether the schedule covers the given instant
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.loc)
+	if !s.days[t.Weekday()] {
+		return false
+	}
+	if len(s.spans) == 0 {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, span := range s.spans {
+		if span.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleActive(t *testing.T) {
+	// 2026-10-12 is a Monday
+	at := func(day int, clock string) time.Time {
+		t, _ := time.ParseInLocation("15:04", clock, time.UTC)
+		return time.Date(2026, 10, 12+day, t.Hour(), t.Minute(), 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		cfg  ScheduleConfig
+		at   time.Time
+		want bool
+	}{
+		{"inside", ScheduleConfig{Times: []string{"09:00-17:30"}}, at(0, "12:00"), true},
+		{"at the end", ScheduleConfig{Times: []string{"09:00-17:30"}}, at(0, "17:30"), false},
+		{"wrapping, late", ScheduleConfig{Times: []string{"22:00-06:00"}}, at(0, "23:15"), true},
+		{"wrapping, early", ScheduleConfig{Times: []string{"22:00-06:00"}}, at(0, "05:59"), true},
+		{"wrapping, outside", ScheduleConfig{Times: []string{"22:00-06:00"}}, at(0, "06:00"), false},
+		{"until midnight", ScheduleConfig{Times: []string{"18:00-24:00"}}, at(0, "23:59"), true},
+		{"until midnight, after it", ScheduleConfig{Times: []string{"18:00-24:00"}}, at(1, "00:00"), false},
+		{"whole day as a range", ScheduleConfig{Times: []string{"00:00-24:00"}}, at(0, "00:00"), true},
+		{"whole day without times", ScheduleConfig{}, at(0, "23:59"), true},
+		{"listed day", ScheduleConfig{Days: []string{"mon"}}, at(0, "10:00"), true},
+		{"other day", ScheduleConfig{Days: []string{"Monday"}, Times: []string{"18:00-24:00"}}, at(1, "20:00"), false},
+	}
+	for _, tt := range tests {
+		tt.cfg.Timezone = "UTC"
+		s, err := newSchedule(&tt.cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := s.Active(tt.at); got != tt.want {
+			t.Errorf("%s: active at %s is %v, want %v", tt.name, tt.at.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestScheduleDays(t *testing.T) {
+	for _, day := range []string{"mon", "Mon", "MONDAY", "monday"} {
+		if _, err := newSchedule(&ScheduleConfig{Days: []string{day}}); err != nil {
+			t.Errorf("%q: %v", day, err)
+		}
+	}
+	for _, day := range []string{"Monkey", "Sunshine", "thursdayz", "tues", "mo", "", "satur"} {
+		if _, err := newSchedule(&ScheduleConfig{Days: []string{day}}); err == nil {
+			t.Errorf("%q accepted as a weekday", day)
+		}
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for _, times := range []string{"09:00", "09:00-25:00", "24:00-06:00", "9-17"} {
+		if _, err := newSchedule(&ScheduleConfig{Times: []string{times}}); err == nil {
+			t.Errorf("%q accepted", times)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relayBufferSize is the copy buffer size for each relay direction
+const relayBufferSize = 32 * 1024
+
+// relayBuffers recycles relay copy buffers between sessions
+var relayBuffers = sync.Pool{New: func() any {
+	b := make([]byte, relayBufferSize)
+	return &b
+}}
+
+// readerOnly hides the WriteTo method of a connection from io.CopyBuffer,
+// which would otherwise ignore the given buffer and allocate its own
+type readerOnly struct {
+	io.Reader
+}
+
+// Session is an established client connection
+type Session struct {
+	ID       uint64    `json:"id"`
+	Tenant   string    `json:"tenant,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Source   string    `json:"source"`
+	Dest     string    `json:"dest"`
+	Outbound string    `json:"outbound"`
+	Member   string    `json:"member,omitempty"` // Outbound that carried the session, e.g. the member a group chose
+	Remote   string    `json:"remote,omitempty"` // Address a direct dial connected to
+	Start    time.Time `json:"start"`
+
+	mem    atomic.Int64 // Approximate bytes held in buffers
+	up     atomic.Int64 // Bytes sent by the client
+	down   atomic.Int64 // Bytes sent to the client
+	upW    atomic.Int64 // Start (unix nanoseconds) of a blocked write to the destination, 0 when idle
+	downW  atomic.Int64 // Start of a blocked write to the client, 0 when idle
+	client net.Conn     // Closed to terminate the session
+
+	rateUp   atomic.Int64 // Estimated current throughput from the client, bytes per second
+	rateDown atomic.Int64 // Estimated current throughput to the client
+	sampled  [2]int64     // Bytes up and down at the last sample, owned by sampleRates
+}
+
+// Memory returns the approximate buffer memory held by the session
+func (s *Session) Memory() int64 {
+	return s.mem.Load()
+}
+
+// Bytes returns the bytes relayed from and to the client so far
+func (s *Session) Bytes() (up, down int64) {
+	return s.up.Load(), s.down.Load()
+}
+
+// Rates returns the estimated current throughput from and to the client,
+// in bytes per second
+func (s *Session) Rates() (up, down int64) {
+	return s.rateUp.Load(), s.rateDown.Load()
+}
+
+// rateInterval is how often session throughput is sampled
+const rateInterval = time.Second
+
+// sampleRates keeps the throughput estimates of the active sessions up to
+// date: every rateInterval, the rate over the interval is averaged with the
+// previous estimate, so a burst shows within a second or two and fades as
+// quickly once the flow calms down
+func sampleRates() {
+	for range time.Tick(rateInterval) {
+		for _, s := range sessions.list() {
+			up, down := s.Bytes()
+			rateUp := (up - s.sampled[0]) * int64(time.Second) / int64(rateInterval)
+			rateDown := (down - s.sampled[1]) * int64(time.Second) / int64(rateInterval)
+			s.rateUp.Store((s.rateUp.Load() + rateUp) / 2)
+			s.rateDown.Store((s.rateDown.Load() + rateDown) / 2)
+			s.sampled = [2]int64{up, down}
+		}
+	}
+}
+
+// writingSince returns when the oldest write still in progress started,
+// zero when no write is blocked
+func (s *Session) writingSince() time.Time {
+	var oldest int64
+	for _, w := range []int64{s.upW.Load(), s.downW.Load()} {
+		if w != 0 && (oldest == 0 || w < oldest) {
+			oldest = w
+		}
+	}
+	if oldest == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, oldest)
+}
+
+// countWriter counts the bytes written through it and records when a
+// write is in progress, for the watchdog
+type countWriter struct {
+	w    io.Writer
+	n    *atomic.Int64
+	busy *atomic.Int64
+}
+
+func (c countWriter) Write(p []byte) (int, error) {
+	c.busy.Store(time.Now().UnixNano())
+	n, err := c.w.Write(p)
+	c.busy.Store(0)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// sessionShards splits the session table so that connections opening and
+// closing concurrently rarely wait on the same lock
+const sessionShards = 64
+
+// sessionTable tracks the active sessions
+type sessionTable struct {
+	nextID atomic.Uint64
+	active atomic.Int64
+	shards [sessionShards]sessionShard
+}
+
+type sessionShard struct {
+	mu sync.Mutex
+	m  map[uint64]*Session
+}
+
+var sessions = newSessionTable()
+
+func newSessionTable() *sessionTable {
+	t := &sessionTable{}
+	for i := range t.shards {
+		t.shards[i].m = map[uint64]*Session{}
+	}
+	return t
+}
+
+func (t *sessionTable) shard(id uint64) *sessionShard {
+	return &t.shards[id%sessionShards]
+}
+
+// add registers a session and assigns its ID
+func (t *sessionTable) add(s *Session) {
+	s.ID = t.nextID.Add(1)
+	sh := t.shard(s.ID)
+	sh.mu.Lock()
+	sh.m[s.ID] = s
+	sh.mu.Unlock()
+	t.active.Add(1)
+}
+
+// remove unregisters a session, handing it to the exporter if any
+func (t *sessionTable) remove(s *Session) {
+	sh := t.shard(s.ID)
+	sh.mu.Lock()
+	delete(sh.m, s.ID)
+	sh.mu.Unlock()
+	t.active.Add(-1)
+	if exporter != nil {
+		exporter.add(s)
+	}
+}
+
+// count returns the number of active sessions without listing them
+func (t *sessionTable) count() int {
+	return int(t.active.Load())
+}
+
+// closeSource terminates the sessions of a client IP, returning how many
+// were closed
+func (t *sessionTable) closeSource(ip net.IP) int {
+	n := 0
+	for _, s := range t.list() {
+		if tcp, ok := s.client.RemoteAddr().(*net.TCPAddr); ok && tcp.IP.Equal(ip) {
+			s.client.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// list returns the active sessions ordered by ID
+func (t *sessionTable) list() []*Session {
+	list := make([]*Session, 0, t.count())
+	for i := range t.shards {
+		sh := &t.shards[i]
+		sh.mu.Lock()
+		for _, s := range sh.m {
+			list = append(list, s)
+		}
+		sh.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// idleTimeouts holds the idle timeouts of the outbounds that set one
+var idleTimeouts = map[string]time.Duration{}
+
+// relay copies data between client and destination until the destination
+// side finishes, accounting the copy buffers to the session. With an idle
+// timeout, both connections are closed once no data moved either way for
+// that long.
+func relay(s *Session, client, dest net.Conn, idle time.Duration) {
+	s.mem.Add(2 * relayBufferSize)
+	defer s.mem.Add(-2 * relayBufferSize)
+	if idle > 0 {
+		defer watchIdle(s, idle, func() {
+			client.Close()
+			dest.Close()
+		})()
+	}
+	go func() {
+		buf := relayBuffers.Get().(*[]byte)
+		io.CopyBuffer(countWriter{dest, &s.up, &s.upW}, readerOnly{client}, *buf)
+		relayBuffers.Put(buf)
+	}()
+	buf := relayBuffers.Get().(*[]byte)
+	io.CopyBuffer(countWriter{client, &s.down, &s.downW}, readerOnly{dest}, *buf)
+	relayBuffers.Put(buf)
+}
+
+// watchIdle calls onIdle when the session relayed no data for the timeout,
+// checking four times per timeout; the returned function stops watching
+func watchIdle(s *Session, timeout time.Duration, onIdle func()) (stop func()) {
+	var last int64
+	active := time.Now()
+	var t *time.Timer
+	var mu sync.Mutex
+	stopped := false
+	t = time.AfterFunc(timeout/4, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return
+		}
+		up, down := s.Bytes()
+		if up+down != last {
+			last, active = up+down, time.Now()
+		} else if time.Since(active) >= timeout {
+			log.Printf("Closing %s -> %s: idle for %v\n", s.Source, s.Dest, timeout)
+			onIdle()
+			return
+		}
+		t.Reset(timeout / 4)
+	})
+	return func() {
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		t.Stop()
+	}
+}
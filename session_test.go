@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// eofConn is a client that sends nothing; it keeps no state, so relays
+// finishing in the background may share it
+type eofConn struct {
+	net.Conn
+}
+
+func (eofConn) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (eofConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// relayPayload is what the destination sends per relay run
+var relayPayload = make([]byte, 1<<20)
+
+// TestRelayAllocs guards the allocations of a relay: the copy buffers come
+// from the pool, so only the goroutine's closure and the two wrapped
+// connections per direction allocate, whatever the amount of data
+func TestRelayAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts differ under the race detector")
+	}
+	s := &Session{}
+	dest := newMemConn(nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		dest.r.Reset(relayPayload)
+		relay(s, eofConn{}, dest, 0)
+		// Let the upload goroutine finish; AllocsPerRun runs on one
+		// thread, where finished relays' goroutines would pile up
+		runtime.Gosched()
+	})
+	if allocs > 5 {
+		t.Errorf("relay allocates %v times, want at most 5", allocs)
+	}
+}
+
+func TestRelayCounts(t *testing.T) {
+	s := &Session{}
+	relay(s, eofConn{}, newMemConn(relayPayload), 0)
+	if up, down := s.Bytes(); up != 0 || down != int64(len(relayPayload)) {
+		t.Errorf("relayed %d bytes up and %d down, want 0 and %d", up, down, len(relayPayload))
+	}
+	if mem := s.Memory(); mem != 0 {
+		t.Errorf("%d bytes of buffers still accounted after the relay", mem)
+	}
+}
+
+func BenchmarkRelay(b *testing.B) {
+	s := &Session{}
+	dest := newMemConn(nil)
+	b.SetBytes(int64(len(relayPayload)))
+	b.ReportAllocs()
+	for range b.N {
+		dest.r.Reset(relayPayload)
+		relay(s, eofConn{}, dest, 0)
+	}
+}
+
+// liveSessions is how many sessions the table benchmarks keep registered
+const liveSessions = 50000
+
+// sessionTracker is what the table benchmarks exercise
+type sessionTracker interface {
+	add(s *Session)
+	remove(s *Session)
+}
+
+// lockedSessionTable is a single-lock table, the baseline for the shards
+type lockedSessionTable struct {
+	mu     sync.Mutex
+	nextID uint64
+	m      map[uint64]*Session
+}
+
+func (t *lockedSessionTable) add(s *Session) {
+	t.mu.Lock()
+	t.nextID++
+	s.ID = t.nextID
+	t.m[s.ID] = s
+	t.mu.Unlock()
+}
+
+func (t *lockedSessionTable) remove(s *Session) {
+	t.mu.Lock()
+	delete(t.m, s.ID)
+	t.mu.Unlock()
+}
+
+// fillSessions registers liveSessions sessions
+func fillSessions(t sessionTracker) {
+	for range liveSessions {
+		t.add(&Session{})
+	}
+}
+
+// BenchmarkSessionChurn opens and closes sessions from all CPUs while
+// 50k others stay registered, against the sharded table and a single lock
+func BenchmarkSessionChurn(b *testing.B) {
+	tables := []struct {
+		name  string
+		table func() sessionTracker
+	}{
+		{"sharded", func() sessionTracker { return newSessionTable() }},
+		{"single-lock", func() sessionTracker { return &lockedSessionTable{m: map[uint64]*Session{}} }},
+	}
+	for _, tt := range tables {
+		b.Run(tt.name, func(b *testing.B) {
+			t := tt.table()
+			fillSessions(t)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				s := &Session{}
+				for pb.Next() {
+					t.add(s)
+					t.remove(s)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkSessionList lists 50k sessions, as the admin API does, from all
+// CPUs while sessions keep opening and closing
+func BenchmarkSessionList(b *testing.B) {
+	t := newSessionTable()
+	fillSessions(t)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s := &Session{}
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				t.add(s)
+				t.remove(s)
+			}
+		}
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if n := len(t.list()); n < liveSessions {
+				b.Errorf("listed %d sessions, want at least %d", n, liveSessions)
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ShadowsocksConfig enables a Shadowsocks (AEAD) inbound next to SOCKS5,
+// for clients that only speak Shadowsocks; its connections are routed
+// like any other
+type ShadowsocksConfig struct {
+	Listen   string `json:"listen"`   // Address to listen on, e.g. ":8388"
+	Method   string `json:"method"`   // "aes-128-gcm", "aes-256-gcm" or "chacha20-ietf-poly1305"
+	Password string `json:"password"` // Shared password
+}
+
+// ssMaxPayload is the largest payload of one Shadowsocks chunk
+const ssMaxPayload = 0x3fff
+
+// ssCipher holds the master key of a Shadowsocks method
+type ssCipher struct {
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newSSCipher(method, password string) (*ssCipher, error) {
+	size, newAEAD := 32, newGCM
+	switch method {
+	case "aes-128-gcm":
+		size = 16
+	case "aes-256-gcm":
+	case "chacha20-ietf-poly1305":
+		newAEAD = chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("shadowsocks: unsupported method %q", method)
+	}
+	if password == "" {
+		return nil, errors.New("shadowsocks: password is required")
+	}
+	return &ssCipher{key: evpBytesToKey(password, size), newAEAD: newAEAD}, nil
+}
+
+// evpBytesToKey derives the master key from the password as OpenSSL's
+// EVP_BytesToKey with MD5 does
+func evpBytesToKey(password string, size int) []byte {
+	var key, prev []byte
+	for len(key) < size {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:size]
+}
+
+// aead returns the cipher of a session, keyed by HKDF-SHA1 of the master
+// key and the session salt
+func (c *ssCipher) aead(salt []byte) (cipher.AEAD, error) {
+	// HKDF extract and expand; one or two SHA-1 blocks cover the key
+	ext := hmac.New(sha1.New, salt)
+	ext.Write(c.key)
+	prk := ext.Sum(nil)
+	var subkey, t []byte
+	for i := byte(1); len(subkey) < len(c.key); i++ {
+		h := hmac.New(sha1.New, prk)
+		h.Write(t)
+		h.Write([]byte("ss-subkey"))
+		h.Write([]byte{i})
+		t = h.Sum(nil)
+		subkey = append(subkey, t...)
+	}
+	return c.newAEAD(subkey[:len(c.key)])
+}
+
+// ssSaltFilter remembers recent session salts so replayed connections are
+// refused; two generations are kept and the older one is dropped when the
+// newer fills up
+type ssSaltFilter struct {
+	mu       sync.Mutex
+	cur, old map[string]bool
+}
+
+const ssSaltGeneration = 100000
+
+var ssSalts = &ssSaltFilter{cur: map[string]bool{}}
+
+// check records a salt, reporting false if it was seen before
+func (f *ssSaltFilter) check(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cur[string(salt)] || f.old[string(salt)] {
+		return false
+	}
+	if len(f.cur) >= ssSaltGeneration {
+		f.old, f.cur = f.cur, map[string]bool{}
+	}
+	f.cur[string(salt)] = true
+	return true
+}
+
+// ssConn is a Shadowsocks AEAD stream: the salt of each direction comes
+// first, then chunks of a sealed length and a sealed payload
+type ssConn struct {
+	net.Conn
+	c *ssCipher
+
+	r      cipher.AEAD
+	rnonce [12]byte
+	salt   []byte // Client salt, until its first chunk is authenticated
+	buf    []byte
+
+	wmu    sync.Mutex
+	w      cipher.AEAD
+	wnonce [12]byte
+}
+
+// ssIncrement advances a little-endian nonce
+func ssIncrement(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (s *ssConn) open(sealed []byte) ([]byte, error) {
+	plain, err := s.r.Open(sealed[:0], s.rnonce[:], sealed, nil)
+	ssIncrement(s.rnonce[:])
+	return plain, err
+}
+
+func (s *ssConn) Read(p []byte) (int, error) {
+	if s.r == nil {
+		salt := make([]byte, len(s.c.key))
+		if _, err := io.ReadFull(s.Conn, salt); err != nil {
+			return 0, err
+		}
+		aead, err := s.c.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		s.r, s.salt = aead, salt
+	}
+	for len(s.buf) == 0 {
+		sealed := make([]byte, 2+s.r.Overhead())
+		if _, err := io.ReadFull(s.Conn, sealed); err != nil {
+			return 0, err
+		}
+		length, err := s.open(sealed)
+		if err != nil {
+			return 0, errors.New("shadowsocks: authentication failed")
+		}
+		if s.salt != nil {
+			// Only authenticated salts are remembered, so probes cannot
+			// fill the filter
+			if !ssSalts.check(s.salt) {
+				return 0, errors.New("shadowsocks: replayed salt")
+			}
+			s.salt = nil
+		}
+		n := (int(length[0])<<8 | int(length[1])) & ssMaxPayload
+		sealed = make([]byte, n+s.r.Overhead())
+		if _, err := io.ReadFull(s.Conn, sealed); err != nil {
+			return 0, err
+		}
+		if s.buf, err = s.open(sealed); err != nil {
+			return 0, errors.New("shadowsocks: authentication failed")
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *ssConn) Write(p []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	var out []byte
+	if s.w == nil {
+		salt := make([]byte, len(s.c.key))
+		rand.Read(salt)
+		aead, err := s.c.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		s.w = aead
+		out = salt
+	}
+	n := 0
+	for len(p) > 0 || out != nil {
+		size := min(len(p), ssMaxPayload)
+		if size > 0 {
+			out = s.w.Seal(out, s.wnonce[:], []byte{byte(size >> 8), byte(size)}, nil)
+			ssIncrement(s.wnonce[:])
+			out = s.w.Seal(out, s.wnonce[:], p[:size], nil)
+			ssIncrement(s.wnonce[:])
+		}
+		if _, err := s.Conn.Write(out); err != nil {
+			return n, err
+		}
+		out = nil
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// serveShadowsocks accepts Shadowsocks clients until the listener fails
+func serveShadowsocks(ss *ShadowsocksConfig, cfg *Config, router *Router) {
+	c, err := newSSCipher(ss.Method, ss.Password)
+	if err != nil {
+		log.Fatal("Invalid config: ", err)
+	}
+	listener, err := net.Listen("tcp", ss.Listen)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", ss.Listen, err)
+	}
+	fmt.Printf("Shadowsocks server running on %s\n", ss.Listen)
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Accept failed: %v\n", err)
+			continue
+		}
+		go handleShadowsocks(client, c, cfg, router)
+	}
+}
+
+// handleShadowsocks reads the destination from the first chunk and hands
+// the connection to the router
+func handleShadowsocks(client net.Conn, c *ssCipher, cfg *Config, router *Router) {
+	defer client.Close()
+	if blocks.blocked(client.RemoteAddr()) {
+		fmt.Printf("Blocked client %s\n", client.RemoteAddr())
+		return
+	}
+	conn := &ssConn{Conn: client, c: c}
+	client.SetReadDeadline(time.Now().Add(30 * time.Second))
+	destAddr, err := readAddr(conn)
+	if err != nil {
+		fmt.Printf("Shadowsocks handshake failed from %s: %v\n", client.RemoteAddr(), err)
+		// Keep reading like a server that is still waiting, so probes
+		// learn nothing from when the connection closes
+		io.Copy(io.Discard, client)
+		return
+	}
+	client.SetReadDeadline(time.Time{})
+	connectClient(conn, "", destAddr, cfg, router, func(byte, error) error { return nil })
+}
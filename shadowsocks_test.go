@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// TestEVPBytesToKey checks master keys against OpenSSL:
+// openssl enc -aes-256-cbc -k password -nosalt -md md5 -P
+func TestEVPBytesToKey(t *testing.T) {
+	tests := []struct {
+		password string
+		size     int
+		want     string
+	}{
+		{"password", 32, "5f4dcc3b5aa765d61d8327deb882cf992b95990a9151374abd8ff8c5a7a0fe08"},
+		{"barfoo!", 16, "b3adc47839e047eb228870526dc8fc30"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(evpBytesToKey(tt.password, tt.size)); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.password, got, tt.want)
+		}
+	}
+}
+
+// ssSubkey is the HKDF-SHA1 subkey of the "password" master key for the
+// salt 00 01 ... 1f, from openssl kdf -kdfopt digest:SHA1 -kdfopt
+// info:ss-subkey HKDF
+var ssSubkey = unhex("ee187aed3f87574907a39db98606f60a526114831288097cac66054b33a9464f")
+
+// freshSalts gives a test a salt filter of its own, as the fixed test salt
+// would otherwise be refused as a replay
+func freshSalts(t *testing.T) {
+	old := ssSalts
+	ssSalts = &ssSaltFilter{cur: map[string]bool{}}
+	t.Cleanup(func() { ssSalts = old })
+}
+
+func ssTestSalt() []byte {
+	salt := make([]byte, 32)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	return salt
+}
+
+// TestSSSubkey checks the session cipher of each method is keyed with
+// the known subkey: what a cipher made from it seals, the session opens
+func TestSSSubkey(t *testing.T) {
+	for method, newAEAD := range map[string]func([]byte) (cipher.AEAD, error){
+		"aes-256-gcm":            newGCM,
+		"chacha20-ietf-poly1305": chacha20poly1305.New,
+	} {
+		c, err := newSSCipher(method, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := c.aead(ssTestSalt())
+		if err != nil {
+			t.Fatal(err)
+		}
+		known, err := newAEAD(ssSubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := make([]byte, 12)
+		sealed := known.Seal(nil, nonce, []byte("payload"), nil)
+		if plain, err := session.Open(nil, nonce, sealed, nil); err != nil || string(plain) != "payload" {
+			t.Errorf("%s: session cipher does not use the known subkey: %q, %v", method, plain, err)
+		}
+	}
+}
+
+// ssStream builds what a client sends: the salt, then a length chunk and
+// a payload chunk per payload, sealed with the subkey and counting nonces
+func ssStream(aead cipher.AEAD, salt []byte, payloads ...[]byte) []byte {
+	out := append([]byte(nil), salt...)
+	nonce := make([]byte, 12)
+	for _, p := range payloads {
+		out = aead.Seal(out, nonce, []byte{byte(len(p) >> 8), byte(len(p))}, nil)
+		ssIncrement(nonce)
+		out = aead.Seal(out, nonce, p, nil)
+		ssIncrement(nonce)
+	}
+	return out
+}
+
+// TestSSReadChunks reads a client stream built independently of ssConn,
+// in chunks up to the largest payload
+func TestSSReadChunks(t *testing.T) {
+	freshSalts(t)
+	c, err := newSSCipher("chacha20-ietf-poly1305", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, _ := chacha20poly1305.New(ssSubkey)
+	data := testStream(2*ssMaxPayload + 10)
+	stream := ssStream(aead, ssTestSalt(), data[:10], data[10:10+ssMaxPayload], data[10+ssMaxPayload:])
+	conn := &ssConn{Conn: newMemConn(stream), c: c}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes differing from the %d sent", len(got), len(data))
+	}
+
+	// A flipped bit fails authentication
+	stream[len(stream)-1] ^= 1
+	freshSalts(t)
+	conn = &ssConn{Conn: newMemConn(stream), c: c}
+	if _, err := io.ReadAll(conn); err == nil || !strings.Contains(err.Error(), "authentication") {
+		t.Errorf("tampered stream: %v", err)
+	}
+}
+
+// TestSSRoundTrip sends data both ways between two ssConns of each method
+func TestSSRoundTrip(t *testing.T) {
+	for _, method := range []string{"aes-128-gcm", "aes-256-gcm", "chacha20-ietf-poly1305"} {
+		t.Run(method, func(t *testing.T) {
+			c, err := newSSCipher(method, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, b := tcpPair(t)
+			client, server := &ssConn{Conn: a, c: c}, &ssConn{Conn: b, c: c}
+			defer client.Close()
+			defer server.Close()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			server.SetDeadline(time.Now().Add(5 * time.Second))
+			up, down := testStream(100000), testStream(5000)
+			go client.Write(up)
+			go server.Write(down)
+			got := make([]byte, len(up))
+			if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, up) {
+				t.Fatalf("server read %d bytes, %v", len(got), err)
+			}
+			got = make([]byte, len(down))
+			if _, err := io.ReadFull(client, got); err != nil || !bytes.Equal(got, down) {
+				t.Fatalf("client read %d bytes, %v", len(got), err)
+			}
+		})
+	}
+}
+
+// TestSSReplay replays a recorded client stream: the second connection
+// is refused
+func TestSSReplay(t *testing.T) {
+	c, err := newSSCipher("aes-256-gcm", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, _ := newGCM(ssSubkey)
+	stream := ssStream(aead, ssTestSalt(), []byte("hello"))
+	freshSalts(t)
+	if _, err := io.ReadAll(&ssConn{Conn: newMemConn(stream), c: c}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(&ssConn{Conn: newMemConn(stream), c: c}); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Errorf("replayed stream: %v", err)
+	}
+}
+
+// TestSSSaltFilter checks that salts are remembered for at least one full
+// generation after theirs, and forgotten after two
+func TestSSSaltFilter(t *testing.T) {
+	f := &ssSaltFilter{cur: map[string]bool{}}
+	first := []byte("first salt")
+	if !f.check(first) || f.check(first) {
+		t.Fatal("a new salt is not accepted once")
+	}
+	fill := func() {
+		for i := range ssSaltGeneration {
+			f.check([]byte(fmt.Sprint(time.Now().UnixNano(), i)))
+		}
+	}
+	fill()
+	if f.check(first) {
+		t.Error("salt forgotten after one generation")
+	}
+	fill()
+	if !f.check(first) {
+		t.Error("salt still remembered after two generations")
+	}
+}
+
+func TestSSMethods(t *testing.T) {
+	for _, method := range []string{"chacha20-poly1305", "aes-192-gcm", "rc4-md5", ""} {
+		if _, err := newSSCipher(method, "secret"); err == nil {
+			t.Errorf("method %q accepted", method)
+		}
+	}
+	if _, err := newSSCipher("aes-256-gcm", ""); err == nil {
+		t.Error("empty password accepted")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// startTime is when the process started, for the uptime of the report
+var startTime = time.Now()
+
+// ShutdownReportConfig posts the report written on shutdown to a webhook,
+// e.g. to collect the results of short-lived container runs
+type ShutdownReportConfig struct {
+	URL     string            `json:"url"`     // Webhook receiving the report as a JSON POST
+	Headers map[string]string `json:"headers"` // Extra request headers, e.g. an "Authorization" token
+	Timeout Duration          `json:"timeout"` // How long shutdown waits for the webhook, default 5s
+}
+
+// ShutdownReport summarizes a run
+type ShutdownReport struct {
+	Signal        string                     `json:"signal"`
+	Started       time.Time                  `json:"started"`
+	Stopped       time.Time                  `json:"stopped"`
+	UptimeSeconds int64                      `json:"uptime_seconds"`
+	Sessions      uint64                     `json:"sessions"` // Sessions opened through all outbounds
+	Active        int64                      `json:"active"`   // Sessions still open at shutdown
+	BytesUp       int64                      `json:"bytes_up"`
+	BytesDown     int64                      `json:"bytes_down"`
+	Errors        map[string]uint64          `json:"errors"` // "dial" failures and "udp_dropped" datagrams
+	Outbounds     map[string]OutboundTraffic `json:"outbounds"`
+}
+
+// handleShutdown exits on SIGINT and SIGTERM after saving the state file
+// (when statePath is set), logging the shutdown report and posting it to
+// the webhook of cfg (when set)
+func handleShutdown(statePath string, cfg *ShutdownReportConfig) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		if statePath != "" {
+			if err := saveState(statePath); err != nil {
+				log.Println("Save state failed:", err)
+			} else {
+				log.Printf("State saved to %s\n", statePath)
+			}
+		}
+		report := shutdownReport(s)
+		data, _ := json.Marshal(report)
+		log.Printf("Shutdown report: %s\n", data)
+		if cfg != nil && cfg.URL != "" {
+			postShutdownReport(cfg, data)
+		}
+		log.Printf("Exiting on %v\n", s)
+		os.Exit(0)
+	}()
+}
+
+// shutdownReport collects the totals of the run
+func shutdownReport(s os.Signal) ShutdownReport {
+	now := time.Now()
+	r := ShutdownReport{
+		Signal:        s.String(),
+		Started:       startTime,
+		Stopped:       now,
+		UptimeSeconds: int64(now.Sub(startTime) / time.Second),
+		Errors:        map[string]uint64{"udp_dropped": udpStats.Dropped.Load()},
+		Outbounds:     trafficStats(),
+	}
+	for _, t := range r.Outbounds {
+		r.Sessions += t.Total
+		r.Active += t.Active
+		r.BytesUp += t.BytesUp
+		r.BytesDown += t.BytesDown
+		r.Errors["dial"] += t.Errors
+	}
+	return r
+}
+
+// postShutdownReport sends the report to the webhook, waiting at most its
+// timeout so shutdown is not held up
+func postShutdownReport(cfg *ShutdownReportConfig, data []byte) {
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Shutdown report: %v\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		log.Printf("Shutdown report: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Shutdown report: %s\n", resp.Status)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Environment variables read in sidecar mode
+const (
+	envConfig   = "ROUTING_SOCKS_CONFIG"   // Path to the (ConfigMap mounted) config file
+	envListen   = "ROUTING_SOCKS_LISTEN"   // Overrides "listen"
+	envUpstream = "ROUTING_SOCKS_UPSTREAM" // Overrides "upstream"
+	envHealth   = "ROUTING_SOCKS_HEALTH"   // Overrides "health"
+	envPodInfo  = "ROUTING_SOCKS_PODINFO"  // Downward API volume, default /etc/podinfo
+	envPodNS    = "POD_NAMESPACE"          // Downward API metadata.namespace
+)
+
+// defaultSidecarHealth is the probe address used in sidecar mode when none
+// is configured
+const defaultSidecarHealth = ":9081"
+
+// PodInfo describes the pod a sidecar runs in, read from the downward API
+type PodInfo struct {
+	Namespace string
+	Labels    map[string]string
+}
+
+// podInfo is set in sidecar mode and used by label:/namespace: rules
+var podInfo *PodInfo
+
+// ready is reported by the /readyz endpoint
+var ready atomic.Bool
+
+// applySidecarEnv overrides config values with those set in the environment
+func applySidecarEnv(cfg *Config) {
+	if v := os.Getenv(envListen); v != "" {
+		cfg.Listen = v
+	}
+	if v := os.Getenv(envUpstream); v != "" {
+		cfg.Upstream = v
+	}
+	if v := os.Getenv(envHealth); v != "" {
+		cfg.Health = v
+	}
+	if cfg.Health == "" {
+		cfg.Health = defaultSidecarHealth
+	}
+}
+
+// loadPodInfo reads the namespace and labels exposed by the downward API.
+// Missing files are not an error, the pod simply has no labels.
+func loadPodInfo() (*PodInfo, error) {
+	dir := os.Getenv(envPodInfo)
+	if dir == "" {
+		dir = "/etc/podinfo"
+	}
+	info := &PodInfo{Namespace: os.Getenv(envPodNS), Labels: map[string]string{}}
+	if info.Namespace == "" {
+		if b, err := os.ReadFile(filepath.Join(dir, "namespace")); err == nil {
+			info.Namespace = strings.TrimSpace(string(b))
+		}
+	}
+	f, err := os.Open(filepath.Join(dir, "labels"))
+	if os.IsNotExist(err) {
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// One label per line: key="value"
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label line %q", line)
+		}
+		if uq, err := strconv.Unquote(v); err == nil {
+			v = uq
+		}
+		info.Labels[k] = v
+	}
+	return info, scanner.Err()
+}
+
+// podMatcher is a rule condition on the pod the sidecar serves; it has the
+// same result for every connection
+type podMatcher bool
+
+func (p podMatcher) Match(m *Metadata) bool {
+	return bool(p)
+}
+
+// parsePodMatcher handles "label:key=value" and "namespace:name" matchers
+func parsePodMatcher(kind, value string) (Matcher, error) {
+	if podInfo == nil {
+		return nil, fmt.Errorf("%s: rules are only available in sidecar mode", kind)
+	}
+	if kind == "namespace" {
+		return podMatcher(podInfo.Namespace == value), nil
+	}
+	k, v, ok := strings.Cut(value, "=")
+	if !ok {
+		_, exists := podInfo.Labels[k]
+		return podMatcher(exists), nil
+	}
+	return podMatcher(podInfo.Labels[k] == v), nil
+}
+
+// serveHealth runs the liveness (/healthz) and readiness (/readyz) endpoints
+func serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+	log.Printf("Health endpoints on %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("Health server failed:", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Scenario is a scripted simulation loaded with -simulate. DNS answers and
+// outbound behaviour come from the script and time is virtual, so a run
+// with the same seed always makes the same decisions.
+type Scenario struct {
+	Seed      int64                   `json:"seed"`
+	Start     time.Time               `json:"start"`     // Virtual start time, default now
+	DNS       map[string][]string     `json:"dns"`       // Answers by host, an empty list is NXDOMAIN
+	Outbounds map[string]*SimOutbound `json:"outbounds"` // Behaviour by outbound tag
+	Steps     []SimStep               `json:"steps"`
+
+	rand *rand.Rand
+	now  time.Time
+}
+
+// SimOutbound is the simulated behaviour of an outbound
+type SimOutbound struct {
+	Down    bool     `json:"down"`    // Every dial fails
+	Latency Duration `json:"latency"` // Connection setup time
+	Jitter  Duration `json:"jitter"`  // Random extra setup time, up to this much
+	Loss    float64  `json:"loss"`    // Probability a dial fails
+}
+
+// SimStep is one step of a scenario; set exactly one of its actions
+type SimStep struct {
+	Connect  string              `json:"connect,omitempty"`  // Route and dial host:port
+	Expect   string              `json:"expect,omitempty"`   // Expected outbound tag for Connect, or "fail"
+	Advance  Duration            `json:"advance,omitempty"`  // Move the virtual clock forward
+	DNS      map[string][]string `json:"dns,omitempty"`      // Replace DNS answers for these hosts
+	Outbound string              `json:"outbound,omitempty"` // Outbound to change ...
+	Set      *SimOutbound        `json:"set,omitempty"`      // ... to this behaviour
+}
+
+// loadScenario reads a scenario file
+func loadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scenario{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+	if s.Seed == 0 {
+		s.Seed = 1
+	}
+	if s.Start.IsZero() {
+		s.Start = time.Now()
+	}
+	if s.DNS == nil {
+		s.DNS = map[string][]string{}
+	}
+	if s.Outbounds == nil {
+		s.Outbounds = map[string]*SimOutbound{}
+	}
+	s.rand = rand.New(rand.NewSource(s.Seed))
+	s.now = s.Start
+	return s, nil
+}
+
+// install replaces the resolver, clock and outbounds with simulated ones
+func (s *Scenario) install() {
+	resolver = simResolver{s}
+	dnsServerResolver = func(string) Resolver { return simResolver{s} }
+	clock = func() time.Time { return s.now }
+	for tag := range outbounds {
+		if tag != "reject" {
+			outbounds[tag] = &simOutbound{scenario: s, tag: tag}
+		}
+	}
+	// Keep the per-connection logging out of the report
+	log.SetOutput(io.Discard)
+}
+
+// run executes the steps, printing one line per connection, and reports
+// whether all expectations held
+func (s *Scenario) run(router *Router) bool {
+	ok := true
+	for i, step := range s.Steps {
+		switch {
+		case step.Connect != "":
+			dest, err := parseAddr(step.Connect)
+			if err != nil {
+				fmt.Printf("step %d: %v\n", i+1, err)
+				ok = false
+				continue
+			}
+			m := newMetadata(nil, dest)
+			conn, tag, err := dialRoute(router, m)
+			result := tag
+			if err == errRejected {
+				fmt.Printf("%10s  %-32s -> %-10s rejected", s.elapsed(), step.Connect, tag)
+			} else if err != nil {
+				result = "fail"
+				fmt.Printf("%10s  %-32s -> %-10s error: %v", s.elapsed(), step.Connect, tag, err)
+			} else {
+				conn.Close()
+				fmt.Printf("%10s  %-32s -> %-10s ok", s.elapsed(), step.Connect, tag)
+			}
+			if step.Expect != "" && step.Expect != result {
+				fmt.Printf("  FAIL: expected %s", step.Expect)
+				ok = false
+			}
+			fmt.Println()
+		case step.Advance != 0:
+			s.now = s.now.Add(time.Duration(step.Advance))
+		case step.DNS != nil:
+			for host, ips := range step.DNS {
+				s.DNS[host] = ips
+			}
+		case step.Outbound != "" && step.Set != nil:
+			s.Outbounds[step.Outbound] = step.Set
+		default:
+			fmt.Printf("step %d: no action\n", i+1)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// elapsed formats the virtual time since the start of the scenario
+func (s *Scenario) elapsed() string {
+	return "+" + s.now.Sub(s.Start).Round(time.Millisecond).String()
+}
+
+// simResolver answers lookups from the scenario
+type simResolver struct {
+	s *Scenario
+}
+
+func (r simResolver) LookupIP(host string) ([]net.IP, error) {
+	answers, ok := r.s.DNS[strings.ToLower(host)]
+	if !ok || len(answers) == 0 {
+		return nil, fmt.Errorf("lookup %s: no such host", host)
+	}
+	var ips []net.IP
+	for _, a := range answers {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("lookup %s: invalid address %q in scenario", host, a)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// simOutbound dials according to the scenario, advancing the virtual clock
+// by the connection setup time
+type simOutbound struct {
+	scenario *Scenario
+	tag      string
+}
+
+func (o *simOutbound) String() string {
+	return "simulated " + o.tag
+}
+
+func (o *simOutbound) Dial(m *Metadata) (net.Conn, error) {
+	s := o.scenario
+	b := s.Outbounds[o.tag]
+	if b == nil {
+		b = &SimOutbound{}
+	}
+	if b.Down {
+		return nil, fmt.Errorf("%s: connection refused (simulated)", o.tag)
+	}
+	latency := time.Duration(b.Latency)
+	if b.Jitter > 0 {
+		latency += time.Duration(s.rand.Int63n(int64(b.Jitter)))
+	}
+	s.now = s.now.Add(latency)
+	if b.Loss > 0 && s.rand.Float64() < b.Loss {
+		return nil, fmt.Errorf("%s: i/o timeout (simulated)", o.tag)
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// SniffConfig enables peeking at raw-IP connections to recover the domain
+type SniffConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Override bool     `json:"override"` // Send the sniffed domain to upstream proxies instead of the IP
+	Timeout  Duration `json:"timeout"`  // How long to wait for the client's first bytes, default 300ms
+}
+
+// maxSniffSize bounds how much of the stream is buffered while sniffing
+const maxSniffSize = 16 * 1024
+
+// errSniffMore means the data seen so far is an incomplete header
+var errSniffMore = errors.New("need more data")
+
+// sniffHost peeks at the first bytes the client sends and extracts the TLS
+// SNI or HTTP Host from them, empty when none was found. The bytes stay
+// unread on the connection for the destination.
+func sniffHost(conn *peekConn, timeout time.Duration) string {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		buf, err := conn.peek(maxSniffSize)
+		if len(buf) > 0 {
+			host, tlsErr := sniffTLSServerName(buf)
+			if tlsErr == nil {
+				return host
+			}
+			host, httpErr := sniffHTTPHost(buf)
+			if httpErr == nil {
+				return host
+			}
+			if tlsErr != errSniffMore && httpErr != errSniffMore {
+				return ""
+			}
+		}
+		if err != nil {
+			return ""
+		}
+	}
+}
+
+// sniffTLSServerName extracts the server_name extension of a ClientHello
+func sniffTLSServerName(b []byte) (string, error) {
+	if len(b) < 5 {
+		if len(b) > 0 && b[0] != 0x16 {
+			return "", errors.New("not TLS")
+		}
+		return "", errSniffMore
+	}
+	if b[0] != 0x16 || b[1] != 0x03 {
+		return "", errors.New("not TLS")
+	}
+	recordLen := int(binary.BigEndian.Uint16(b[3:5]))
+	if len(b) < 5+recordLen {
+		return "", errSniffMore
+	}
+	hs := b[5 : 5+recordLen]
+	if len(hs) < 4 || hs[0] != 0x01 {
+		return "", errors.New("not a ClientHello")
+	}
+	hello := hs[4:]
+	if n := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3]); n < len(hello) {
+		hello = hello[:n]
+	}
+
+	// client_version(2) random(32) session_id cipher_suites compression_methods
+	p := 34
+	if len(hello) < p+1 {
+		return "", errors.New("short ClientHello")
+	}
+	p += 1 + int(hello[p])
+	if len(hello) < p+2 {
+		return "", errors.New("short ClientHello")
+	}
+	p += 2 + int(binary.BigEndian.Uint16(hello[p:]))
+	if len(hello) < p+1 {
+		return "", errors.New("short ClientHello")
+	}
+	p += 1 + int(hello[p])
+	if len(hello) < p+2 {
+		return "", errors.New("no extensions")
+	}
+	ext := hello[p+2:]
+	if n := int(binary.BigEndian.Uint16(hello[p:])); n < len(ext) {
+		ext = ext[:n]
+	}
+
+	for len(ext) >= 4 {
+		typ := binary.BigEndian.Uint16(ext)
+		n := int(binary.BigEndian.Uint16(ext[2:]))
+		if len(ext) < 4+n {
+			break
+		}
+		data := ext[4 : 4+n]
+		ext = ext[4+n:]
+		if typ != 0 { // server_name
+			continue
+		}
+		// server_name_list: length(2), then name_type(1) length(2) name
+		if len(data) < 2 {
+			break
+		}
+		list := data[2:]
+		for len(list) >= 3 {
+			nameLen := int(binary.BigEndian.Uint16(list[1:]))
+			if len(list) < 3+nameLen {
+				break
+			}
+			if list[0] == 0 { // host_name
+				return strings.ToLower(string(list[3 : 3+nameLen])), nil
+			}
+			list = list[3+nameLen:]
+		}
+	}
+	return "", errors.New("no server name")
+}
+
+// httpMethods are the request methods recognised when sniffing HTTP
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE "}
+
+// sniffHTTPHost extracts the Host header of a plain HTTP request
+func sniffHTTPHost(b []byte) (string, error) {
+	isHTTP := false
+	for _, m := range httpMethods {
+		n := min(len(m), len(b))
+		if string(b[:n]) == m[:n] {
+			isHTTP = true
+			if len(b) < len(m) {
+				return "", errSniffMore
+			}
+			break
+		}
+	}
+	if !isHTTP {
+		return "", errors.New("not HTTP")
+	}
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", errSniffMore
+	}
+	for _, line := range strings.Split(string(b[:end]), "\r\n")[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.ToLower(strings.Trim(host, "[]")), nil
+	}
+	return "", errors.New("no Host header")
+}
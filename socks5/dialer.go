@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ContextDialer opens the connection to the proxy; *net.Dialer is one
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dialer connects through a SOCKS5 proxy. Its DialContext can be used
+// wherever one is expected, e.g. as http.Transport.DialContext.
+type Dialer struct {
+	Proxy   string        // Address of the proxy, "host:port"
+	Auth    *Auth         // Credentials, nil for no authentication
+	Forward ContextDialer // Opens the connection to the proxy, nil for a plain net.Dialer
+	Timeout time.Duration // Bounds the whole dial when ctx has no earlier deadline, 0 for none
+}
+
+// Dial connects to address through the proxy
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the proxy; only TCP networks
+// are supported. Domains are sent to the proxy to resolve.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("socks5: network not supported")}
+	}
+	dest, err := ParseAddr(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	conn, _, err := d.negotiate(ctx, CmdConnect, dest)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: dest, Err: err}
+	}
+	return conn, nil
+}
+
+// negotiate connects to the proxy and sends a request, honoring the
+// context and Timeout; the connection is closed on failure
+func (d *Dialer) negotiate(ctx context.Context, cmd byte, dest Addr) (net.Conn, Addr, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	conn, err := forward.DialContext(ctx, "tcp", d.Proxy)
+	if err != nil {
+		return nil, Addr{}, err
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+	// Unblock the handshake when ctx is canceled
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	bound, err := d.request(conn, cmd, dest)
+	close(done)
+	<-stopped
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		} else if hasDeadline && !time.Now().Before(deadline) {
+			// The connection timed out before ctx noticed its deadline
+			err = context.DeadlineExceeded
+		}
+		return nil, Addr{}, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+func (d *Dialer) request(conn net.Conn, cmd byte, dest Addr) (Addr, error) {
+	if err := Handshake(conn, d.Auth); err != nil {
+		return Addr{}, err
+	}
+	return Request(conn, cmd, dest)
+}
@@ -0,0 +1,252 @@
+// Package socks5 is a SOCKS5 client (RFC 1928) with username/password
+// authentication (RFC 1929): CONNECT through a Dialer, UDP ASSOCIATE
+// through a UDPConn, and the protocol steps on a connection for callers
+// that set up the connection to the proxy themselves (TLS, tunnels,
+// proxy chains).
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Commands of a request
+const (
+	CmdConnect      byte = 0x01
+	CmdBind         byte = 0x02
+	CmdUDPAssociate byte = 0x03
+)
+
+// Address types
+const (
+	AtypIPv4   byte = 0x01
+	AtypDomain byte = 0x03
+	AtypIPv6   byte = 0x04
+)
+
+// Addr is an address in SOCKS5 form
+type Addr struct {
+	Type byte   // AtypIPv4, AtypDomain or AtypIPv6
+	Host []byte // 4 or 16 address bytes, or the domain name
+	Port uint16
+}
+
+// ParseAddr parses "host:port"; literal IPs become IPv4 or IPv6 addresses,
+// anything else a domain
+func ParseAddr(s string) (Addr, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return Addr{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return Addr{}, fmt.Errorf("socks5: invalid port in %q", s)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return Addr{Type: AtypIPv4, Host: ip4, Port: uint16(port)}, nil
+		}
+		return Addr{Type: AtypIPv6, Host: ip, Port: uint16(port)}, nil
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return Addr{}, fmt.Errorf("socks5: invalid host name in %q", s)
+	}
+	return Addr{Type: AtypDomain, Host: []byte(host), Port: uint16(port)}, nil
+}
+
+// String formats the address as "host:port"
+func (a Addr) String() string {
+	port := strconv.Itoa(int(a.Port))
+	if a.Type == AtypDomain {
+		return net.JoinHostPort(string(a.Host), port)
+	}
+	return net.JoinHostPort(net.IP(a.Host).String(), port)
+}
+
+// Network implements net.Addr
+func (a Addr) Network() string {
+	return "socks5"
+}
+
+// AppendAddr appends an address in wire form: type, address, port
+func AppendAddr(b []byte, a Addr) []byte {
+	b = append(b, a.Type)
+	if a.Type == AtypDomain {
+		b = append(b, byte(len(a.Host)))
+	}
+	b = append(b, a.Host...)
+	return binary.BigEndian.AppendUint16(b, a.Port)
+}
+
+// ReadAddr reads an address in wire form
+func ReadAddr(r io.Reader) (Addr, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:1]); err != nil {
+		return Addr{}, err
+	}
+	var n int
+	switch head[0] {
+	case AtypIPv4:
+		n = 4
+	case AtypIPv6:
+		n = 16
+	case AtypDomain:
+		if _, err := io.ReadFull(r, head[1:]); err != nil {
+			return Addr{}, err
+		}
+		n = int(head[1])
+	default:
+		return Addr{}, fmt.Errorf("socks5: unsupported address type %d", head[0])
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Addr{}, err
+	}
+	return Addr{Type: head[0], Host: buf[:n], Port: binary.BigEndian.Uint16(buf[n:])}, nil
+}
+
+// parseAddrBytes parses an address in wire form at the start of b and
+// returns its length
+func parseAddrBytes(b []byte) (Addr, int, error) {
+	if len(b) < 1 {
+		return Addr{}, 0, errShortHeader
+	}
+	var n int
+	switch b[0] {
+	case AtypIPv4:
+		n = 1 + 4
+	case AtypIPv6:
+		n = 1 + 16
+	case AtypDomain:
+		if len(b) < 2 {
+			return Addr{}, 0, errShortHeader
+		}
+		n = 2 + int(b[1])
+	default:
+		return Addr{}, 0, fmt.Errorf("socks5: unsupported address type %d", b[0])
+	}
+	if len(b) < n+2 {
+		return Addr{}, 0, errShortHeader
+	}
+	host := b[1:n]
+	if b[0] == AtypDomain {
+		host = b[2:n]
+	}
+	return Addr{Type: b[0], Host: host, Port: binary.BigEndian.Uint16(b[n:])}, n + 2, nil
+}
+
+var errShortHeader = errors.New("socks5: short datagram header")
+
+// Errors of the method negotiation
+var (
+	ErrNotSOCKS5     = errors.New("socks5: server is not a SOCKS5 proxy")
+	ErrAuthRequired  = errors.New("socks5: server requires authentication")
+	ErrAuthRejected  = errors.New("socks5: server rejected the credentials")
+	ErrNoMethod      = errors.New("socks5: server accepted none of the authentication methods")
+	errLongAuthField = errors.New("socks5: username or password longer than 255 bytes")
+)
+
+// Auth holds username/password credentials
+type Auth struct {
+	Username string
+	Password string
+}
+
+// Handshake completes the method negotiation on a connection to a SOCKS5
+// proxy, authenticating with username/password when auth is set. The
+// connection is left open on failure; closing it is up to the caller.
+func Handshake(conn net.Conn, auth *Auth) error {
+	methods := []byte{0x05, 0x01, 0x00}
+	if auth != nil {
+		if len(auth.Username) > 255 || len(auth.Password) > 255 {
+			return errLongAuthField
+		}
+		methods = []byte{0x05, 0x02, 0x00, 0x02}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != 0x05 {
+		return ErrNotSOCKS5
+	}
+	switch {
+	case resp[1] == 0x00:
+		return nil
+	case resp[1] == 0x02 && auth != nil:
+		req := []byte{0x01, byte(len(auth.Username))}
+		req = append(req, auth.Username...)
+		req = append(req, byte(len(auth.Password)))
+		req = append(req, auth.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return ErrAuthRejected
+		}
+		return nil
+	case auth == nil && (resp[1] == 0x02 || resp[1] == 0xff):
+		return ErrAuthRequired
+	}
+	return ErrNoMethod
+}
+
+// ReplyError is a request refused by the proxy
+type ReplyError struct {
+	Code byte
+}
+
+// replyTexts are the RFC 1928 reply meanings
+var replyTexts = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+func (e *ReplyError) Error() string {
+	if text, ok := replyTexts[e.Code]; ok {
+		return fmt.Sprintf("socks5: request failed: %d (%s)", e.Code, text)
+	}
+	return fmt.Sprintf("socks5: request failed: %d", e.Code)
+}
+
+// Request sends a request on a negotiated connection and reads the reply,
+// returning the address the proxy bound. A refusal is a *ReplyError, read
+// in full so the connection is positioned after the reply. The connection
+// is left open on failure; closing it is up to the caller.
+func Request(conn net.Conn, cmd byte, dest Addr) (Addr, error) {
+	req := AppendAddr([]byte{0x05, cmd, 0x00}, dest)
+	if _, err := conn.Write(req); err != nil {
+		return Addr{}, err
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return Addr{}, err
+	}
+	if reply[0] != 0x05 {
+		return Addr{}, ErrNotSOCKS5
+	}
+	bound, err := ReadAddr(conn)
+	if err != nil {
+		return Addr{}, err
+	}
+	if reply[1] != 0x00 {
+		return Addr{}, &ReplyError{Code: reply[1]}
+	}
+	return bound, nil
+}
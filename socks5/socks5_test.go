@@ -0,0 +1,386 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is an in-process SOCKS5 proxy answering one scripted way
+type testServer struct {
+	auth  *Auth // Required credentials, nil for NO AUTH
+	rep   byte  // Reply code of requests
+	stall bool  // Accept, then never answer the greeting
+
+	ln    net.Listener
+	relay *net.UDPConn // Echoes datagrams of UDP associations
+	dests chan Addr    // Destinations of the requests
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startTestServer(t *testing.T, s *testServer) *testServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ln = ln
+	s.dests = make(chan Addr, 16)
+	t.Cleanup(func() {
+		ln.Close()
+		s.mu.Lock()
+		for _, conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	if s.stall {
+		io.Copy(io.Discard, conn)
+		return
+	}
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil || head[0] != 0x05 {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	want := byte(0x00)
+	if s.auth != nil {
+		want = 0x02
+	}
+	if !bytes.Contains(methods, []byte{want}) {
+		conn.Write([]byte{0x05, 0xff})
+		return
+	}
+	conn.Write([]byte{0x05, want})
+	if s.auth != nil {
+		user, pass, err := readUserPass(conn)
+		if err != nil {
+			return
+		}
+		if user != s.auth.Username || pass != s.auth.Password {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+	var req [3]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return
+	}
+	dest, err := ReadAddr(conn)
+	if err != nil {
+		return
+	}
+	s.dests <- dest
+	bound := Addr{Type: AtypIPv4, Host: net.IPv4(127, 0, 0, 1).To4()}
+	if req[1] == CmdUDPAssociate && s.relay != nil {
+		bound.Port = uint16(s.relay.LocalAddr().(*net.UDPAddr).Port)
+	}
+	conn.Write(AppendAddr([]byte{0x05, s.rep, 0x00}, bound))
+	if s.rep != 0 {
+		return
+	}
+	// Echo the stream of CONNECT; hold UDP associations open
+	io.Copy(conn, conn)
+}
+
+func readUserPass(r io.Reader) (string, string, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return "", "", err
+	}
+	user := make([]byte, l[1])
+	if _, err := io.ReadFull(r, user); err != nil {
+		return "", "", err
+	}
+	if _, err := io.ReadFull(r, l[:1]); err != nil {
+		return "", "", err
+	}
+	pass := make([]byte, l[0])
+	if _, err := io.ReadFull(r, pass); err != nil {
+		return "", "", err
+	}
+	return string(user), string(pass), nil
+}
+
+func TestDialHandshake(t *testing.T) {
+	creds := &Auth{Username: "alice", Password: "secret"}
+	tests := []struct {
+		name       string
+		serverAuth *Auth
+		clientAuth *Auth
+		dest       string
+		want       Addr
+	}{
+		{"no auth", nil, nil, "example.com:443", Addr{Type: AtypDomain, Host: []byte("example.com"), Port: 443}},
+		{"no auth offered with credentials", nil, creds, "192.0.2.1:80", Addr{Type: AtypIPv4, Host: net.IPv4(192, 0, 2, 1).To4(), Port: 80}},
+		{"username/password", creds, creds, "[2001:db8::1]:22", Addr{Type: AtypIPv6, Host: net.ParseIP("2001:db8::1"), Port: 22}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startTestServer(t, &testServer{auth: tt.serverAuth})
+			d := &Dialer{Proxy: s.addr(), Auth: tt.clientAuth}
+			conn, err := d.Dial("tcp", tt.dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := <-s.dests; got.Type != tt.want.Type || !bytes.Equal(got.Host, tt.want.Host) || got.Port != tt.want.Port {
+				t.Errorf("server got destination %v, want %v", got, tt.want)
+			}
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Errorf("read %q, %v after the handshake, want the echoed \"ping\"", buf, err)
+			}
+		})
+	}
+}
+
+func TestDialAuthErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverAuth *Auth
+		clientAuth *Auth
+		want       error
+	}{
+		{"wrong password", &Auth{"alice", "secret"}, &Auth{"alice", "guess"}, ErrAuthRejected},
+		{"unknown user", &Auth{"alice", "secret"}, &Auth{"bob", "secret"}, ErrAuthRejected},
+		{"credentials missing", &Auth{"alice", "secret"}, nil, ErrAuthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startTestServer(t, &testServer{auth: tt.serverAuth})
+			d := &Dialer{Proxy: s.addr(), Auth: tt.clientAuth}
+			conn, err := d.Dial("tcp", "example.com:80")
+			if err == nil {
+				conn.Close()
+				t.Fatal("dial succeeded")
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandshakeLongCredentials(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	long := string(make([]byte, 256))
+	if err := Handshake(client, &Auth{Username: long}); err != errLongAuthField {
+		t.Errorf("got %v, want %v", err, errLongAuthField)
+	}
+}
+
+func TestDialReplyError(t *testing.T) {
+	for _, code := range []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x42} {
+		s := startTestServer(t, &testServer{rep: code})
+		d := &Dialer{Proxy: s.addr()}
+		conn, err := d.Dial("tcp", "example.com:80")
+		if err == nil {
+			conn.Close()
+			t.Fatalf("REP %d: dial succeeded", code)
+		}
+		var rerr *ReplyError
+		if !errors.As(err, &rerr) || rerr.Code != code {
+			t.Errorf("REP %d: got %v, want a *ReplyError with that code", code, err)
+		}
+	}
+}
+
+func TestDialContextCanceled(t *testing.T) {
+	s := startTestServer(t, &testServer{stall: true})
+	d := &Dialer{Proxy: s.addr()}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", "example.com:80")
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded")
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("dial returned after %v, not on cancellation", elapsed)
+	}
+}
+
+func TestDialContextDeadline(t *testing.T) {
+	s := startTestServer(t, &testServer{stall: true})
+	tests := []struct {
+		name    string
+		ctx     func() (context.Context, context.CancelFunc)
+		timeout time.Duration
+	}{
+		{"context deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 100*time.Millisecond)
+		}, 0},
+		{"dialer timeout", func() (context.Context, context.CancelFunc) {
+			return context.Background(), func() {}
+		}, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			d := &Dialer{Proxy: s.addr(), Timeout: tt.timeout}
+			start := time.Now()
+			conn, err := d.DialContext(ctx, "tcp", "example.com:80")
+			if err == nil {
+				conn.Close()
+				t.Fatal("dial succeeded")
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("dial returned after %v, not at the deadline", elapsed)
+			}
+		})
+	}
+}
+
+func TestDialUnsupportedNetwork(t *testing.T) {
+	d := &Dialer{Proxy: "127.0.0.1:1"}
+	if _, err := d.Dial("udp", "example.com:53"); err == nil {
+		t.Error("dial of udp succeeded")
+	}
+}
+
+func TestUDPHeaderRoundTrip(t *testing.T) {
+	addrs := []Addr{
+		{Type: AtypIPv4, Host: net.IPv4(192, 0, 2, 1).To4(), Port: 53},
+		{Type: AtypIPv6, Host: net.ParseIP("2001:db8::53"), Port: 5353},
+		{Type: AtypDomain, Host: []byte("dns.example.com"), Port: 853},
+		{Type: AtypDomain, Host: bytes.Repeat([]byte("a"), 255), Port: 65535},
+	}
+	for _, a := range addrs {
+		payload := []byte("payload")
+		b := append(appendUDPHeader(nil, a), payload...)
+		got, gotPayload, err := parseUDPHeader(b)
+		if err != nil {
+			t.Errorf("%v: %v", a, err)
+			continue
+		}
+		if got.Type != a.Type || !bytes.Equal(got.Host, a.Host) || got.Port != a.Port {
+			t.Errorf("decoded %v, want %v", got, a)
+		}
+		if !bytes.Equal(gotPayload, payload) {
+			t.Errorf("%v: payload %q, want %q", a, gotPayload, payload)
+		}
+		// Every truncation of the header is rejected
+		for n := range len(b) - len(payload) {
+			if _, _, err := parseUDPHeader(b[:n]); err == nil {
+				t.Errorf("%v: header truncated to %d bytes accepted", a, n)
+			}
+		}
+	}
+}
+
+func TestUDPHeaderRejects(t *testing.T) {
+	ipv4 := appendUDPHeader(nil, Addr{Type: AtypIPv4, Host: net.IPv4(192, 0, 2, 1).To4(), Port: 53})
+	fragmented := append([]byte(nil), ipv4...)
+	fragmented[2] = 1
+	badType := append([]byte(nil), ipv4...)
+	badType[3] = 0x02
+	tests := []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"fragment 1", fragmented, errFragmented},
+		{"short", []byte{0, 0}, errShortHeader},
+		{"unknown address type", badType, nil},
+	}
+	for _, tt := range tests {
+		_, _, err := parseUDPHeader(tt.b)
+		if err == nil || tt.want != nil && err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestListenUDP(t *testing.T) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	go func() {
+		// Answer every datagram from the destination it was sent to
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			relay.WriteToUDP(buf[:n], from)
+		}
+	}()
+	s := startTestServer(t, &testServer{relay: relay})
+	d := &Dialer{Proxy: s.addr()}
+	conn, err := d.ListenUDP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := <-s.dests; got.Type != AtypIPv4 || !net.IP(got.Host).IsUnspecified() {
+		t.Errorf("association requested for %v, want an unspecified address", got)
+	}
+
+	dests := []net.Addr{
+		Addr{Type: AtypDomain, Host: []byte("example.com"), Port: 53},
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123},
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, dest := range dests {
+		if _, err := conn.WriteTo([]byte("hello"), dest); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "hello" || from.String() != dest.String() {
+			t.Errorf("read %q from %v, want \"hello\" from %v", buf[:n], from, dest)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// UDPConn is a UDP association through a SOCKS5 proxy. It is a
+// net.PacketConn: datagrams written to an address are relayed there by the
+// proxy, and replies are read with their source. The association ends
+// with Close, or when the proxy closes the control connection.
+type UDPConn struct {
+	ctrl  net.Conn     // Control connection, the association lives as long as it
+	conn  *net.UDPConn // Local socket sending to the relay
+	relay *net.UDPAddr // The proxy's relay address
+}
+
+// udpHeaderMax is the longest datagram header: reserved, fragment and the
+// longest address
+const udpHeaderMax = 3 + 1 + 1 + 255 + 2
+
+// ListenUDP requests a UDP association from the proxy
+func (d *Dialer) ListenUDP(ctx context.Context) (*UDPConn, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	// The client address is not known before the proxy sees the first
+	// datagram, so it is left unspecified
+	ctrl, bound, err := d.negotiate(ctx, CmdUDPAssociate, Addr{Type: AtypIPv4, Host: net.IPv4zero.To4()})
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "listen", Net: "udp", Err: err}
+	}
+	relay, err := relayAddr(ctx, ctrl, bound)
+	if err != nil {
+		ctrl.Close()
+		conn.Close()
+		return nil, &net.OpError{Op: "listen", Net: "udp", Err: err}
+	}
+	c := &UDPConn{ctrl: ctrl, conn: conn, relay: relay}
+	go c.watch()
+	return c, nil
+}
+
+// relayAddr returns the address to send datagrams to: the address the
+// proxy bound, or the proxy's own address when it bound an unspecified one
+func relayAddr(ctx context.Context, ctrl net.Conn, bound Addr) (*net.UDPAddr, error) {
+	switch bound.Type {
+	case AtypDomain:
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", string(bound.Host))
+		if err != nil {
+			return nil, err
+		}
+		return &net.UDPAddr{IP: ips[0], Port: int(bound.Port)}, nil
+	}
+	ip := net.IP(bound.Host)
+	if ip.IsUnspecified() {
+		if tcp, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			ip = tcp.IP
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(bound.Port)}, nil
+}
+
+// watch closes the association when the proxy closes the control
+// connection
+func (c *UDPConn) watch() {
+	io.Copy(io.Discard, c.ctrl)
+	c.conn.Close()
+}
+
+// WriteTo sends a datagram to addr through the proxy; domains are
+// resolved by the proxy
+func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	var dest Addr
+	switch a := addr.(type) {
+	case Addr:
+		dest = a
+	case *net.UDPAddr:
+		dest = fromIP(a.IP, a.Port)
+	default:
+		var err error
+		if dest, err = ParseAddr(addr.String()); err != nil {
+			return 0, err
+		}
+	}
+	buf := appendUDPHeader(make([]byte, 0, udpHeaderMax+len(p)), dest)
+	buf = append(buf, p...)
+	if _, err := c.conn.WriteToUDP(buf, c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadFrom reads a datagram relayed by the proxy; the source is a
+// *net.UDPAddr, or an Addr for a domain. Fragmented datagrams, which
+// proxies rarely send, are dropped.
+func (c *UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, udpHeaderMax+len(p))
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(c.relay.IP) {
+			continue
+		}
+		src, payload, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+		n = copy(p, payload)
+		if src.Type == AtypDomain {
+			src.Host = append([]byte(nil), src.Host...)
+			return n, src, nil
+		}
+		return n, &net.UDPAddr{IP: append(net.IP(nil), src.Host...), Port: int(src.Port)}, nil
+	}
+}
+
+// errFragmented is a datagram with a non-zero FRAG field
+var errFragmented = errors.New("socks5: fragmented datagram")
+
+// appendUDPHeader appends the header of a datagram to or from dest:
+// reserved, fragment 0 and the address
+func appendUDPHeader(b []byte, dest Addr) []byte {
+	return AppendAddr(append(b, 0, 0, 0), dest)
+}
+
+// parseUDPHeader splits a relayed datagram into its address and payload
+func parseUDPHeader(b []byte) (Addr, []byte, error) {
+	if len(b) < 3 {
+		return Addr{}, nil, errShortHeader
+	}
+	if b[2] != 0 {
+		return Addr{}, nil, errFragmented
+	}
+	addr, n, err := parseAddrBytes(b[3:])
+	if err != nil {
+		return Addr{}, nil, err
+	}
+	return addr, b[3+n:], nil
+}
+
+func fromIP(ip net.IP, port int) Addr {
+	if ip4 := ip.To4(); ip4 != nil {
+		return Addr{Type: AtypIPv4, Host: ip4, Port: uint16(port)}
+	}
+	return Addr{Type: AtypIPv6, Host: ip.To16(), Port: uint16(port)}
+}
+
+// Close ends the association
+func (c *UDPConn) Close() error {
+	err := c.conn.Close()
+	if cerr := c.ctrl.Close(); err == nil || errors.Is(err, net.ErrClosed) {
+		err = cerr
+	}
+	return err
+}
+
+// LocalAddr returns the local address datagrams are sent from
+func (c *UDPConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RelayAddr returns the proxy's relay address
+func (c *UDPConn) RelayAddr() net.Addr {
+	return c.relay
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// softFailRetry is how often unavailable data is retried in soft-fail mode
+const softFailRetry = time.Minute
+
+// unavailableError marks data that could not be loaded (missing file,
+// failed download), as opposed to an invalid configuration
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string { return e.err.Error() }
+func (e *unavailableError) Unwrap() error { return e.err }
+
+// pendingMatchers are retried in the background once routing starts
+var pendingMatchers []*pendingMatcher
+
+// pendingMatcher stands in for a matcher whose data is unavailable at
+// startup; it matches nothing until a background retry builds it
+type pendingMatcher struct {
+	desc    string
+	build   func() (Matcher, error)
+	matcher atomic.Pointer[Matcher]
+}
+
+// newPendingMatcher registers a matcher to be built later
+func newPendingMatcher(desc string, build func() (Matcher, error)) *pendingMatcher {
+	p := &pendingMatcher{desc: desc, build: build}
+	pendingMatchers = append(pendingMatchers, p)
+	return p
+}
+
+func (p *pendingMatcher) Match(m *Metadata) bool {
+	if matcher := p.matcher.Load(); matcher != nil {
+		return (*matcher).Match(m)
+	}
+	return false
+}
+
+func (p *pendingMatcher) entries() int {
+	if matcher := p.matcher.Load(); matcher != nil {
+		return countEntries(*matcher)
+	}
+	return 0
+}
+
+// retryLoop builds the matcher every softFailRetry until it succeeds
+func (p *pendingMatcher) retryLoop(onReady func()) {
+	for {
+		time.Sleep(softFailRetry)
+		matcher, err := p.build()
+		if err != nil {
+			log.Printf("%s: still unavailable: %v\n", p.desc, err)
+			continue
+		}
+		p.matcher.Store(&matcher)
+		onReady()
+		log.Printf("%s: loaded\n", p.desc)
+		return
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SpeedTestConfig sets the test server of the speed tests run through the
+// admin API
+type SpeedTestConfig struct {
+	DownloadURL string   `json:"download_url"` // Fetched for the download test, default Cloudflare's speed test
+	UploadURL   string   `json:"upload_url"`   // Receives a POST for the upload test, default Cloudflare's; "none" to skip
+	UploadSize  int64    `json:"upload_size"`  // Most bytes uploaded, default 25 MB
+	Duration    Duration `json:"duration"`     // Longest each direction runs, default 10s
+}
+
+// SpeedTestResult is the outcome of a speed test through an outbound;
+// rates are in megabits per second
+type SpeedTestResult struct {
+	Outbound      string    `json:"outbound"`
+	Time          time.Time `json:"time"`
+	LatencyMS     int64     `json:"latency_ms"` // Time to the download's response headers
+	DownloadBytes int64     `json:"download_bytes"`
+	DownloadMbps  float64   `json:"download_mbps"`
+	UploadBytes   int64     `json:"upload_bytes,omitempty"`
+	UploadMbps    float64   `json:"upload_mbps,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// speedTests runs one speed test at a time, since parallel tests would
+// share the uplink, and keeps the last result per outbound
+var speedTests = struct {
+	cfg     SpeedTestConfig
+	run     sync.Mutex
+	mu      sync.Mutex
+	results map[string]SpeedTestResult
+}{results: map[string]SpeedTestResult{}}
+
+// setSpeedTest applies the defaults of the speed test settings
+func setSpeedTest(cfg *SpeedTestConfig) {
+	st := SpeedTestConfig{}
+	if cfg != nil {
+		st = *cfg
+	}
+	if st.DownloadURL == "" {
+		st.DownloadURL = "https://speed.cloudflare.com/__down?bytes=100000000"
+	}
+	if st.UploadURL == "" {
+		st.UploadURL = "https://speed.cloudflare.com/__up"
+	}
+	if st.UploadSize <= 0 {
+		st.UploadSize = 25 << 20
+	}
+	if st.Duration <= 0 {
+		st.Duration = Duration(10 * time.Second)
+	}
+	speedTests.cfg = st
+}
+
+// runSpeedTest measures download and upload throughput through an
+// outbound
+func runSpeedTest(tag string) SpeedTestResult {
+	cfg := speedTests.cfg
+	r := SpeedTestResult{Outbound: tag, Time: time.Now()}
+	limit := time.Duration(cfg.Duration)
+	client := outboundClient(outbounds[tag], limit+30*time.Second)
+
+	start := time.Now()
+	resp, err := client.Get(cfg.DownloadURL)
+	if err != nil {
+		r.Error = fmt.Sprintf("download: %v", err)
+		return r
+	}
+	r.LatencyMS = time.Since(start).Milliseconds()
+	start = time.Now()
+	r.DownloadBytes, err = io.Copy(io.Discard, &deadlineReader{resp.Body, start.Add(limit)})
+	resp.Body.Close()
+	r.DownloadMbps = mbps(r.DownloadBytes, time.Since(start))
+	if err != nil {
+		r.Error = fmt.Sprintf("download: %v", err)
+		return r
+	}
+	if resp.StatusCode != http.StatusOK {
+		r.Error = fmt.Sprintf("download: %s", resp.Status)
+		return r
+	}
+
+	if cfg.UploadURL == "none" {
+		return r
+	}
+	body := &zeroReader{left: cfg.UploadSize}
+	start = time.Now()
+	body.deadline = start.Add(limit)
+	resp, err = client.Post(cfg.UploadURL, "application/octet-stream", body)
+	r.UploadBytes = cfg.UploadSize - body.left
+	r.UploadMbps = mbps(r.UploadBytes, time.Since(start))
+	if err != nil {
+		r.Error = fmt.Sprintf("upload: %v", err)
+		return r
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		r.Error = fmt.Sprintf("upload: %s", resp.Status)
+	}
+	return r
+}
+
+func mbps(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n*8) / d.Seconds() / 1e6
+}
+
+// deadlineReader ends a read stream at a deadline
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if time.Now().After(d.deadline) {
+		return 0, io.EOF
+	}
+	return d.r.Read(p)
+}
+
+// zeroReader is an upload body of up to left zero bytes that ends at a
+// deadline
+type zeroReader struct {
+	left     int64
+	deadline time.Time
+}
+
+func (z *zeroReader) Read(p []byte) (int, error) {
+	if z.left <= 0 || time.Now().After(z.deadline) {
+		return 0, io.EOF
+	}
+	n := min(int64(len(p)), z.left)
+	clear(p[:n])
+	z.left -= n
+	return int(n), nil
+}
+
+// handleSpeedTest lists the last results (GET) or runs a test through an
+// outbound and returns its result (POST ?outbound=)
+func handleSpeedTest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		speedTests.mu.Lock()
+		defer speedTests.mu.Unlock()
+		writeJSON(w, speedTests.results)
+	case http.MethodPost:
+		tag := r.URL.Query().Get("outbound")
+		if _, ok := outbounds[tag]; !ok || tag == "reject" {
+			http.Error(w, "unknown outbound", http.StatusNotFound)
+			return
+		}
+		if !speedTests.run.TryLock() {
+			http.Error(w, "a speed test is running", http.StatusConflict)
+			return
+		}
+		defer speedTests.run.Unlock()
+		log.Printf("Speed test through %s\n", tag)
+		result := runSpeedTest(tag)
+		if result.Error != "" {
+			log.Printf("Speed test through %s failed: %s\n", tag, result.Error)
+		} else {
+			log.Printf("Speed test through %s: %.1f Mbit/s down, %.1f Mbit/s up\n", tag, result.DownloadMbps, result.UploadMbps)
+		}
+		speedTests.mu.Lock()
+		speedTests.results[tag] = result
+		speedTests.mu.Unlock()
+		writeJSON(w, result)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
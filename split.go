@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// splitTarget is one outbound of a weighted split
+type splitTarget struct {
+	Outbound string
+	Weight   int
+}
+
+// newSplit validates a rule's "split" weights; targets are sorted by tag so
+// the same destination keeps its outbound across restarts
+func newSplit(weights map[string]int) ([]splitTarget, error) {
+	var targets []splitTarget
+	for tag, w := range weights {
+		if _, ok := outbounds[tag]; !ok {
+			return nil, fmt.Errorf("split: unknown outbound %q", tag)
+		}
+		if w < 0 {
+			return nil, fmt.Errorf("split: negative weight for %q", tag)
+		}
+		if w > 0 {
+			targets = append(targets, splitTarget{Outbound: tag, Weight: w})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("split: no outbound with a positive weight")
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Outbound < targets[j].Outbound })
+	return targets, nil
+}
+
+// pickSplit chooses an outbound by weight, keyed on the destination host
+// (or address) so every connection to it uses the same outbound
+func pickSplit(targets []splitTarget, m *Metadata) string {
+	key := strings.ToLower(m.Host)
+	if key == "" {
+		key = string(m.Dest.Addr)
+	}
+	total := 0
+	for _, t := range targets {
+		total += t.Weight
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	n := int(h.Sum32() % uint32(total))
+	for _, t := range targets {
+		if n < t.Weight {
+			return t.Outbound
+		}
+		n -= t.Weight
+	}
+	return targets[len(targets)-1].Outbound
+}
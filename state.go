@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// stateSaveInterval is how often the state file is rewritten, so a crash
+// loses little; it is also written on shutdown
+const stateSaveInterval = 5 * time.Minute
+
+// State is what routing-socks learns while running, kept in the
+// "state_file" so a restart doesn't start from scratch
+type State struct {
+	Saved  time.Time             `json:"saved"`
+	Health map[string]HealthInfo `json:"health,omitempty"` // Health check state by outbound
+	Groups map[string]GroupState `json:"groups,omitempty"` // Members in use by group
+	Warm   map[string][]net.IP   `json:"warm,omitempty"`   // Last addresses of warm domains
+}
+
+// GroupState is the learned or selected state of a urltest or select group
+type GroupState struct {
+	Current string           `json:"current"`
+	Latency map[string]int64 `json:"latency_ms,omitempty"` // For urltest: last measurement by member
+}
+
+// statefulGroup is implemented by groups whose choice of member is kept
+type statefulGroup interface {
+	state() GroupState
+	restore(GroupState)
+}
+
+// loadState restores the state saved by a previous run; a missing file is
+// not an error. Health state is only restored with health checks on, since
+// nothing would bring an outbound saved as down back up otherwise.
+func loadState(path string, healthChecks bool) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st State
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("parse %s: %v", path, err)
+	}
+	if healthChecks {
+		health.restore(st.Health)
+	}
+	for tag, gs := range st.Groups {
+		if g, ok := outbounds[tag].(statefulGroup); ok {
+			g.restore(gs)
+		}
+	}
+	warm.restore(st.Warm)
+	log.Printf("Restored state from %s, saved %s\n", path, st.Saved.Format(time.RFC3339))
+	return nil
+}
+
+// saveState writes the current state to path
+func saveState(path string) error {
+	st := State{Saved: time.Now(), Health: health.list(), Groups: map[string]GroupState{}, Warm: warm.snapshot()}
+	for tag, o := range outbounds {
+		if g, ok := o.(statefulGroup); ok {
+			st.Groups[tag] = g.state()
+		}
+	}
+	data, _ := json.MarshalIndent(st, "", "  ")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// startStateSaver saves the state periodically; shutdown saves it a last
+// time
+func startStateSaver(path string) {
+	go func() {
+		for range time.Tick(stateSaveInterval) {
+			if err := saveState(path); err != nil {
+				log.Println("Save state failed:", err)
+			}
+		}
+	}()
+}
+
+// restore takes over saved health check state for the upstreams that
+// still exist
+func (t *healthTable) restore(saved map[string]HealthInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for tag, info := range saved {
+		if o, ok := outbounds[tag]; !ok || !isUpstream(o) {
+			continue
+		}
+		if old := t.info[tag]; old != nil && !old.Up {
+			t.ndown.Add(-1)
+		}
+		info := info
+		t.info[tag] = &info
+		if !info.Up {
+			t.ndown.Add(1)
+		}
+	}
+}
+
+func (g *urlTestGroup) state() GroupState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	gs := GroupState{Current: g.current, Latency: map[string]int64{}}
+	for member, d := range g.latency {
+		gs.Latency[member] = d.Milliseconds()
+	}
+	return gs
+}
+
+// restore resumes with the saved member and measurements, which the
+// first test round then confirms or replaces
+func (g *urlTestGroup) restore(gs GroupState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if slices.Contains(g.members, gs.Current) {
+		g.current = gs.Current
+	}
+	for member, ms := range gs.Latency {
+		if slices.Contains(g.members, member) {
+			g.latency[member] = time.Duration(ms) * time.Millisecond
+		}
+	}
+}
+
+func (g *selectGroup) state() GroupState {
+	return GroupState{Current: *g.current.Load()}
+}
+
+// restore keeps the member selected through the admin API
+func (g *selectGroup) restore(gs GroupState) {
+	if err := g.selectMember(gs.Current); err != nil {
+		log.Printf("State: group selection %s dropped: %v\n", gs.Current, err)
+	}
+}
+
+// snapshot returns the addresses of the warm domains
+func (t *warmTable) snapshot() map[string][]net.IP {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	hosts := make(map[string][]net.IP, len(t.hosts))
+	for host, h := range t.hosts {
+		if h.ips != nil {
+			hosts[host] = h.ips
+		}
+	}
+	return hosts
+}
+
+// restore warms the saved domains with their last addresses until they
+// are refreshed
+func (t *warmTable) restore(saved map[string][]net.IP) {
+	if len(saved) == 0 {
+		return
+	}
+	t.once.Do(func() { go t.refreshLoop() })
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for host, ips := range saved {
+		host = strings.ToLower(host)
+		if len(t.hosts) >= warmMax {
+			break
+		}
+		if h := t.hosts[host]; h != nil && h.ips != nil {
+			continue
+		}
+		h := &warmHost{ips: ips}
+		h.used.Store(time.Now().UnixNano())
+		t.hosts[host] = h
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ResponseConfig is the HTTP response a "static" outbound answers every
+// request with
+type ResponseConfig struct {
+	Status  int               `json:"status"`  // Default 200
+	Headers map[string]string `json:"headers"` // e.g. {"Content-Type": "text/html"}
+	Body    string            `json:"body"`    // Response body, default a 1x1 transparent GIF
+	File    string            `json:"file"`    // File read for the body instead of Body
+}
+
+// pixelGIF is a 1x1 transparent GIF
+var pixelGIF = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+// staticOutbound answers plain-HTTP requests itself instead of connecting,
+// so blocked hosts such as ad servers fail fast without broken requests
+type staticOutbound struct {
+	status  int
+	headers http.Header
+	body    []byte
+}
+
+// newStaticOutbound prepares the response of a static outbound
+func newStaticOutbound(rc *ResponseConfig) (staticOutbound, error) {
+	o := staticOutbound{status: http.StatusOK, headers: http.Header{}, body: pixelGIF}
+	if rc == nil {
+		rc = &ResponseConfig{}
+	}
+	if rc.Status != 0 {
+		if rc.Status < 100 || rc.Status > 999 {
+			return o, fmt.Errorf("invalid status %d", rc.Status)
+		}
+		o.status = rc.Status
+	}
+	switch {
+	case rc.File != "":
+		body, err := os.ReadFile(rc.File)
+		if err != nil {
+			return o, err
+		}
+		o.body = body
+	case rc.Body != "":
+		o.body = []byte(rc.Body)
+	default:
+		o.headers.Set("Content-Type", "image/gif")
+	}
+	for k, v := range rc.Headers {
+		o.headers.Set(k, v)
+	}
+	if o.headers.Get("Content-Type") == "" {
+		o.headers.Set("Content-Type", http.DetectContentType(o.body))
+	}
+	o.headers.Set("Content-Length", strconv.Itoa(len(o.body)))
+	o.headers.Set("Connection", "close")
+	return o, nil
+}
+
+func (o staticOutbound) String() string {
+	return fmt.Sprintf("static %d (%d bytes)", o.status, len(o.body))
+}
+
+func (o staticOutbound) Dial(m *Metadata) (net.Conn, error) {
+	client, server := net.Pipe()
+	go o.serve(server)
+	return client, nil
+}
+
+// serve answers the first request on conn and closes it; anything that
+// is not HTTP is dropped
+func (o staticOutbound) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", o.status, http.StatusText(o.status))
+	o.headers.Write(w)
+	w.WriteString("\r\n")
+	if req.Method != http.MethodHead {
+		w.Write(o.body)
+	}
+	w.Flush()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// TenantConfig is an isolated customer namespace served by the same
+// process: its own listener, users, outbounds and rules. Everything else
+// (DNS, geo data, sniffing, admin API) is shared with the main config.
+type TenantConfig struct {
+	Listen    string                    `json:"listen"`    // Local address the tenant's clients connect to
+	Users     map[string]string         `json:"users"`     // SOCKS5 username/password pairs, empty for no auth
+	Outbounds map[string]OutboundConfig `json:"outbounds"` // The tenant's outbounds, registered as "<tenant>/<name>"
+	Rules     []RuleConfig              `json:"rules"`     // Routing rules, first match wins
+	Default   string                    `json:"default"`   // Outbound used when no rule matches, default "direct"
+	Fallback  string                    `json:"fallback"`  // Outbound retried when the chosen one fails to connect, empty for none
+}
+
+// Tenant is a tenant ready to serve
+type Tenant struct {
+	Name   string
+	cfg    *Config
+	router *Router
+}
+
+// addTenantOutbounds adds the outbounds of the tenants to the main config
+// under their namespaced names, so they are built with the others. A
+// tenant may only refer to its own outbounds and "direct" and "reject".
+func addTenantOutbounds(cfg *Config) error {
+	if cfg.Outbounds == nil {
+		cfg.Outbounds = map[string]OutboundConfig{}
+	}
+	for name, t := range cfg.Tenants {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("tenant %q: invalid name", name)
+		}
+		for tag, oc := range t.Outbounds {
+			var err error
+			if oc.Chain, err = t.tags(name, oc.Chain); err != nil {
+				return fmt.Errorf("tenant %s: outbound %s: chain: %v", name, tag, err)
+			}
+			if oc.Members, err = t.tags(name, oc.Members); err != nil {
+				return fmt.Errorf("tenant %s: outbound %s: members: %v", name, tag, err)
+			}
+			if oc.CertFallback, err = t.tag(name, oc.CertFallback); err != nil {
+				return fmt.Errorf("tenant %s: outbound %s: cert_fallback: %v", name, tag, err)
+			}
+			if oc.Weights != nil {
+				weights := map[string]int{}
+				for member, w := range oc.Weights {
+					member, err := t.tag(name, member)
+					if err != nil {
+						return fmt.Errorf("tenant %s: outbound %s: weights: %v", name, tag, err)
+					}
+					weights[member] = w
+				}
+				oc.Weights = weights
+			}
+			cfg.Outbounds[name+"/"+tag] = oc
+		}
+	}
+	return nil
+}
+
+// tag returns the registered name of an outbound a tenant refers to
+func (t TenantConfig) tag(tenant, name string) (string, error) {
+	if _, ok := t.Outbounds[name]; ok {
+		return tenant + "/" + name, nil
+	}
+	if name != "" && name != "direct" && name != "reject" && name != "none" {
+		return "", fmt.Errorf("unknown outbound %q", name)
+	}
+	return name, nil
+}
+
+func (t TenantConfig) tags(tenant string, names []string) ([]string, error) {
+	if names == nil {
+		return nil, nil
+	}
+	tags := make([]string, len(names))
+	for i, name := range names {
+		var err error
+		if tags[i], err = t.tag(tenant, name); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// newTenants builds the configs and routers of the tenants, once their
+// outbounds are built. Tenant configs are copies of the main one with the
+// tenant's settings, so shared settings apply to all.
+func newTenants(cfg *Config, geo *GeoData) ([]*Tenant, error) {
+	var tenants []*Tenant
+	for name, t := range cfg.Tenants {
+		if t.Listen == "" {
+			return nil, fmt.Errorf("tenant %s: listen is required", name)
+		}
+		tc := *cfg
+		tc.Tenants = nil
+		tc.Listen = t.Listen
+		tc.Users = t.Users
+		tc.Shadowsocks, tc.Trojan = nil, nil
+		var err error
+		if tc.Default, err = t.tag(name, t.Default); err != nil {
+			return nil, fmt.Errorf("tenant %s: default: %v", name, err)
+		}
+		if tc.Default == "" {
+			tc.Default = "direct"
+		}
+		if tc.Fallback, err = t.tag(name, t.Fallback); err != nil {
+			return nil, fmt.Errorf("tenant %s: fallback: %v", name, err)
+		}
+		tc.Rules = nil
+		for i, rc := range t.Rules {
+			if rc.Outbound, err = t.tag(name, rc.Outbound); err != nil {
+				return nil, fmt.Errorf("tenant %s: rule %d: %v", name, i+1, err)
+			}
+			if rc.Fallback, err = t.tag(name, rc.Fallback); err != nil {
+				return nil, fmt.Errorf("tenant %s: rule %d: fallback: %v", name, i+1, err)
+			}
+			if rc.Split != nil {
+				split := map[string]int{}
+				for tag, w := range rc.Split {
+					if tag, err = t.tag(name, tag); err != nil {
+						return nil, fmt.Errorf("tenant %s: rule %d: split: %v", name, i+1, err)
+					}
+					split[tag] = w
+				}
+				rc.Split = split
+			}
+			tc.Rules = append(tc.Rules, rc)
+		}
+		router, err := newRouter(&tc, geo)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %v", name, err)
+		}
+		router.tenant = name
+		tenants = append(tenants, &Tenant{Name: name, cfg: &tc, router: router})
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	return tenants, nil
+}
+
+// serve accepts the tenant's clients
+func (t *Tenant) serve() {
+	listener, err := net.Listen("tcp", t.cfg.Listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Tenant %s: failed to listen on %s: %v\n", t.Name, t.cfg.Listen, err)
+		os.Exit(1)
+	}
+	log.Printf("Tenant %s: SOCKS5 server running on %s\n", t.Name, t.cfg.Listen)
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Tenant %s: accept failed: %v\n", t.Name, err)
+			continue
+		}
+		go handleClient(client, t.cfg, t.router)
+	}
+}
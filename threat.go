@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// threatList is a compiled IP reputation feed: CIDRs by category
+type threatList map[string]*ipMatcher
+
+func (t threatList) Match(m *Metadata) bool {
+	for _, ips := range t {
+		if ips.Match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t threatList) entries() int {
+	n := 0
+	for _, ips := range t {
+		n += len(ips.nets)
+	}
+	return n
+}
+
+// addThreatEntry adds a reputation feed line: a CIDR optionally followed by
+// its category ("203.0.113.0/24 malware" or "203.0.113.0/24,malware").
+// Text after ';' is a comment, as in the Spamhaus DROP lists.
+func addThreatEntry(t threatList, line, category string) error {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return nil
+	}
+	n, err := parseCIDR(fields[0])
+	if err != nil {
+		return err
+	}
+	if len(fields) > 1 {
+		category = fields[1]
+	}
+	if category == "" {
+		return fmt.Errorf("%s: no category", fields[0])
+	}
+	category = strings.ToLower(category)
+	if t[category] == nil {
+		t[category] = &ipMatcher{}
+	}
+	t[category].nets = append(t[category].nets, n)
+	return nil
+}
+
+// threatMatcher matches destinations listed under a category in any
+// "threat" provider; "any" matches every category
+type threatMatcher string
+
+func (c threatMatcher) Match(m *Metadata) bool {
+	for _, p := range providers {
+		if p.cfg.Format != "threat" {
+			continue
+		}
+		for _, matcher := range *p.matcher.Load() {
+			t, ok := matcher.(threatList)
+			if !ok {
+				continue
+			}
+			if c == "any" && t.Match(m) {
+				return true
+			}
+			if ips := t[string(c)]; ips != nil && ips.Match(m) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseThreatMatcher builds a threat:<category> matcher
+func parseThreatMatcher(category string) (Matcher, error) {
+	for _, p := range providers {
+		if p.cfg.Format == "threat" {
+			return threatMatcher(strings.ToLower(category)), nil
+		}
+	}
+	return nil, fmt.Errorf("threat:%s needs a provider with format \"threat\"", category)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// outboundCounters counts the connections and traffic of an outbound
+type outboundCounters struct {
+	up     atomic.Int64  // Bytes sent by clients of closed sessions
+	down   atomic.Int64  // Bytes sent to clients of closed sessions
+	active atomic.Int64  // Sessions open
+	total  atomic.Uint64 // Sessions opened
+	errors atomic.Uint64 // Failed dials
+}
+
+// OutboundTraffic is an outbound's traffic for the admin API
+type OutboundTraffic struct {
+	BytesUp   int64  `json:"bytes_up"`
+	BytesDown int64  `json:"bytes_down"`
+	Active    int64  `json:"active"`
+	Total     uint64 `json:"total"`
+	Errors    uint64 `json:"errors"`
+}
+
+// outboundStats holds the counters of every outbound; it is filled once
+// the outbounds are built and only read afterwards
+var outboundStats = map[string]*outboundCounters{}
+
+// initOutboundStats creates the counters of the outbounds
+func initOutboundStats() {
+	for tag := range outbounds {
+		outboundStats[tag] = &outboundCounters{}
+	}
+}
+
+// dialFailed counts a failed dial through an outbound; rejections are not
+// failures
+func dialFailed(tag string, err error) {
+	if c := outboundStats[tag]; c != nil && !errors.Is(err, errRejected) {
+		c.errors.Add(1)
+	}
+}
+
+// opened counts a session carried by an outbound and returns the function
+// to call when it ends
+func (c *outboundCounters) opened(s *Session) func() {
+	if c == nil {
+		return func() {}
+	}
+	c.total.Add(1)
+	c.active.Add(1)
+	return func() {
+		up, down := s.Bytes()
+		c.up.Add(up)
+		c.down.Add(down)
+		c.active.Add(-1)
+	}
+}
+
+// trafficStats reports the traffic per outbound, including the bytes
+// relayed so far by open sessions
+func trafficStats() map[string]OutboundTraffic {
+	list := make(map[string]OutboundTraffic, len(outboundStats))
+	for tag, c := range outboundStats {
+		list[tag] = OutboundTraffic{
+			BytesUp:   c.up.Load(),
+			BytesDown: c.down.Load(),
+			Active:    c.active.Load(),
+			Total:     c.total.Load(),
+			Errors:    c.errors.Load(),
+		}
+	}
+	for _, s := range sessions.list() {
+		t, ok := list[s.Member]
+		if !ok {
+			continue
+		}
+		up, down := s.Bytes()
+		t.BytesUp += up
+		t.BytesDown += down
+		list[s.Member] = t
+	}
+	return list
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransportConfig says how the connection to an upstream proxy is carried.
+// The default is plain TCP; "ws" tunnels it through a WebSocket, which lets
+// the upstream sit behind an HTTP reverse proxy or CDN.
+type TransportConfig struct {
+	Type    string            `json:"type"`    // "" (TCP) or "ws"
+	Path    string            `json:"path"`    // Request path, "{random}" is replaced per connection, default "/"
+	Host    string            `json:"host"`    // Host header, for fronting; default the upstream address
+	Headers map[string]string `json:"headers"` // Extra request headers, e.g. a CDN auth token
+	TLS     *TLSConfig        `json:"tls"`     // Wrap the connection in TLS, nil for none
+
+	tlsConfig        *tls.Config
+	handshakeTimeout time.Duration // The outbound's tls_timeout
+}
+
+// defaultHandshakeTimeout bounds the TLS and WebSocket handshakes with an
+// upstream proxy when its outbound sets no tls_timeout
+const defaultHandshakeTimeout = 10 * time.Second
+
+// TLSConfig sets up TLS to an upstream proxy
+type TLSConfig struct {
+	ServerName string   `json:"server_name"` // SNI and name verified, default the host of the address
+	CA         string   `json:"ca"`          // PEM file with the CAs to trust instead of the system roots
+	Insecure   bool     `json:"insecure"`    // Skip certificate verification
+	Cert       string   `json:"cert"`        // PEM client certificate, for proxies requiring one
+	Key        string   `json:"key"`         // PEM private key of Cert
+	Pins       []string `json:"pins"`        // Accepted "sha256/<base64>" public key (SPKI) or hex SHA-256 certificate hashes, any in the chain; empty for no pinning
+}
+
+// validate checks a transport section and prepares its TLS settings
+func (t *TransportConfig) validate() error {
+	switch t.Type {
+	case "", "tcp", "ws":
+	default:
+		return fmt.Errorf("transport: unknown type %q", t.Type)
+	}
+	if t.TLS == nil {
+		return nil
+	}
+	t.tlsConfig = &tls.Config{ServerName: t.TLS.ServerName, InsecureSkipVerify: t.TLS.Insecure, Time: clockNow}
+	if t.TLS.CA != "" {
+		pem, err := os.ReadFile(t.TLS.CA)
+		if err != nil {
+			return fmt.Errorf("transport: %v", err)
+		}
+		t.tlsConfig.RootCAs = x509.NewCertPool()
+		if !t.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("transport: no certificates in %s", t.TLS.CA)
+		}
+	}
+	if t.TLS.Cert != "" || t.TLS.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.TLS.Cert, t.TLS.Key)
+		if err != nil {
+			return fmt.Errorf("transport: client certificate: %v", err)
+		}
+		t.tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(t.TLS.Pins) > 0 {
+		pins, err := parsePins(t.TLS.Pins)
+		if err != nil {
+			return fmt.Errorf("transport: %v", err)
+		}
+		t.tlsConfig.VerifyConnection = pins.verify
+	}
+	return nil
+}
+
+// certPins are the hashes a pinned upstream's certificate chain must
+// contain one of
+type certPins struct {
+	spki map[[sha256.Size]byte]bool // Of the SubjectPublicKeyInfo
+	cert map[[sha256.Size]byte]bool // Of the DER certificate
+}
+
+// parsePins parses "sha256/<base64>" public key pins, as curl and HPKP
+// write them, and hex certificate fingerprints, with or without colons
+func parsePins(list []string) (*certPins, error) {
+	p := &certPins{spki: map[[sha256.Size]byte]bool{}, cert: map[[sha256.Size]byte]bool{}}
+	for _, pin := range list {
+		var h [sha256.Size]byte
+		if b64, ok := strings.CutPrefix(pin, "sha256/"); ok {
+			b, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid public key pin %q", pin)
+			}
+			copy(h[:], b)
+			p.spki[h] = true
+			continue
+		}
+		b, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q: want sha256/<base64> or a hex SHA-256 fingerprint", pin)
+		}
+		copy(h[:], b)
+		p.cert[h] = true
+	}
+	return p, nil
+}
+
+// pinError reports a certificate chain matching none of the pins
+type pinError struct {
+	leaf string // Public key hash of the leaf, to update the pins from
+}
+
+func (e *pinError) Error() string {
+	return "certificate matches no pin (leaf public key sha256/" + e.leaf + ")"
+}
+
+// verify accepts a handshake when a certificate of the chain matches a
+// pin; it runs after (and in addition to) the usual verification
+func (p *certPins) verify(cs tls.ConnectionState) error {
+	for _, cert := range cs.PeerCertificates {
+		if p.spki[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] || p.cert[sha256.Sum256(cert.Raw)] {
+			return nil
+		}
+	}
+	e := &pinError{}
+	if len(cs.PeerCertificates) > 0 {
+		h := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		e.leaf = base64.StdEncoding.EncodeToString(h[:])
+	}
+	return e
+}
+
+// proxyUnreachableError reports that the connection to an upstream proxy
+// itself failed, as opposed to the proxy failing to reach the destination
+type proxyUnreachableError struct {
+	addr string
+	err  error
+}
+
+func (e *proxyUnreachableError) Error() string {
+	return fmt.Sprintf("proxy %s unreachable: %v", e.addr, e.err)
+}
+
+func (e *proxyUnreachableError) Unwrap() error {
+	return e.err
+}
+
+// dialProxy opens a TCP connection to an upstream proxy, with the bind
+// dialer of the outbound when it has one
+func dialProxy(addr string, d *net.Dialer) (net.Conn, error) {
+	conn, err := dialBound(d, addr, 0)
+	if err != nil {
+		return nil, &proxyUnreachableError{addr, err}
+	}
+	return conn, nil
+}
+
+// dialTransport opens the connection to an upstream proxy at addr
+func dialTransport(addr string, t *TransportConfig, d *net.Dialer) (net.Conn, error) {
+	conn, err := dialProxy(addr, d)
+	if err != nil {
+		return nil, err
+	}
+	return wrapTransport(conn, addr, t)
+}
+
+// wrapTransport sets up the transport on a connection to the proxy at
+// addr, which may itself be tunneled through other proxies; conn is closed
+// on failure
+func wrapTransport(conn net.Conn, addr string, t *TransportConfig) (net.Conn, error) {
+	if t == nil {
+		return conn, nil
+	}
+	timeout := t.handshakeTimeout
+	if timeout == 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	raw := conn
+	if t.tlsConfig != nil {
+		cfg := t.tlsConfig
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	if t.Type != "ws" {
+		raw.SetDeadline(time.Time{})
+		return conn, nil
+	}
+	ws, err := wsHandshake(conn, addr, t, wsFrameSize(pathMSS(raw), t.tlsConfig != nil))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// isCertError reports whether a dial failed because the upstream's TLS
+// certificate did not verify or matched no pin
+func isCertError(err error) bool {
+	var pin *pinError
+	if errors.As(err, &pin) {
+		return true
+	}
+	var verify *tls.CertificateVerificationError
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &verify) || errors.As(err, &unknown) ||
+		errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
+// certAlertInterval limits certificate failure alerts per outbound
+const certAlertInterval = time.Minute
+
+var (
+	certAlertMu   sync.Mutex
+	certAlertLast = map[string]time.Time{}
+)
+
+// certAlert logs that an outbound's certificate failed verification and
+// its traffic goes to the fallback, at most once per certAlertInterval
+func certAlert(tag, fallback string, err error) {
+	certAlertMu.Lock()
+	defer certAlertMu.Unlock()
+	if time.Since(certAlertLast[tag]) < certAlertInterval {
+		return
+	}
+	certAlertLast[tag] = time.Now()
+	log.Printf("ALERT: outbound %s: TLS certificate verification failed, sending its traffic to %s: %v\n", tag, fallback, err)
+}
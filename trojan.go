@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// TrojanConfig enables a Trojan inbound: a TLS listener whose clients send
+// a password hash before the destination; its connections are routed like
+// any other
+type TrojanConfig struct {
+	Listen   string            `json:"listen"`   // Address to listen on, e.g. ":443"
+	Cert     string            `json:"cert"`     // PEM certificate chain
+	Key      string            `json:"key"`      // PEM private key
+	Users    map[string]string `json:"users"`    // Passwords by user name; the name is recorded in sessions
+	Fallback string            `json:"fallback"` // host:port that non-Trojan traffic is passed to, e.g. a web server; empty to drop it
+}
+
+// trojanHashLen is the length of the hex SHA-224 password hash
+const trojanHashLen = 56
+
+// serveTrojan accepts Trojan clients until the listener fails
+func serveTrojan(tc *TrojanConfig, cfg *Config, router *Router) {
+	if len(tc.Users) == 0 {
+		log.Fatal("Invalid config: trojan: users are required")
+	}
+	cert, err := tls.LoadX509KeyPair(tc.Cert, tc.Key)
+	if err != nil {
+		log.Fatal("Invalid config: trojan: ", err)
+	}
+	// Clients send the hex SHA-224 of their password
+	users := make(map[string]string, len(tc.Users))
+	for user, password := range tc.Users {
+		sum := sha256.Sum224([]byte(password))
+		users[hex.EncodeToString(sum[:])] = user
+	}
+	listener, err := tls.Listen("tcp", tc.Listen, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"http/1.1"}, // The fallback may not speak HTTP/2
+		Time:         clockNow,
+	})
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", tc.Listen, err)
+	}
+	fmt.Printf("Trojan server running on %s\n", tc.Listen)
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Accept failed: %v\n", err)
+			continue
+		}
+		go handleTrojan(client, tc, users, cfg, router)
+	}
+}
+
+// handleTrojan checks the password hash, reads the destination and hands
+// the connection to the router; anything else goes to the fallback
+func handleTrojan(client net.Conn, tc *TrojanConfig, users map[string]string, cfg *Config, router *Router) {
+	defer client.Close()
+	if blocks.blocked(client.RemoteAddr()) {
+		fmt.Printf("Blocked client %s\n", client.RemoteAddr())
+		return
+	}
+	client.SetReadDeadline(time.Now().Add(30 * time.Second))
+	// Everything read before authentication is kept for the fallback
+	pc := newPeekConn(client)
+	pc.mark()
+	user, destAddr, err := readTrojanRequest(pc, users)
+	if err != nil {
+		fmt.Printf("Trojan handshake failed from %s: %v\n", client.RemoteAddr(), err)
+		if errors.Is(err, errTrojanAuth) {
+			pc.rewind()
+			trojanFallback(pc, tc.Fallback)
+		}
+		return
+	}
+	pc.unmark()
+	client.SetReadDeadline(time.Time{})
+	connectClient(pc, user, destAddr, cfg, router, func(byte, error) error { return nil })
+}
+
+var errTrojanAuth = errors.New("trojan: not a Trojan client or wrong password")
+
+// readTrojanRequest reads the password hash, command and destination, each
+// line ended by CRLF
+func readTrojanRequest(r io.Reader, users map[string]string) (string, Addr, error) {
+	// Stop at the first byte that cannot be part of the hash, so short
+	// requests such as plain HTTP reach the fallback without waiting
+	var head [trojanHashLen + 2]byte
+	for n := 0; n < len(head); {
+		m, err := r.Read(head[n:])
+		for _, c := range head[n : n+m] {
+			if n < trojanHashLen && !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+				return "", Addr{}, errTrojanAuth
+			}
+			n++
+		}
+		if err != nil && n < len(head) {
+			return "", Addr{}, errTrojanAuth
+		}
+	}
+	user := ""
+	for hash, name := range users {
+		if subtle.ConstantTimeCompare(head[:trojanHashLen], []byte(hash)) == 1 {
+			user = name
+		}
+	}
+	if user == "" || string(head[trojanHashLen:]) != "\r\n" {
+		return "", Addr{}, errTrojanAuth
+	}
+	var cmd [1]byte
+	if _, err := io.ReadFull(r, cmd[:]); err != nil {
+		return "", Addr{}, err
+	}
+	if cmd[0] != 0x01 {
+		return "", Addr{}, fmt.Errorf("trojan: unsupported command %d", cmd[0])
+	}
+	destAddr, err := readAddr(r)
+	if err != nil {
+		return "", Addr{}, err
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(r, crlf[:]); err != nil {
+		return "", Addr{}, err
+	}
+	if string(crlf[:]) != "\r\n" {
+		return "", Addr{}, errors.New("trojan: malformed request")
+	}
+	return user, destAddr, nil
+}
+
+// trojanFallback passes a connection that failed authentication, rewound
+// to its first byte, to the fallback server so the listener looks like
+// that server to probes; without one the connection is drained
+func trojanFallback(client net.Conn, fallback string) {
+	if fallback == "" {
+		io.Copy(io.Discard, client)
+		return
+	}
+	conn, err := net.DialTimeout("tcp", fallback, 10*time.Second)
+	if err != nil {
+		log.Printf("Trojan fallback %s: %v\n", fallback, err)
+		return
+	}
+	defer conn.Close()
+	client.SetReadDeadline(time.Time{})
+	go func() {
+		io.Copy(conn, client)
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	io.Copy(client, conn)
+}
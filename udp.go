@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpBufferSize fits any UDP datagram
+const udpBufferSize = 64 * 1024
+
+// fragTimeout is how long an incomplete fragment sequence is kept; RFC 1928
+// asks for at least 5 seconds
+const fragTimeout = 5 * time.Second
+
+// udpStats counts UDP relay events for the admin API
+var udpStats struct {
+	Associations atomic.Int64  // Active associations
+	Datagrams    atomic.Uint64 // Datagrams relayed from clients
+	Fragments    atomic.Uint64 // Fragments received (FRAG != 0)
+	Reassembled  atomic.Uint64 // Datagrams rebuilt from fragments
+	FragDropped  atomic.Uint64 // Fragments discarded (gap, timeout, restart)
+	Dropped      atomic.Uint64 // Datagrams dropped (rules, unsupported outbound, errors)
+	Replies      atomic.Uint64 // Datagrams relayed back to clients
+	Foreign      atomic.Uint64 // Datagrams dropped for coming from another address than the association's client
+	FragRepeated atomic.Uint64 // Repeated fragments dropped without losing the sequence
+	Replayed     atomic.Uint64 // Datagrams dropped as repeats within the dedup window
+	Reclaimed    atomic.Uint64 // Associations closed for relaying nothing within udpIdleTimeout
+}
+
+// udpDedupWindow is how long a datagram is remembered to drop repeats of
+// it; 0 disables the check
+var udpDedupWindow time.Duration
+
+// udpIdleTimeout closes associations that relayed no datagram either way
+// for that long, freeing their sockets while clients hold the control
+// connection open; 0 keeps them until it closes
+var udpIdleTimeout time.Duration
+
+// udpAssociation relays datagrams for one UDP ASSOCIATE request
+type udpAssociation struct {
+	router   *Router
+	relay    *net.UDPConn // Socket the client sends to, nil for UDP-over-TCP
+	source   net.Addr     // Client address of the control connection
+	clientIP net.IP
+	session  *Session
+	reply    func(src Addr, payload []byte) error // Sends a datagram back to the client
+
+	mu      sync.Mutex
+	client  *net.UDPAddr // Learned from the first datagram
+	frag    fragQueue
+	dests   map[string]*udpTarget   // Routed destinations, nil for dropped ones
+	outs    map[string]*net.UDPConn // Sockets towards destinations, by direct outbound
+	ended   bool                    // No more sockets are opened
+	fakeSrc map[string]Addr         // Fake addresses by the real source of their replies
+	seen    map[uint64]time.Time    // Recent datagram hashes, when udpDedupWindow is set
+
+	uotMu sync.Mutex
+	uots  map[string]*uotConn // UDP-over-TCP streams by outbound
+}
+
+// udpTarget is where the datagrams of a destination are sent: straight to
+// its address from a direct outbound's socket, or through an outbound's
+// UDP-over-TCP stream
+type udpTarget struct {
+	addr *net.UDPAddr
+	out  *net.UDPConn
+	tag  string
+}
+
+// handleUDPAssociate serves a UDP ASSOCIATE request. The association lives
+// as long as the TCP control connection stays open.
+func handleUDPAssociate(client net.Conn, req Addr, router *Router) {
+	local := client.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		writeReply(client, 0x01) // General failure
+		fmt.Println("UDP associate failed:", err)
+		return
+	}
+	defer relay.Close()
+
+	a := &udpAssociation{
+		router:   router,
+		relay:    relay,
+		source:   client.RemoteAddr(),
+		clientIP: client.RemoteAddr().(*net.TCPAddr).IP,
+		dests:    map[string]*udpTarget{},
+		uots:     map[string]*uotConn{},
+		session: &Session{
+			Tenant:   router.tenant,
+			Source:   client.RemoteAddr().String(),
+			Dest:     "udp " + relay.LocalAddr().String(),
+			Outbound: "udp",
+			Start:    time.Now(),
+			client:   client,
+		},
+	}
+	a.reply = a.replyRelay
+	defer a.closeOuts()
+	defer a.closeUoT()
+	// A non-zero address in the request is where the client will send from
+	if req.Port != 0 && (req.Atyp == 0x01 || req.Atyp == 0x04) && !net.IP(req.Addr).IsUnspecified() {
+		a.client = &net.UDPAddr{IP: net.IP(req.Addr), Port: int(req.Port)}
+	}
+
+	if err := writeReplyAddr(client, 0x00, relay.LocalAddr().(*net.UDPAddr)); err != nil {
+		fmt.Println("Write reply failed:", err)
+		return
+	}
+	log.Printf("UDP associate: %s via %s\n", client.RemoteAddr(), relay.LocalAddr())
+
+	sessions.add(a.session)
+	defer sessions.remove(a.session)
+	udpStats.Associations.Add(1)
+	defer udpStats.Associations.Add(-1)
+	a.session.mem.Add(udpBufferSize)
+	defer a.session.mem.Add(-udpBufferSize)
+	defer a.reclaimIdle(client)()
+
+	go a.clientLoop()
+
+	// The association ends when the control connection closes
+	io.Copy(io.Discard, client)
+}
+
+// reclaimIdle closes the client connection, ending the association, once
+// it relayed no datagram for udpIdleTimeout; the returned function stops
+// watching
+func (a *udpAssociation) reclaimIdle(client net.Conn) (stop func()) {
+	if udpIdleTimeout <= 0 {
+		return func() {}
+	}
+	return watchIdle(a.session, udpIdleTimeout, func() {
+		udpStats.Reclaimed.Add(1)
+		client.Close()
+	})
+}
+
+// clientLoop relays datagrams from the client to their destinations
+func (a *udpAssociation) clientLoop() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !a.acceptFrom(from) {
+			udpStats.Foreign.Add(1)
+			udpStats.Dropped.Add(1)
+			continue
+		}
+		dest, payload, err := a.unwrap(buf[:n])
+		if err != nil {
+			log.Printf("UDP from %s: %v\n", from, err)
+			udpStats.Dropped.Add(1)
+			continue
+		}
+		if payload == nil {
+			continue // Waiting for more fragments
+		}
+		if udpDedupWindow > 0 && a.replayed(dest, payload) {
+			udpStats.Replayed.Add(1)
+			udpStats.Dropped.Add(1)
+			continue
+		}
+		udpStats.Datagrams.Add(1)
+		a.forward(dest, payload)
+	}
+}
+
+// acceptFrom only lets the client that opened the association send, locking
+// onto the first port it uses
+func (a *udpAssociation) acceptFrom(from *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !from.IP.Equal(a.clientIP) {
+		return false
+	}
+	if a.client == nil {
+		a.client = from
+	}
+	return a.client.Port == from.Port
+}
+
+// replayed reports whether the same datagram was sent to the same
+// destination within udpDedupWindow. The SOCKS5 encapsulation carries no
+// sequence number, so identical datagrams in quick succession are taken as
+// duplicated or replayed; protocols that retransmit do so with new content
+// (QUIC) or after longer timeouts (DNS).
+func (a *udpAssociation) replayed(dest Addr, payload []byte) bool {
+	h := fnv.New64a()
+	h.Write([]byte(dest.String()))
+	h.Write(payload)
+	sum := h.Sum64()
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.seen == nil {
+		a.seen = map[uint64]time.Time{}
+	}
+	if t, ok := a.seen[sum]; ok && now.Sub(t) < udpDedupWindow {
+		return true
+	}
+	if len(a.seen) >= udpDedupMax {
+		for k, t := range a.seen {
+			if now.Sub(t) >= udpDedupWindow {
+				delete(a.seen, k)
+			}
+		}
+	}
+	a.seen[sum] = now
+	return false
+}
+
+// udpDedupMax is the number of remembered datagrams per association before
+// expired ones are pruned
+const udpDedupMax = 4096
+
+// unwrap parses the SOCKS5 UDP request header, reassembling fragmented
+// datagrams. A nil payload means the datagram was a fragment that did not
+// complete a sequence yet.
+func (a *udpAssociation) unwrap(b []byte) (Addr, []byte, error) {
+	if len(b) < 4 || b[0] != 0 || b[1] != 0 {
+		return Addr{}, nil, errors.New("invalid UDP header")
+	}
+	frag := b[2]
+	dest, n, err := parseAddrBytes(b[3:])
+	if err != nil {
+		return Addr{}, nil, err
+	}
+	data := b[3+n:]
+	if frag == 0 {
+		return dest, append([]byte(nil), data...), nil
+	}
+
+	udpStats.Fragments.Add(1)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	payload := a.frag.add(dest, frag, data, time.Now())
+	return dest, payload, nil
+}
+
+// forward routes a datagram and sends it to its destination
+func (a *udpAssociation) forward(dest Addr, payload []byte) {
+	routed, err := restoreFakeIP(dest)
+	if err != nil {
+		log.Printf("UDP %s: %v\n", dest, err)
+		udpStats.Dropped.Add(1)
+		return
+	}
+	target, err := a.resolve(routed, dest)
+	if err != nil {
+		log.Printf("UDP %s: %v\n", dest, err)
+		udpStats.Dropped.Add(1)
+		return
+	}
+	if target == nil {
+		udpStats.Dropped.Add(1)
+		return
+	}
+	if target.addr != nil {
+		_, err = target.out.WriteToUDP(payload, target.addr)
+	} else {
+		err = a.uotSend(target.tag, routed, payload)
+	}
+	if err != nil {
+		log.Printf("UDP %s: %v\n", dest, err)
+		udpStats.Dropped.Add(1)
+		return
+	}
+	a.session.up.Add(int64(len(payload)))
+}
+
+// resolve routes a destination once per association and caches where its
+// datagrams go; a nil target means they are dropped. For a fake IP, dest
+// is its domain and requested the fake address, which replies then come
+// from.
+func (a *udpAssociation) resolve(dest, requested Addr) (*udpTarget, error) {
+	key := dest.String()
+	a.mu.Lock()
+	target, ok := a.dests[key]
+	a.mu.Unlock()
+	if ok {
+		return target, nil
+	}
+
+	m := newMetadata(a.source, dest)
+	tag, _ := a.router.Route(m)
+	m.logf(logNormal, "UDP route: %s -> %s\n", dest, tag)
+	if d, direct := outbounds[tag].(directOutbound); direct {
+		ips := d.family.order(m.DialIPs())
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no address for %s", dest)
+		}
+		out, err := a.outFor(tag, d)
+		if err != nil {
+			return nil, err
+		}
+		target = &udpTarget{addr: &net.UDPAddr{IP: ips[0], Port: int(dest.Port)}, out: out}
+	} else if tag != "reject" && supportsUoT(tag) {
+		target = &udpTarget{tag: tag}
+	} else if tag != "reject" {
+		log.Printf("UDP %s: outbound %s does not support UDP, dropping\n", dest, tag)
+	}
+
+	a.mu.Lock()
+	a.dests[key] = target
+	if target != nil && requested.Atyp != dest.Atyp {
+		if a.fakeSrc == nil {
+			a.fakeSrc = map[string]Addr{}
+		}
+		a.fakeSrc[dest.String()] = requested
+		if target.addr != nil {
+			a.fakeSrc[udpAddrToAddr(target.addr).String()] = requested
+		}
+	}
+	a.mu.Unlock()
+	return target, nil
+}
+
+// outFor returns the association's socket for a direct outbound, opening
+// it with the outbound's interface, source and mark on first use
+func (a *udpAssociation) outFor(tag string, d directOutbound) (*net.UDPConn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if out, ok := a.outs[tag]; ok {
+		return out, nil
+	}
+	if a.ended {
+		return nil, net.ErrClosed
+	}
+	out, err := listenBound(d.dialer)
+	if err != nil {
+		return nil, err
+	}
+	if a.outs == nil {
+		a.outs = map[string]*net.UDPConn{}
+	}
+	a.outs[tag] = out
+	go a.replyLoop(out)
+	return out, nil
+}
+
+// closeOuts closes the sockets towards destinations
+func (a *udpAssociation) closeOuts() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ended = true
+	for _, out := range a.outs {
+		out.Close()
+	}
+}
+
+// replyLoop relays datagrams from destinations back to the client
+func (a *udpAssociation) replyLoop(out *net.UDPConn) {
+	a.session.mem.Add(udpBufferSize)
+	defer a.session.mem.Add(-udpBufferSize)
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := out.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if a.reply(a.replySource(udpAddrToAddr(from)), buf[:n]) == nil {
+			udpStats.Replies.Add(1)
+			a.session.down.Add(int64(n))
+		}
+	}
+}
+
+// replySource returns the source a reply is relayed to the client with:
+// the fake address the client sent to, when it has one
+func (a *udpAssociation) replySource(src Addr) Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if fake, ok := a.fakeSrc[src.String()]; ok {
+		return fake
+	}
+	return src
+}
+
+// errNoClient is returned for replies that arrive before the client sent
+// its first datagram
+var errNoClient = errors.New("client address not known yet")
+
+// replyRelay sends a datagram to the client through the relay socket
+func (a *udpAssociation) replyRelay(src Addr, payload []byte) error {
+	a.mu.Lock()
+	client := a.client
+	a.mu.Unlock()
+	if client == nil {
+		return errNoClient
+	}
+	packet := appendAddr([]byte{0, 0, 0}, src)
+	packet = append(packet, payload...)
+	_, err := a.relay.WriteToUDP(packet, client)
+	return err
+}
+
+// fragQueue reassembles a fragmented datagram (RFC 1928 section 7): FRAG
+// counts 1..127 and its high bit marks the last fragment
+type fragQueue struct {
+	dest     string
+	next     byte
+	parts    []byte
+	deadline time.Time
+}
+
+// add queues a fragment and returns the datagram once the sequence ends
+func (q *fragQueue) add(dest Addr, frag byte, data []byte, now time.Time) []byte {
+	pos := frag & 0x7f
+	last := frag&0x80 != 0
+
+	if q.next > 1 && pos == q.next-1 && dest.String() == q.dest && now.Before(q.deadline) {
+		// The fragment just queued, sent again: dropping it keeps the
+		// sequence intact
+		udpStats.FragRepeated.Add(1)
+		return nil
+	}
+	if q.next != 0 && (now.After(q.deadline) || dest.String() != q.dest || pos != q.next) {
+		// Timed out, different destination, or out of sequence: the
+		// queued fragments can never be completed
+		udpStats.FragDropped.Add(uint64(q.next - 1))
+		q.reset()
+	}
+	if q.next == 0 {
+		if pos != 1 {
+			udpStats.FragDropped.Add(1)
+			return nil
+		}
+		q.dest = dest.String()
+		q.next = 1
+		q.deadline = now.Add(fragTimeout)
+	}
+	q.parts = append(q.parts, data...)
+	q.next++
+	if !last {
+		return nil
+	}
+	payload := q.parts
+	q.parts = nil
+	q.reset()
+	udpStats.Reassembled.Add(1)
+	return payload
+}
+
+func (q *fragQueue) reset() {
+	q.dest = ""
+	q.next = 0
+	q.parts = q.parts[:0]
+}
+
+// parseAddrBytes parses ATYP, address and port from a buffer, returning
+// the number of bytes used
+func parseAddrBytes(b []byte) (Addr, int, error) {
+	if len(b) < 1 {
+		return Addr{}, 0, errors.New("short address")
+	}
+	var n int
+	var addr []byte
+	switch b[0] {
+	case 0x01:
+		n = 1 + 4
+		if len(b) >= n {
+			addr = b[1:n]
+		}
+	case 0x03:
+		if len(b) < 2 {
+			return Addr{}, 0, errors.New("short address")
+		}
+		n = 2 + int(b[1])
+		if len(b) >= n {
+			addr = b[2:n]
+		}
+	case 0x04:
+		n = 1 + 16
+		if len(b) >= n {
+			addr = b[1:n]
+		}
+	default:
+		return Addr{}, 0, errors.New("unsupported address type")
+	}
+	if len(b) < n+2 {
+		return Addr{}, 0, errors.New("short address")
+	}
+	port := binary.BigEndian.Uint16(b[n:])
+	return Addr{Atyp: b[0], Addr: append([]byte(nil), addr...), Port: port}, n + 2, nil
+}
+
+// udpAddrToAddr converts a UDP address to SOCKS5 form
+func udpAddrToAddr(u *net.UDPAddr) Addr {
+	if ip4 := u.IP.To4(); ip4 != nil {
+		return Addr{Atyp: 0x01, Addr: ip4, Port: uint16(u.Port)}
+	}
+	return Addr{Atyp: 0x04, Addr: u.IP.To16(), Port: uint16(u.Port)}
+}
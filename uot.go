@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// UDP-over-TCP (the sing-box/Shadowsocks "UoT" encapsulation) carries the
+// datagrams of a UDP association inside a stream through the upstream, for
+// proxies and networks that cannot relay SOCKS5 UDP. The stream is
+// requested as a CONNECT to a magic domain, then carries each datagram as
+// [address][uint16 length][payload] in both directions. Version 2 first
+// sends a request: a connect flag and a destination; in connect mode all
+// datagrams go to that destination and carry no address.
+const (
+	uotMagicV1 = "sp.udp-over-tcp.arpa"
+	uotMagicV2 = "sp.v2.udp-over-tcp.arpa"
+)
+
+// udpOverTCP holds the outbounds configured to carry UDP as UDP-over-TCP
+var udpOverTCP = map[string]bool{}
+
+// uotVersion returns the UDP-over-TCP version a requested destination
+// starts, 0 for an ordinary destination
+func uotVersion(a Addr) int {
+	if a.Atyp != 0x03 {
+		return 0
+	}
+	switch string(a.Addr) {
+	case uotMagicV1:
+		return 1
+	case uotMagicV2:
+		return 2
+	}
+	return 0
+}
+
+// supportsUoT reports whether UDP routed to an outbound can be carried as
+// UDP-over-TCP: it is configured to, or is a group whose members all are
+func supportsUoT(tag string) bool {
+	if udpOverTCP[tag] {
+		return true
+	}
+	g, ok := outbounds[tag].(interface{ info() GroupInfo })
+	if !ok {
+		return false
+	}
+	members := g.info().Members
+	return len(members) > 0 && !slices.ContainsFunc(members, func(member string) bool { return !supportsUoT(member) })
+}
+
+// uotConn is a UDP-over-TCP stream
+type uotConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	connect bool // Version 2 connect mode: datagrams carry no address
+	dest    Addr // Destination of all datagrams in connect mode
+	wmu     sync.Mutex
+}
+
+func newUoTConn(conn net.Conn) *uotConn {
+	return &uotConn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// dialUoT opens a version 2 UDP-over-TCP stream through an outbound
+func dialUoT(tag string, m *Metadata) (*uotConn, error) {
+	dest := m.Dest
+	m.Dest = Addr{Atyp: 0x03, Addr: []byte(uotMagicV2)}
+	conn, err := dialOutbound(tag, m)
+	m.Dest = dest
+	if err != nil {
+		return nil, err
+	}
+	// Not in connect mode, so the association can reach any destination;
+	// the request's destination is then informational
+	req := appendAddr([]byte{0}, dest)
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newUoTConn(conn), nil
+}
+
+// writePacket sends a datagram; concurrent writers are serialized so
+// datagrams are not interleaved
+func (c *uotConn) writePacket(dest Addr, payload []byte) error {
+	if len(payload) > 0xffff {
+		return fmt.Errorf("datagram of %d bytes too large", len(payload))
+	}
+	buf := make([]byte, 0, addrMaxLen+2+len(payload))
+	if !c.connect {
+		buf = appendAddr(buf, dest)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	buf = append(buf, payload...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// readPacket reads a datagram into buf
+func (c *uotConn) readPacket(buf []byte) (Addr, []byte, error) {
+	src := c.dest
+	if !c.connect {
+		var err error
+		if src, err = readAddr(c.r); err != nil {
+			return Addr{}, nil, err
+		}
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(c.r, l[:]); err != nil {
+		return Addr{}, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(c.r, buf[:n]); err != nil {
+		return Addr{}, nil, err
+	}
+	return src, buf[:n], nil
+}
+
+// uotSend sends a datagram through the association's UDP-over-TCP stream
+// for an outbound, opening it on first use or after it failed
+func (a *udpAssociation) uotSend(tag string, dest Addr, payload []byte) error {
+	a.uotMu.Lock()
+	c := a.uots[tag]
+	if c == nil {
+		m := newMetadata(a.source, dest)
+		var err error
+		if c, err = dialUoT(tag, m); err != nil {
+			a.uotMu.Unlock()
+			return fmt.Errorf("UDP-over-TCP via %s: %w", tag, err)
+		}
+		m.logf(logNormal, "UDP-over-TCP: %s via %s\n", a.source, tag)
+		a.uots[tag] = c
+		go a.uotReplyLoop(tag, c)
+	}
+	a.uotMu.Unlock()
+	return c.writePacket(dest, payload)
+}
+
+// uotReplyLoop relays datagrams from a UDP-over-TCP stream back to the
+// client until the stream closes
+func (a *udpAssociation) uotReplyLoop(tag string, c *uotConn) {
+	defer func() {
+		c.conn.Close()
+		a.uotMu.Lock()
+		if a.uots[tag] == c {
+			delete(a.uots, tag)
+		}
+		a.uotMu.Unlock()
+	}()
+	buf := make([]byte, udpBufferSize)
+	for {
+		src, payload, err := c.readPacket(buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("UDP-over-TCP via %s: %v\n", tag, err)
+			}
+			return
+		}
+		if a.reply(a.replySource(src), payload) == nil {
+			udpStats.Replies.Add(1)
+			a.session.down.Add(int64(len(payload)))
+		}
+	}
+}
+
+// closeUoT closes the association's UDP-over-TCP streams
+func (a *udpAssociation) closeUoT() {
+	a.uotMu.Lock()
+	defer a.uotMu.Unlock()
+	for _, c := range a.uots {
+		c.conn.Close()
+	}
+}
+
+// serveUoT relays the datagrams of a UDP-over-TCP stream requested by a
+// client, routing them like those of a UDP ASSOCIATE
+func serveUoT(client net.Conn, version int, router *Router) {
+	c := newUoTConn(client)
+	if version == 2 {
+		client.SetReadDeadline(time.Now().Add(30 * time.Second))
+		flag, err := c.r.ReadByte()
+		if err != nil {
+			return
+		}
+		if c.dest, err = readAddr(c.r); err != nil {
+			return
+		}
+		client.SetReadDeadline(time.Time{})
+		c.connect = flag != 0
+	}
+	a := &udpAssociation{
+		router: router,
+		source: client.RemoteAddr(),
+		dests:  map[string]*udpTarget{},
+		uots:   map[string]*uotConn{},
+		session: &Session{
+			Tenant:   router.tenant,
+			Source:   client.RemoteAddr().String(),
+			Dest:     "udp-over-tcp",
+			Outbound: "udp",
+			Start:    time.Now(),
+			client:   client,
+		},
+	}
+	a.reply = c.writePacket
+	defer a.closeOuts()
+	defer a.closeUoT()
+	log.Printf("UDP-over-TCP: %s (version %d)\n", client.RemoteAddr(), version)
+
+	sessions.add(a.session)
+	defer sessions.remove(a.session)
+	udpStats.Associations.Add(1)
+	defer udpStats.Associations.Add(-1)
+	a.session.mem.Add(udpBufferSize)
+	defer a.session.mem.Add(-udpBufferSize)
+	defer a.reclaimIdle(client)()
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		dest, payload, err := c.readPacket(buf)
+		if err != nil {
+			return
+		}
+		if udpDedupWindow > 0 && a.replayed(dest, payload) {
+			udpStats.Replayed.Add(1)
+			udpStats.Dropped.Add(1)
+			continue
+		}
+		udpStats.Datagrams.Add(1)
+		a.forward(dest, payload)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// vlessOutbound connects through a VLESS server; VLESS does not encrypt,
+// so it is normally used with a TLS transport
+type vlessOutbound struct {
+	addr      string
+	id        [16]byte
+	transport *TransportConfig
+	dialer    *net.Dialer // Binds connections to an interface, source address or mark, nil for none
+}
+
+func (o vlessOutbound) String() string {
+	return "vless " + o.addr + transportSuffix(o.transport)
+}
+
+func (o vlessOutbound) Dial(m *Metadata) (net.Conn, error) {
+	conn, err := dialTransport(o.addr, o.transport, o.dialer)
+	if err != nil {
+		return nil, err
+	}
+	// Version 0, user ID, no addons, TCP command, then the destination
+	req := append([]byte{0}, o.id[:]...)
+	req = append(req, 0, 0x01)
+	req = appendV2rayAddr(req, m.Dest)
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The response header comes with the first data from the server
+	return &vlessConn{Conn: conn}, nil
+}
+
+// vlessConn strips the VLESS response header from the first read
+type vlessConn struct {
+	net.Conn
+	once sync.Once
+	err  error
+}
+
+func (c *vlessConn) Read(p []byte) (int, error) {
+	c.once.Do(func() {
+		var h [2]byte // Version and addons length
+		if _, c.err = io.ReadFull(c.Conn, h[:]); c.err != nil {
+			return
+		}
+		if h[0] != 0 {
+			c.err = fmt.Errorf("vless: unexpected response version %d", h[0])
+			return
+		}
+		_, c.err = io.CopyN(io.Discard, c.Conn, int64(h[1]))
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+// parseUUID parses a user ID such as "b831381d-6324-4d53-ad4f-8cda48b30811"
+func parseUUID(s string) ([16]byte, error) {
+	var id [16]byte
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		return id, fmt.Errorf("invalid uuid %q", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// appendV2rayAddr appends a destination as port followed by the address
+// in the VMess/VLESS encoding: 1 IPv4, 2 domain, 3 IPv6
+func appendV2rayAddr(b []byte, a Addr) []byte {
+	b = binary.BigEndian.AppendUint16(b, a.Port)
+	switch a.Atyp {
+	case 0x01:
+		b = append(b, 0x01)
+	case 0x03:
+		b = append(b, 0x02, byte(len(a.Addr)))
+	case 0x04:
+		b = append(b, 0x03)
+	}
+	return append(b, a.Addr...)
+}
+
+// transportSuffix describes a transport for outbound String methods
+func transportSuffix(t *TransportConfig) string {
+	s := ""
+	if t != nil && t.Type == "ws" {
+		s += " over ws"
+	}
+	if t != nil && t.TLS != nil {
+		s += " (tls)"
+	}
+	return s
+}
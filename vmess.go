@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// vmessOutbound connects through a VMess server with AEAD headers
+// (alterId 0) and AES-128-GCM body encryption
+type vmessOutbound struct {
+	addr      string
+	cmdKey    [16]byte // Derived from the user ID
+	transport *TransportConfig
+	dialer    *net.Dialer // Binds connections to an interface, source address or mark, nil for none
+}
+
+// vmessMaxChunk is the most payload sent in one body chunk
+const vmessMaxChunk = 8192
+
+func newVMessOutbound(addr string, id [16]byte, t *TransportConfig, d *net.Dialer) vmessOutbound {
+	o := vmessOutbound{addr: addr, transport: t, dialer: d}
+	o.cmdKey = md5.Sum(append(id[:], "c48619fe-8f02-49e0-b9e9-edf763e17e21"...))
+	return o
+}
+
+func (o vmessOutbound) String() string {
+	return "vmess " + o.addr + transportSuffix(o.transport)
+}
+
+func (o vmessOutbound) Dial(m *Metadata) (net.Conn, error) {
+	conn, err := dialTransport(o.addr, o.transport, o.dialer)
+	if err != nil {
+		return nil, err
+	}
+	var key, iv [16]byte
+	var respV [1]byte
+	rand.Read(key[:])
+	rand.Read(iv[:])
+	rand.Read(respV[:])
+
+	// Version, body IV and key, response check byte, chunk stream option,
+	// AES-128-GCM without padding, reserved, TCP command, destination,
+	// then an FNV-1a checksum of it all
+	header := append([]byte{1}, iv[:]...)
+	header = append(header, key[:]...)
+	header = append(header, respV[0], 0x01, 0x03, 0, 0x01)
+	header = appendV2rayAddr(header, m.Dest)
+	h := fnv.New32a()
+	h.Write(header)
+	header = h.Sum(header)
+
+	sealed, err := vmessSealHeader(o.cmdKey, header)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(sealed); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	respKey, respIV := sha256.Sum256(key[:]), sha256.Sum256(iv[:])
+	c := &vmessConn{Conn: conn, respV: respV[0]}
+	c.w, _ = newChunkAEAD(key[:], iv[:])
+	c.r, _ = newChunkAEAD(respKey[:16], respIV[:16])
+	copy(c.respKey[:], respKey[:16])
+	copy(c.respIV[:], respIV[:16])
+	return c, nil
+}
+
+// vmessKDF derives keys with the nested HMAC-SHA256 construction of VMess
+// AEAD, salted with the path elements in order
+func vmessKDF(key []byte, path ...[]byte) []byte {
+	newHash := func() hash.Hash { return hmac.New(sha256.New, []byte("VMess AEAD KDF")) }
+	for _, p := range path {
+		parent, p := newHash, p
+		newHash = func() hash.Hash { return hmac.New(parent, p) }
+	}
+	h := newHash()
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// vmessSealHeader encrypts a request header: auth ID, sealed length,
+// connection nonce, sealed header
+func vmessSealHeader(cmdKey [16]byte, header []byte) ([]byte, error) {
+	// The auth ID carries the time, so the server can reject replays
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:], uint64(clockNow().Unix()))
+	rand.Read(id[8:12])
+	binary.BigEndian.PutUint32(id[12:], crc32.ChecksumIEEE(id[:12]))
+	block, err := aes.NewCipher(vmessKDF(cmdKey[:], []byte("AES Auth ID Encryption"))[:16])
+	if err != nil {
+		return nil, err
+	}
+	block.Encrypt(id[:], id[:])
+
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	seal := func(keySalt, nonceSalt string, data []byte) ([]byte, error) {
+		aead, err := newGCM(vmessKDF(cmdKey[:], []byte(keySalt), id[:], nonce[:])[:16])
+		if err != nil {
+			return nil, err
+		}
+		n := vmessKDF(cmdKey[:], []byte(nonceSalt), id[:], nonce[:])[:12]
+		return aead.Seal(nil, n, data, id[:]), nil
+	}
+	length, err := seal("VMess Header AEAD Key_Length", "VMess Header AEAD Nonce_Length",
+		binary.BigEndian.AppendUint16(nil, uint16(len(header))))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := seal("VMess Header AEAD Key", "VMess Header AEAD Nonce", header)
+	if err != nil {
+		return nil, err
+	}
+	out := append(id[:], length...)
+	out = append(out, nonce[:]...)
+	return append(out, payload...), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkAEAD seals or opens the chunks of one direction of a VMess body;
+// the nonce is a chunk counter followed by bytes 2-11 of the IV
+type chunkAEAD struct {
+	aead  cipher.AEAD
+	nonce [12]byte
+	count uint16
+}
+
+func newChunkAEAD(key, iv []byte) (*chunkAEAD, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	c := &chunkAEAD{aead: aead}
+	copy(c.nonce[:], iv)
+	return c, nil
+}
+
+func (c *chunkAEAD) next() []byte {
+	binary.BigEndian.PutUint16(c.nonce[:], c.count)
+	c.count++
+	return c.nonce[:]
+}
+
+// vmessConn encrypts writes into body chunks and decrypts the response
+type vmessConn struct {
+	net.Conn
+	respV   byte // Must be echoed in the response header
+	respKey [16]byte
+	respIV  [16]byte
+
+	wmu sync.Mutex
+	w   *chunkAEAD
+
+	r       *chunkAEAD
+	started bool   // Response header read
+	buf     []byte // Decrypted data not yet read
+	eof     bool
+}
+
+func (c *vmessConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n := 0
+	for len(p) > 0 {
+		size := min(len(p), vmessMaxChunk)
+		if err := c.writeChunk(p[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// writeChunk sends one chunk: sealed length, then the sealed payload; an
+// empty chunk ends the stream
+func (c *vmessConn) writeChunk(p []byte) error {
+	out := binary.BigEndian.AppendUint16(nil, uint16(len(p)+c.w.aead.Overhead()))
+	out = c.w.aead.Seal(out, c.w.next(), p, nil)
+	_, err := c.Conn.Write(out)
+	return err
+}
+
+// vmessCloseFlush bounds how long Close waits to send the end of the stream
+const vmessCloseFlush = time.Second
+
+// Close ends the stream with an empty chunk and closes the connection. A
+// Write in progress, possibly stalled on the peer, holds wmu; closing the
+// connection is what unblocks it, so the empty chunk is skipped then.
+func (c *vmessConn) Close() error {
+	if c.wmu.TryLock() {
+		c.Conn.SetWriteDeadline(time.Now().Add(vmessCloseFlush))
+		c.writeChunk(nil)
+		c.wmu.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+func (c *vmessConn) Read(p []byte) (int, error) {
+	if !c.started {
+		c.started = true
+		if err := c.readHeader(); err != nil {
+			c.eof = true
+			return 0, err
+		}
+	}
+	for len(c.buf) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// readHeader reads and checks the sealed response header
+func (c *vmessConn) readHeader() error {
+	open := func(keySalt, ivSalt string, n int) ([]byte, error) {
+		aead, err := newGCM(vmessKDF(c.respKey[:], []byte(keySalt))[:16])
+		if err != nil {
+			return nil, err
+		}
+		sealed := make([]byte, n+aead.Overhead())
+		if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+			return nil, err
+		}
+		return aead.Open(sealed[:0], vmessKDF(c.respIV[:], []byte(ivSalt))[:12], sealed, nil)
+	}
+	length, err := open("AEAD Resp Header Len Key", "AEAD Resp Header Len IV", 2)
+	if err != nil {
+		return fmt.Errorf("vmess: response header: %v", err)
+	}
+	header, err := open("AEAD Resp Header Key", "AEAD Resp Header IV", int(binary.BigEndian.Uint16(length)))
+	if err != nil {
+		return fmt.Errorf("vmess: response header: %v", err)
+	}
+	if len(header) < 4 || header[0] != c.respV {
+		return errors.New("vmess: response header mismatch")
+	}
+	return nil
+}
+
+// readChunk decrypts the next body chunk into buf
+func (c *vmessConn) readChunk() error {
+	var size [2]byte
+	if _, err := io.ReadFull(c.Conn, size[:]); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n < c.r.aead.Overhead() {
+		return errors.New("vmess: invalid chunk size")
+	}
+	if n == c.r.aead.Overhead() {
+		c.eof = true
+		return nil
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		return err
+	}
+	plain, err := c.r.aead.Open(sealed[:0], c.r.next(), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("vmess: %v", err)
+	}
+	c.buf = plain
+	return nil
+}
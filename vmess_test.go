@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestVmessConn(t *testing.T, conn net.Conn) *vmessConn {
+	t.Helper()
+	w, err := newChunkAEAD(make([]byte, 16), make([]byte, 12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &vmessConn{Conn: conn, w: w}
+}
+
+// TestVmessCloseStalledWrite closes a connection whose Write is blocked on
+// a peer that stopped reading: Close must not wait for the Write
+func TestVmessCloseStalledWrite(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	c := newTestVmessConn(t, conn)
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("never read"))
+		written <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // Let the Write block holding wmu
+
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close blocked behind a stalled Write")
+	}
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Error("stalled Write succeeded after Close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write still blocked after Close")
+	}
+}
+
+// TestVmessCloseStalledPeer closes an idle connection whose peer does not
+// read the end-of-stream chunk: Close gives up on it after vmessCloseFlush
+func TestVmessCloseStalledPeer(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	c := newTestVmessConn(t, conn)
+	start := time.Now()
+	c.Close()
+	if elapsed := time.Since(start); elapsed > vmessCloseFlush+time.Second {
+		t.Errorf("Close took %v", elapsed)
+	}
+}
+
+// TestVmessCloseSendsEnd checks that an idle connection still ends the
+// stream with an empty chunk
+func TestVmessCloseSendsEnd(t *testing.T) {
+	conn, peer := net.Pipe()
+	c := newTestVmessConn(t, conn)
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(peer)
+		received <- b
+	}()
+	c.Close()
+	// Sealed length and the tag of an empty payload
+	if b := <-received; len(b) != 2+c.w.aead.Overhead() {
+		t.Errorf("peer received %d bytes, want the %d of an empty chunk", len(b), 2+c.w.aead.Overhead())
+	}
+}
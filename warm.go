@@ -0,0 +1,210 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Warm rules keep the DNS answers of their domains fresh in the background
+// and, for upstream proxies, keep negotiated connections ready, so the
+// first byte doesn't wait for a lookup or a handshake
+const (
+	warmRefresh  = 30 * time.Second // How often warm domains are re-resolved
+	warmIdle     = 10 * time.Minute // Domains not connected to for this long are dropped
+	warmMax      = 1024             // Most domains kept warm
+	warmSeedMax  = 256              // Most domains taken from each rule at startup
+	spareConns   = 2                // Negotiated connections kept per upstream
+	spareMaxAge  = 30 * time.Second // Spare connections older than this are replaced
+	spareBackoff = 5 * time.Second  // Wait after failing to open a spare connection
+)
+
+// warmTable holds the addresses of warm domains
+type warmTable struct {
+	mu    sync.RWMutex
+	once  sync.Once
+	hosts map[string]*warmHost
+}
+
+type warmHost struct {
+	ips  []net.IP
+	used atomic.Int64 // Last connection, unix nanoseconds
+}
+
+var warm = &warmTable{hosts: map[string]*warmHost{}}
+
+// add keeps a domain warm, resolving it in the background when it is new
+func (t *warmTable) add(host string) {
+	host = strings.ToLower(host)
+	t.once.Do(func() { go t.refreshLoop() })
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h := t.hosts[host]; h != nil {
+		h.used.Store(time.Now().UnixNano())
+		return
+	}
+	if len(t.hosts) >= warmMax {
+		return
+	}
+	h := &warmHost{}
+	h.used.Store(time.Now().UnixNano())
+	t.hosts[host] = h
+	go t.resolve(host, h)
+}
+
+// get returns the cached addresses of a warm domain
+func (t *warmTable) get(host string) ([]net.IP, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	h := t.hosts[strings.ToLower(host)]
+	if h == nil || h.ips == nil {
+		return nil, false
+	}
+	h.used.Store(time.Now().UnixNano())
+	return h.ips, true
+}
+
+func (t *warmTable) resolve(host string, h *warmHost) {
+	ips, err := resolver.LookupIP(host)
+	if err != nil {
+		log.Printf("Warm lookup %s: %v\n", host, err)
+		return
+	}
+	t.mu.Lock()
+	h.ips = ips
+	t.mu.Unlock()
+}
+
+// refreshLoop re-resolves the warm domains and drops idle ones
+func (t *warmTable) refreshLoop() {
+	for {
+		time.Sleep(warmRefresh)
+		t.mu.Lock()
+		refresh := map[string]*warmHost{}
+		for host, h := range t.hosts {
+			if time.Since(time.Unix(0, h.used.Load())) > warmIdle {
+				delete(t.hosts, host)
+				continue
+			}
+			refresh[host] = h
+		}
+		t.mu.Unlock()
+		for host, h := range refresh {
+			t.resolve(host, h)
+		}
+	}
+}
+
+// warmSeeds lists the domain names a matcher is known to match, to warm
+// them before the first connection
+func warmSeeds(m Matcher) []string {
+	var seeds []string
+	switch m := m.(type) {
+	case *domainMatcher:
+		for host := range m.full {
+			seeds = append(seeds, host)
+		}
+		for host := range m.suffix {
+			seeds = append(seeds, host)
+		}
+	case *customList:
+		seeds = warmSeeds(m.domains)
+	case andMatcher:
+		for _, part := range m {
+			seeds = append(seeds, warmSeeds(part)...)
+		}
+	}
+	if len(seeds) > warmSeedMax {
+		seeds = seeds[:warmSeedMax]
+	}
+	return seeds
+}
+
+// sparePool keeps connections to an upstream proxy ready for requests,
+// negotiated as far as the protocol allows before the destination is known;
+// it starts filling on first use
+type sparePool struct {
+	greet func() (net.Conn, error) // Opens a prepared connection
+	once  sync.Once
+	ch    chan spareConn
+}
+
+type spareConn struct {
+	conn net.Conn
+	made time.Time
+}
+
+// newSparePool keeps size connections ready, at least spareConns
+func newSparePool(greet func() (net.Conn, error), size int) *sparePool {
+	return &sparePool{greet: greet, ch: make(chan spareConn, max(size, spareConns))}
+}
+
+// noReplyError is a request that failed before the proxy sent any byte of
+// its reply. On a spare connection it means the connection went stale in
+// the pool, and the request is retried on a fresh one; failures the proxy
+// answered are returned as they are, so refusals are not sent twice.
+type noReplyError struct {
+	err error
+}
+
+func (e *noReplyError) Error() string { return e.err.Error() }
+func (e *noReplyError) Unwrap() error { return e.err }
+
+// replyConn records whether the proxy answered on a connection
+type replyConn struct {
+	net.Conn
+	answered bool
+}
+
+func (c *replyConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.answered = true
+	}
+	return n, err
+}
+
+// take returns a fresh spare connection, or nil when none is ready
+func (p *sparePool) take() net.Conn {
+	p.once.Do(func() { go p.fill() })
+	for {
+		select {
+		case c := <-p.ch:
+			if time.Since(c.made) < spareMaxAge {
+				return c.conn
+			}
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// fill keeps the pool full, replacing connections that got too old
+func (p *sparePool) fill() {
+	for {
+		conn, err := p.greet()
+		if err != nil {
+			log.Printf("Spare connection: %v\n", err)
+			time.Sleep(spareBackoff)
+			continue
+		}
+		c := spareConn{conn: conn, made: time.Now()}
+		for sent := false; !sent; {
+			select {
+			case p.ch <- c:
+				sent = true
+			case <-time.After(spareMaxAge / 2):
+				// Full of idle connections: replace the oldest
+				select {
+				case old := <-p.ch:
+					old.conn.Close()
+				default:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// WatchdogConfig enables the stall watchdog: when a relay write has been
+// blocked for longer than Stall, the stacks of all goroutines are dumped
+// once per Interval to capture evidence of deadlocks
+type WatchdogConfig struct {
+	Stall    Duration `json:"stall"`    // How long a write may block, default 5m
+	Interval Duration `json:"interval"` // Least time between dumps, default 1h
+	Dir      string   `json:"dir"`      // Directory for dump files, empty to log the stacks
+}
+
+// watchdog checks the sessions for stalled writes every stall/4
+func watchdog(cfg *WatchdogConfig) {
+	if cfg.Stall == 0 {
+		cfg.Stall = Duration(5 * time.Minute)
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = Duration(time.Hour)
+	}
+	stall, interval := time.Duration(cfg.Stall), time.Duration(cfg.Interval)
+	var lastDump time.Time
+	reported := map[uint64]bool{} // Stalled sessions already logged
+	for {
+		time.Sleep(stall / 4)
+		stalled := map[uint64]bool{}
+		fresh := false
+		for _, s := range sessions.list() {
+			since := s.writingSince()
+			if since.IsZero() || time.Since(since) <= stall {
+				continue
+			}
+			stalled[s.ID] = true
+			if !reported[s.ID] {
+				fresh = true
+				log.Printf("Watchdog: session %d %s -> %s stalled in a write for %s\n",
+					s.ID, s.Source, s.Dest, time.Since(since).Round(time.Second))
+			}
+		}
+		reported = stalled
+		if !fresh {
+			continue
+		}
+		if !lastDump.IsZero() && time.Since(lastDump) < interval {
+			continue
+		}
+		lastDump = time.Now()
+		dumpStacks(cfg.Dir)
+	}
+}
+
+// dumpStacks writes the stacks of all goroutines to a file in dir, or to
+// the log when dir is empty
+func dumpStacks(dir string) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	if dir == "" {
+		log.Printf("Watchdog: goroutine dump (%d goroutines)\n%s", runtime.NumGoroutine(), buf)
+		return
+	}
+	name := filepath.Join(dir, fmt.Sprintf("goroutines-%s.txt", time.Now().Format("20060102-150405")))
+	if err := os.WriteFile(name, buf, 0644); err != nil {
+		log.Println("Watchdog: write goroutine dump:", err)
+		return
+	}
+	log.Printf("Watchdog: goroutine dump written to %s\n", name)
+}
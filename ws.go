@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsPath expands "{random}" placeholders so each connection uses a
+// different path
+func wsPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	for strings.Contains(path, "{random}") {
+		b := make([]byte, 8)
+		rand.Read(b)
+		path = strings.Replace(path, "{random}", hex.EncodeToString(b), 1)
+	}
+	return path
+}
+
+// wsGUID is the fixed key suffix of RFC 6455
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsHandshake upgrades conn to a WebSocket
+func wsHandshake(conn net.Conn, addr string, t *TransportConfig, chunk int) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	host := t.Host
+	if host == "" {
+		host = addr
+	}
+	req, err := http.NewRequest("GET", "http://"+host+wsPath(t.Path), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade: %s", resp.Status)
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("websocket upgrade: bad Sec-WebSocket-Accept")
+	}
+	return newWSConn(conn, br, chunk), nil
+}
+
+// wsConn carries a byte stream in binary WebSocket frames. Writes are
+// coalesced: while a frame is being sent, further writes collect into the
+// next one instead of each becoming its own small frame, and data is cut
+// into frames sized to fill whole TCP segments.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	remaining int64  // Payload bytes left in the current frame
+	mask      []byte // Mask of the current frame, nil when unmasked
+	maskPos   int
+
+	chunk    int        // Payload size of full data frames
+	wmu      sync.Mutex // Guards pending, flushing and werr
+	wcond    *sync.Cond // Signals flushed data, on wmu
+	pending  []byte     // Written data not yet framed
+	flushing bool       // A flush is sending pending
+	werr     error      // Failure of an earlier flush, returned by later writes
+	smu      sync.Mutex // Serializes frames on the connection
+}
+
+// wsCloseFlush bounds how long Close waits for pending data to be sent
+const wsCloseFlush = time.Second
+
+func newWSConn(conn net.Conn, br *bufio.Reader, chunk int) *wsConn {
+	c := &wsConn{Conn: conn, br: br, chunk: chunk}
+	c.wcond = sync.NewCond(&c.wmu)
+	return c
+}
+
+// wsFrameSize returns the payload size of full data frames for a path MSS
+// (0 when unknown): the frame, with its header and, under TLS, the TLS 1.3
+// record overhead, fills whole TCP segments and fits in one TLS record
+func wsFrameSize(mss int, overTLS bool) int {
+	const (
+		maxRecord   = 16384 // Largest TLS record payload
+		frameHeader = 2 + 2 + 4
+		tlsOverhead = 5 + 1 + 16 // Record header, content type, AEAD tag
+	)
+	if mss <= 0 {
+		mss = 1460
+	}
+	overhead := frameHeader
+	if overTLS {
+		overhead += tlsOverhead
+	}
+	segments := (maxRecord - frameHeader + overhead) / mss
+	if segments == 0 {
+		// Jumbo or loopback MSS: a single record is less than a segment
+		return maxRecord - frameHeader
+	}
+	return segments*mss - overhead
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	for i := 0; i < n && c.mask != nil; i++ {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers, answering control frames, until a data
+// frame starts
+func (c *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	opcode := hdr[0] & 0x0f
+	length := int64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(b[:]) & (1<<63 - 1))
+	}
+	c.mask, c.maskPos = nil, 0
+	if hdr[1]&0x80 != 0 {
+		c.mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.br, c.mask); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case 0x0, 0x1, 0x2: // Continuation, text, binary
+		c.remaining = length
+		return nil
+	case 0x3, 0x4, 0x5, 0x6, 0x7:
+		return fmt.Errorf("websocket: reserved opcode %d", opcode)
+	}
+	// Control frames are at most 125 bytes and never fragmented (RFC 6455
+	// section 5.5); check before allocating the payload
+	if length > 125 || hdr[0]&0x80 == 0 {
+		return fmt.Errorf("websocket: invalid control frame")
+	}
+	if opcode == 0x8 { // Close
+		return io.EOF
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	for i := range payload {
+		if c.mask != nil {
+			payload[i] ^= c.mask[i&3]
+		}
+	}
+	if opcode == 0x9 {
+		return c.writeFrame(0xa, payload)
+	}
+	return nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		for len(c.pending) >= c.chunk && c.werr == nil {
+			c.wcond.Wait()
+		}
+		if c.werr != nil {
+			return written, c.werr
+		}
+		n := min(len(p), c.chunk-len(c.pending))
+		c.pending = append(c.pending, p[:n]...)
+		p = p[n:]
+		written += n
+		if !c.flushing {
+			c.flushing = true
+			go c.flush()
+		}
+	}
+	return written, c.werr
+}
+
+// flush sends the pending data in frames until none is left
+func (c *wsConn) flush() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for len(c.pending) > 0 && c.werr == nil {
+		n := min(len(c.pending), c.chunk)
+		frame := appendFrame(nil, 0x2, c.pending[:n])
+		c.pending = append(c.pending[:0], c.pending[n:]...)
+		c.wcond.Broadcast()
+		c.wmu.Unlock()
+		err := c.send(frame)
+		c.wmu.Lock()
+		if err != nil {
+			c.werr = err
+		}
+	}
+	c.flushing = false
+	c.wcond.Broadcast()
+}
+
+// Close sends the pending data, waiting at most wsCloseFlush, and closes
+// the connection
+func (c *wsConn) Close() error {
+	c.wmu.Lock()
+	if c.flushing {
+		c.Conn.SetWriteDeadline(time.Now().Add(wsCloseFlush))
+		for c.flushing {
+			c.wcond.Wait()
+		}
+	}
+	c.wmu.Unlock()
+	return c.Conn.Close()
+}
+
+// writeFrame sends one frame right away, for control frames
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	return c.send(appendFrame(nil, opcode, payload))
+}
+
+func (c *wsConn) send(frame []byte) error {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// appendFrame appends a masked frame, as clients must send
+func appendFrame(buf []byte, opcode byte, payload []byte) []byte {
+	buf = slices.Grow(buf, 14+len(payload))
+	buf = append(buf, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, 0x80|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 0x80|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 0x80|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	var mask [4]byte
+	rand.Read(mask[:])
+	buf = append(buf, mask[:]...)
+	for i, b := range payload {
+		buf = append(buf, b^mask[i&3])
+	}
+	return buf
+}
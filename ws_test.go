@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// readWSFrame reads one frame as a server, unmasking client frames
+func readWSFrame(br *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	var mask [4]byte
+	masked := hdr[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(br, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		if masked {
+			payload[i] ^= mask[i&3]
+		}
+	}
+	if !masked {
+		return 0, nil, fmt.Errorf("unmasked client frame")
+	}
+	return hdr[0] & 0x0f, payload, nil
+}
+
+// appendServerFrame appends an unmasked frame, as servers send
+func appendServerFrame(buf []byte, opcode byte, payload []byte) []byte {
+	buf = append(buf, 0x80|opcode)
+	if len(payload) < 126 {
+		buf = append(buf, byte(len(payload)))
+	} else {
+		buf = append(buf, 126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	}
+	return append(buf, payload...)
+}
+
+// serveWSEcho upgrades the connection, pings the client once and echoes
+// its data frames back, each checked against the frame size
+func serveWSEcho(conn net.Conn, accept func(key string) string, chunk int, got chan<- *http.Request, errc chan<- error) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		errc <- err
+		return
+	}
+	got <- req
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		accept(req.Header.Get("Sec-WebSocket-Key")))
+	if _, err := conn.Write(appendServerFrame(nil, 0x9, []byte("ping"))); err != nil {
+		errc <- err
+		return
+	}
+	pong := false
+	for {
+		opcode, payload, err := readWSFrame(br)
+		if err != nil {
+			if !pong {
+				err = fmt.Errorf("ping not answered: %v", err)
+			} else if err == io.EOF {
+				err = nil
+			}
+			errc <- err
+			return
+		}
+		switch opcode {
+		case 0xa:
+			pong = bytes.Equal(payload, []byte("ping"))
+		case 0x2:
+			if len(payload) > chunk {
+				errc <- fmt.Errorf("%d-byte frame, chunk is %d", len(payload), chunk)
+				return
+			}
+			if _, err := conn.Write(appendServerFrame(nil, 0x2, payload)); err != nil {
+				errc <- err
+				return
+			}
+		default:
+			errc <- fmt.Errorf("unexpected opcode %#x", opcode)
+			return
+		}
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection; unlike
+// net.Pipe, it buffers, so both sides may write at once as over a network
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// TestWSTransport upgrades a connection with fronting settings and
+// carries a stream over it in both directions
+func TestWSTransport(t *testing.T) {
+	const chunk = 1000
+	client, server := tcpPair(t)
+	got, errc := make(chan *http.Request, 1), make(chan error, 1)
+	go serveWSEcho(server, wsAccept, chunk, got, errc)
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	tc := &TransportConfig{Path: "/tunnel/{random}", Host: "cdn.example", Headers: map[string]string{"X-Token": "abc"}}
+	ws, err := wsHandshake(client, "upstream.example:443", tc, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-got
+	if req.Host != "cdn.example" {
+		t.Errorf("Host %q, want cdn.example", req.Host)
+	}
+	if !regexp.MustCompile(`^/tunnel/[0-9a-f]{16}$`).MatchString(req.URL.Path) {
+		t.Errorf("path %q, want a random one under /tunnel/", req.URL.Path)
+	}
+	if v := req.Header.Get("X-Token"); v != "abc" {
+		t.Errorf("X-Token %q, want abc", v)
+	}
+
+	stream := testStream(20000)
+	go func() {
+		for p := stream; len(p) > 0; p = p[min(len(p), 3333):] {
+			ws.Write(p[:min(len(p), 3333)])
+		}
+	}()
+	echo := make([]byte, len(stream))
+	if _, err := io.ReadFull(ws, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, stream) {
+		t.Error("echoed stream differs from the one sent")
+	}
+	ws.Close()
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWSHandshakeBadAccept(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	errc := make(chan error, 1)
+	go serveWSEcho(server, func(string) string { return "bogus" }, 1000, make(chan *http.Request, 1), errc)
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := wsHandshake(client, "upstream.example:443", &TransportConfig{}, 1000); err == nil {
+		t.Error("handshake with a bad Sec-WebSocket-Accept succeeded")
+	}
+}
+
+func TestWSPath(t *testing.T) {
+	if p := wsPath(""); p != "/" {
+		t.Errorf("empty path is %q, want /", p)
+	}
+	a, b := wsPath("/{random}/{random}"), wsPath("/{random}/{random}")
+	if a == b || !regexp.MustCompile(`^/[0-9a-f]{16}/[0-9a-f]{16}$`).MatchString(a) {
+		t.Errorf("random paths %q and %q", a, b)
+	}
+}
+
+// TestWSControlFrames reads frames a server sent: control frames longer
+// than 125 bytes or fragmented fail before their payload is allocated
+func TestWSControlFrames(t *testing.T) {
+	ping := appendServerFrame(nil, 0x9, []byte("ping"))
+	data := appendServerFrame(nil, 0x2, []byte("hi"))
+	tests := []struct {
+		name   string
+		frames []byte
+		ok     bool
+	}{
+		{"ping then data", append(ping, data...), true},
+		{"huge ping", []byte{0x89, 127, 0, 0, 1, 0, 0, 0, 0, 0}, false},
+		{"126-byte ping", appendServerFrame(nil, 0x9, make([]byte, 126)), false},
+		{"fragmented ping", append([]byte{0x09, 4}, "ping"...), false},
+		{"huge close", []byte{0x88, 127, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, false},
+		{"reserved opcode", []byte{0x83, 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := newWSConn(newMemConn(nil), bufio.NewReader(bytes.NewReader(tt.frames)), 1000)
+			buf := make([]byte, 16)
+			n, err := ws.Read(buf)
+			if tt.ok && (err != nil || string(buf[:n]) != "hi") {
+				t.Errorf("read %q, %v, want \"hi\"", buf[:n], err)
+			}
+			if !tt.ok && (err == nil || err == io.EOF || err == io.ErrUnexpectedEOF) {
+				t.Errorf("read %q, %v, want an invalid frame error", buf[:n], err)
+			}
+		})
+	}
+}